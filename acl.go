@@ -0,0 +1,67 @@
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ACL is an access control list of client networks and TSIG keys. An empty ACL allows nobody.
+type ACL []ACLEntry
+
+// ACLEntry matches either the clients in a network, or the requests signed with a TSIG key.
+type ACLEntry struct {
+	Prefix netip.Prefix
+	Key    Domain // Name of the TSIG key, as a lowercase FQDN. Empty if the entry is a network.
+}
+
+// ParseACLEntry parses an IP address or a network in CIDR notation, e.g. "192.0.2.0/24", into an ACL entry.
+// A bare address only matches itself. "key:<name>" matches requests signed with the TSIG key name.
+func ParseACLEntry(s string) (ACLEntry, error) {
+	if name, ok := strings.CutPrefix(s, "key:"); ok {
+		key := Domain(strings.ToLower(name))
+		if !key.Valid() {
+			return ACLEntry{}, fmt.Errorf("Invalid TSIG key name %q", name)
+		}
+		return ACLEntry{Key: key.AsFQDN()}, nil
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return ACLEntry{Prefix: netip.PrefixFrom(addr, addr.BitLen())}, nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return ACLEntry{}, fmt.Errorf("Invalid address or network %q", s)
+	}
+	return ACLEntry{Prefix: prefix.Masked()}, nil
+}
+
+// Allows reports whether client is in any of the networks of the ACL, or signed its request with any of the
+// keys of the ACL.
+func (a ACL) Allows(client Client) bool {
+	addr := client.Addr.Addr().Unmap() // IPv4 clients of dual-stack sockets arrive as IPv4-mapped IPv6 addresses.
+	for _, entry := range a {
+		if entry.Key != "" {
+			if client.Key != nil && client.Key.Name == entry.Key {
+				return true
+			}
+		} else if entry.Prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a ACL) String() string {
+	entries := make([]string, len(a))
+	for i, entry := range a {
+		entries[i] = entry.String()
+	}
+	return strings.Join(entries, " ")
+}
+
+func (e ACLEntry) String() string {
+	if e.Key != "" {
+		return "key:" + e.Key.String()
+	}
+	return e.Prefix.String()
+}
@@ -0,0 +1,176 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// aliasTimeout is how long the resolver has to answer each attempt to look up an ALIAS target.
+	aliasTimeout = time.Second
+	// aliasAttempts is how many times an ALIAS target is looked up before giving up.
+	aliasAttempts = 3
+	// aliasNegativeTTL is how long it's cached that an ALIAS target has no addresses of a type.
+	aliasNegativeTTL = time.Minute
+	// aliasCacheMax is the number of lookups cached before the cache is emptied.
+	aliasCacheMax = 10000
+)
+
+// aliasCache holds the addresses the resolver gave for ALIAS targets, until their TTLs run out.
+type aliasCache struct {
+	mu      sync.Mutex
+	entries map[string]aliasEntry // By lowercase target name and type, see resolveAlias.
+}
+
+type aliasEntry struct {
+	rrs     []RR
+	expires time.Time
+}
+
+// get returns the cached records for key, if they haven't expired by now. Their TTLs are what's left of them.
+func (c *aliasCache) get(key string, now time.Time) ([]RR, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || !now.Before(entry.expires) {
+		return nil, false
+	}
+	left := uint32(entry.expires.Sub(now).Seconds())
+	rrs := make([]RR, len(entry.rrs))
+	for i, rr := range entry.rrs {
+		rrs[i] = rr
+		rrs[i].TTL = min(rr.TTL, left)
+	}
+	return rrs, true
+}
+
+// put will cache rrs under key until expires. The whole cache is emptied when it's full.
+func (c *aliasCache) put(key string, rrs []RR, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || len(c.entries) >= aliasCacheMax {
+		c.entries = make(map[string]aliasEntry)
+	}
+	c.entries[key] = aliasEntry{rrs: rrs, expires: expires}
+}
+
+// aliasAddresses returns the addresses of type t (A or AAAA) for the target of alias, an ALIAS record of zone, as
+// records owned by the ALIAS record's name with TTLs no longer than its own.
+// Targets in our zones are looked up in zones, following CNAMEs and DNAMEs as any query would. Other targets,
+// including those our CNAMEs lead to, are looked up with AliasResolver and cached.
+func (s *Server) aliasAddresses(zones *Trie[Zone], zone *Zone, alias RData, t RecType, logHead string, recurCount uint) ([]RData, error) {
+	var rrs []RR
+	target := alias.Target.AsFQDN()
+	if _, ok := findZone(zones, target); ok {
+		var local DNSMsg
+		q := Question{Name: target, Type: t, Class: QClassIN}
+		if rcode := s.answer(q, zones, &local, logHead, recurCount); rcode == rcodeServFail {
+			errStr := fmt.Sprintf("Could not look up %v %v in our zones", target, t)
+			return nil, errors.New(errStr)
+		}
+		rrs = local.Answer
+		target = ""
+		if n := len(rrs); n > 0 && rrs[n-1].Type == TypeCNAME {
+			if _, ok := findZone(zones, rrs[n-1].RData.Target); !ok {
+				target = rrs[n-1].RData.Target.AsFQDN() // The CNAME led out of our zones.
+			}
+		}
+	}
+	if target != "" {
+		var err error
+		if rrs, err = s.resolveAlias(target, t); err != nil {
+			return nil, err
+		}
+	}
+
+	ttl := alias.TTLOrDefault(*zone)
+	var addrs []RData
+	for _, rr := range rrs {
+		if rr.Type == t {
+			addrs = append(addrs, RData{Name: alias.Name, Type: t, Addr: rr.RData.Addr, TTL: min(ttl, uint(rr.TTL))})
+		}
+	}
+	return addrs, nil
+}
+
+// resolveAlias returns the records of type t at name, an ALIAS target outside our zones, from the cache or by
+// asking AliasResolver.
+func (s *Server) resolveAlias(name Domain, t RecType) ([]RR, error) {
+	if !s.AliasResolver.IsValid() {
+		errStr := fmt.Sprintf("%v isn't in our zones, and there's no resolver to look it up with", name)
+		return nil, errors.New(errStr)
+	}
+	key := strings.ToLower(name.String()) + " " + t.String()
+	now := time.Now()
+	if rrs, ok := s.aliases.get(key, now); ok {
+		return rrs, nil
+	}
+	rrs, ttl, err := lookup(s.AliasResolver, name, t)
+	if err != nil {
+		return nil, err
+	}
+	s.aliases.put(key, rrs, now.Add(ttl))
+	return rrs, nil
+}
+
+// lookup asks the recursive resolver for the records of type t at name over UDP, up to aliasAttempts times.
+// The records of type t in the answer are returned, along with how long they may be cached for: their smallest
+// TTL, or aliasNegativeTTL if there are none.
+func lookup(resolver netip.AddrPort, name Domain, t RecType) (rrs []RR, ttl time.Duration, err error) {
+	query := DNSMsg{
+		Header:   Header{ID: uint16(rand.Uint32()), QR: qrQuery, Opcode: opcodeQuery, RD: true},
+		Question: []Question{{Name: name, Type: t, Class: QClassIN}},
+		EDNS:     &EDNS{UDPSize: ednsUDPSize},
+	}
+	payload, err := query.Serialise()
+	if err != nil {
+		return nil, 0, err
+	}
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(resolver))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, ednsUDPSize)
+	for range aliasAttempts {
+		if _, err = conn.Write(payload); err != nil {
+			return nil, 0, err
+		}
+		deadline := time.Now().Add(aliasTimeout)
+		conn.SetReadDeadline(deadline)
+		for time.Now().Before(deadline) {
+			var n int
+			if n, err = conn.Read(buf); err != nil {
+				time.Sleep(time.Until(deadline))
+				break
+			}
+			reply, err := ParseDNSMsg(buf[:n])
+			if err != nil || reply.Header.ID != query.Header.ID || reply.Header.QR != qrReply {
+				continue // Not a reply to our query.
+			}
+			if reply.Header.TC || (reply.Header.Rcode != rcodeNoError && reply.Header.Rcode != rcodeNxdomain) {
+				errStr := fmt.Sprintf("Resolver %v couldn't look up %v %v, rcode %v", resolver, name, t, reply.Header.Rcode)
+				return nil, 0, errors.New(errStr)
+			}
+			ttl = aliasNegativeTTL
+			for _, rr := range reply.Answer {
+				if rr.Type == t {
+					if len(rrs) == 0 || time.Duration(rr.TTL)*time.Second < ttl {
+						ttl = time.Duration(rr.TTL) * time.Second
+					}
+					rrs = append(rrs, rr)
+				}
+			}
+			return rrs, ttl, nil
+		}
+	}
+	errStr := fmt.Sprintf("No reply from resolver %v after %v attempts, last error: %v", resolver, aliasAttempts, err)
+	return nil, 0, errors.New(errStr)
+}
@@ -0,0 +1,127 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+// testResolver serves as a recursive resolver on a local UDP socket, which has an A record for every name and
+// no AAAA records. The number of queries it's been sent is counted.
+func testResolver(t *testing.T, queries *atomic.Int32) netip.AddrPort {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, ednsUDPSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			query, err := ParseDNSMsg(buf[:n])
+			if err != nil {
+				continue
+			}
+			queries.Add(1)
+			reply := NewDNSMsg(query)
+			if q := query.Question[0]; q.Type == TypeA {
+				a := RData{Type: TypeA, Addr: netip.MustParseAddr("198.51.100.7"), TTL: 600}
+				reply.Answer = []RR{a.RR(q.Name)}
+			}
+			payload, _ := reply.Serialise()
+			conn.WriteToUDP(payload, addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+// TestALIAS ensures ALIAS records are answered with the addresses of their targets, from our zones or the
+// resolver, which are cached, and that they can't have address records beside them.
+func TestALIAS(t *testing.T) {
+	var queries atomic.Int32
+	dir := t.TempDir()
+	testZoneFile(t, dir, 1, "@ ALIAS www.example.com.\nwww A 192.0.2.1\nwww AAAA 2001:db8::1 60\n"+
+		"lb ALIAS cdn.example.com.\ncdn CNAME edge.example.org.\next ALIAS host.example.org.\nmissing ALIAS nothing.example.com.")
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir, AliasResolver: testResolver(t, &queries)})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+
+	tests := []struct {
+		name  Domain
+		rtype RecType
+		addrs []string
+	}{
+		{"example.com", TypeA, []string{"192.0.2.1"}},
+		{"example.com", TypeAAAA, []string{"2001:db8::1"}},
+		{"example.com", TypeMX, nil},
+		{"lb.example.com", TypeA, []string{"198.51.100.7"}},
+		{"ext.example.com", TypeA, []string{"198.51.100.7"}},
+		{"ext.example.com", TypeA, []string{"198.51.100.7"}},
+		{"ext.example.com", TypeAAAA, nil},
+		{"missing.example.com", TypeA, nil},
+	}
+	for _, test := range tests {
+		reply := testRespond(t, server, testQuery(test.name, test.rtype))
+		var addrs []string
+		for _, rr := range reply.Answer {
+			if rr.Name.AsFQDN() != test.name.AsFQDN() || rr.Type != test.rtype || rr.TTL > 300 {
+				t.Errorf("%v %v: expected records owned by the ALIAS name with its TTL at most, got %v", test.name, test.rtype, rr)
+			}
+			addrs = append(addrs, rr.RData.DataString())
+		}
+		if reply.Header.Rcode != rcodeNoError || !slices.Equal(addrs, test.addrs) {
+			t.Errorf("%v %v: expected %v, got rcode %v and %v", test.name, test.rtype, test.addrs, reply.Header.Rcode, reply.Answer)
+		}
+	}
+	if n := queries.Load(); n != 3 {
+		t.Errorf("Expected the resolver to be asked 3 times, with the answers cached, got %v", n)
+	}
+
+	// The ALIAS records themselves are only sent in zone transfers.
+	reply := testRespond(t, server, testQuery("example.com", TypeALIAS))
+	if reply.Header.Rcode != rcodeNoError || len(reply.Answer) != 0 ||
+		len(reply.Authority) != 1 || reply.Authority[0].Type != TypeSOA {
+		t.Errorf("Expected NODATA for a query for the ALIAS record, got %+v", reply)
+	}
+	var transferred int
+	for _, msg := range testTransfer(t, server, testQuery("example.com", TypeAXFR), "192.0.2.10") {
+		for _, rr := range msg.Answer {
+			if rr.Type == TypeALIAS {
+				transferred++
+			}
+		}
+	}
+	if transferred != 4 {
+		t.Errorf("Expected the 4 ALIAS records in a zone transfer, got %v", transferred)
+	}
+
+	server = NewServer(server.Zones(), Config{})
+	if reply := testRespond(t, server, testQuery("ext.example.com", TypeA)); reply.Header.Rcode != rcodeServFail {
+		t.Errorf("Expected SERVFAIL for an ALIAS target outside our zones without a resolver, got %+v", reply)
+	}
+
+	// The addresses are signed as if they were records of the zone.
+	testDNSSECKeys(t, dir)
+	testZoneFile(t, dir, 1, "dnssec-key ed.pem\n@ ALIAS www.example.com.\nwww A 192.0.2.1")
+	server = NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load signed zone: %v", err)
+	}
+	dnskeys, _ := testSplitRRSIGs(testDNSSECQuery(t, server, "example.com", TypeDNSKEY).Answer, TypeDNSKEY)
+	rrset, sigs := testSplitRRSIGs(testDNSSECQuery(t, server, "example.com", TypeA).Answer, TypeA)
+	if len(rrset) != 1 || len(sigs) != 1 {
+		t.Fatalf("Expected a signed A record for the ALIAS, got %v %v", rrset, sigs)
+	}
+	testVerifyRRSIG(t, "example.com.", rrset, sigs[0], dnskeys)
+
+	testZoneFile(t, dir, 1, "@ ALIAS www.example.com.\n@ A 192.0.2.1")
+	if _, err := LoadZoneFiles(dir); err == nil {
+		t.Errorf("Expected an ALIAS record beside an A record not to load")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	dns "github.com/pyfon/go-dns.git"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+func init() {
+	log.SetOutput(os.Stdout)
+	log.SetLevel(log.InfoLevel)
+}
+
+func main() {
+	cfg, err := parseArgs()
+	if err != nil {
+		log.Errorln(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	zones := dns.NewTrie[dns.Zone]()
+	server := dns.NewServer(&zones, cfg)
+	if cfg.KeyFile != "" {
+		if server.Keys, err = dns.LoadKeys(cfg.KeyFile); err != nil {
+			log.Errorf("Could not load TSIG keys: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := server.LoadZones(); err != nil {
+		log.Errorf("Could not parse zone files: %v", err)
+		os.Exit(1)
+	}
+
+	g, ctx := errgroup.WithContext(context.Background())
+	g.Go(func() error {
+		return reloadOnSignal(server, ctx)
+	})
+	g.Go(func() error {
+		return server.RunSecondaries(ctx)
+	})
+	for _, sock := range cfg.Sockets {
+		g.Go(func() error {
+			return server.ServeUDP(sock, ctx)
+		})
+		g.Go(func() error {
+			return server.ServeTCP(dns.TCPAddr(sock), ctx)
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		log.Error(err)
+		os.Exit(-1)
+	}
+}
+
+// reloadOnSignal will reload the zone files whenever the process receives SIGHUP, until ctx is cancelled.
+func reloadOnSignal(server *dns.Server, ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			log.Infof("Received SIGHUP, reloading zone files")
+			if err := server.LoadZones(); err != nil {
+				log.Errorf("Could not reload zone files, still serving the old zones: %v", err)
+			}
+		}
+	}
+}
+
+func parseArgs() (cfg dns.Config, err error) {
+	flag.StringVar(&cfg.ZonePath, "zones", "", "A path to a directory containing one or more zone files")
+	flag.StringVar(&cfg.KeyFile, "keys", "", "A file of TSIG keys, one per line: name algorithm base64-secret")
+	logLevel := flag.String("logLevel", "info", "log level (debug, info, warn, error, fatal, panic)")
+	flag.Var(&cfg.Sockets, "listen", "Listen on a given ADDR:PORT pair over UDP and TCP. (use flag multiple times for multiple sockets)")
+	flag.DurationVar(&cfg.TCPIdleTimeout, "tcpIdleTimeout", 10*time.Second, "Close TCP connections which have been idle for this long")
+	flag.IntVar(&cfg.TCPMaxConns, "tcpMaxConns", 256, "Maximum number of concurrent TCP connections")
+	flag.BoolVar(&cfg.MinimalResponses, "minimalResponses", false, "Don't add the addresses of MX, NS etc. targets to the additional section")
+	flag.Func("aliasResolver", "A recursive resolver, as ADDR:PORT, to look up ALIAS targets outside our zones with", func(s string) (err error) {
+		cfg.AliasResolver, err = netip.ParseAddrPort(s)
+		return err
+	})
+	flag.Parse()
+
+	level, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		s := fmt.Sprintf("Invalid logLevel given: %v", err)
+		err = errors.New(s)
+		return
+	}
+	log.SetLevel(level)
+
+	if len(cfg.ZonePath) <= 0 {
+		s := "Missing required argument: -zones"
+		err = errors.New(s)
+		return
+	}
+
+	if len(cfg.Sockets) <= 0 {
+		s := "Missing required argument: -listen"
+		err = errors.New(s)
+		return
+	}
+
+	if cfg.TCPIdleTimeout <= 0 || cfg.TCPMaxConns <= 0 {
+		s := "-tcpIdleTimeout and -tcpMaxConns must be positive"
+		err = errors.New(s)
+		return
+	}
+
+	return
+}
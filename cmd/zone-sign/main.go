@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	dns "github.com/pyfon/go-dns.git"
+	log "github.com/sirupsen/logrus"
+)
+
+// backdate is how far before now the signatures become valid, for validators whose clock is behind ours.
+const backdate = time.Hour
+
+type config struct {
+	ZoneFile  string
+	Out       string
+	KSK       string
+	ZSK       string
+	Algorithm string
+	Validity  time.Duration
+}
+
+func main() {
+	cfg, err := parseArgs()
+	if err != nil {
+		log.Errorln(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if err := run(cfg); err != nil {
+		log.Errorln(err)
+		os.Exit(1)
+	}
+}
+
+// run will sign the zone file given in cfg, write the signed zone to cfg.Out and print the DS records of its key
+// signing keys for the parent zone.
+func run(cfg config) error {
+	zone, err := readZone(cfg.ZoneFile)
+	if err != nil {
+		return err
+	}
+	ksk, err := loadOrGenerateKey(cfg.KSK, cfg.Algorithm)
+	if err != nil {
+		return err
+	}
+	ksks, zsks := []*dns.DNSSECKey{ksk}, []*dns.DNSSECKey(nil)
+	if cfg.ZSK != "" {
+		key, err := loadOrGenerateKey(cfg.ZSK, cfg.Algorithm)
+		if err != nil {
+			return err
+		}
+		zsk, err := key.ZSK()
+		if err != nil {
+			return err
+		}
+		zsks = append(zsks, zsk)
+	}
+
+	now := time.Now()
+	signed, err := zone.Sign(ksks, zsks, now.Add(-backdate), now.Add(cfg.Validity))
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(cfg.Out, signed.ZoneFile(), 0o644); err != nil {
+		return err
+	}
+	log.Infof("Wrote %v, signatures are valid until %v", cfg.Out, now.Add(cfg.Validity).UTC().Format(time.RFC3339))
+
+	for _, key := range ksks {
+		ds, err := key.DS(zone.Name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%v DS %v\n", zone.Name.AsFQDN(), ds.DataString())
+	}
+	return nil
+}
+
+// readZone parses the zone file at path.
+func readZone(path string) (dns.Zone, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return dns.Zone{}, err
+	}
+	defer file.Close()
+	lexer := dns.NewLexer(bufio.NewReader(file))
+	parser := dns.NewParser(&lexer, filepath.Base(path))
+	return parser.Parse()
+}
+
+// loadOrGenerateKey will load the DNSSEC key at path. If there's no file there, a new key for algorithm is
+// generated and written to it first, readable only by us.
+func loadOrGenerateKey(path, algorithm string) (*dns.DNSSECKey, error) {
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		return dns.LoadDNSSECKey(path)
+	}
+	key, err := dns.GenerateDNSSECKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	pem, err := key.PEM()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(pem); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	log.Infof("Generated %v key %v", algorithm, path)
+	return key, nil
+}
+
+func parseArgs() (cfg config, err error) {
+	flag.StringVar(&cfg.ZoneFile, "zone", "", "The zone file to sign")
+	flag.StringVar(&cfg.Out, "out", "", "Where to write the signed zone file")
+	flag.StringVar(&cfg.KSK, "ksk", "", "PEM file of the key signing key, generated if it doesn't exist")
+	flag.StringVar(&cfg.ZSK, "zsk", "", "PEM file of the zone signing key, generated if it doesn't exist. Without one, the key signing key signs everything")
+	flag.StringVar(&cfg.Algorithm, "algorithm", "ED25519", "Algorithm of generated keys (ED25519, ECDSAP256SHA256)")
+	flag.DurationVar(&cfg.Validity, "validity", 30*24*time.Hour, "How long the signatures are valid for")
+	flag.Parse()
+
+	if cfg.ZoneFile == "" || cfg.Out == "" || cfg.KSK == "" {
+		s := "Missing required argument: -zone, -out and -ksk are required"
+		err = errors.New(s)
+		return
+	}
+	if cfg.Validity <= 0 {
+		s := "-validity must be positive"
+		err = errors.New(s)
+		return
+	}
+	return
+}
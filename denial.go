@@ -0,0 +1,343 @@
+package dns
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha1"
+	"encoding/base32"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Denial is how a signed zone proves that names or records don't exist.
+type Denial int
+
+const (
+	DenialNSEC    Denial = iota // NSEC records linking the names of the zone in canonical order (RFC 4034).
+	DenialNSEC3                 // NSEC3 records linking the hashes of the names of the zone (RFC 5155).
+	DenialCompact               // A single NSEC record made for the queried name, and no NXDOMAIN rcode.
+)
+
+const (
+	// nsec3SHA1 is the only NSEC3 hash algorithm (RFC 5155 section 11).
+	nsec3SHA1 byte = 1
+	// nsec3MaxIterations is the most extra NSEC3 hash iterations a zone can use. Validators treat zones with more
+	// as unsigned, as every iteration makes proofs more expensive to check (RFC 9276 section 3.2).
+	nsec3MaxIterations = 100
+	// TypeNXNAME is set in the type bit map of compact denial NSEC records for names which don't exist.
+	// It's a meta-type, which only ever appears in type bit maps.
+	TypeNXNAME RecType = 128
+)
+
+var denialNames = map[Denial]string{
+	DenialNSEC:    "nsec",
+	DenialNSEC3:   "nsec3",
+	DenialCompact: "compact",
+}
+
+// dnssecTypes are the DNSSEC record types made when a zone is signed, online by the server or offline by Zone.Sign.
+var dnssecTypes = []RecType{TypeDNSKEY, TypeRRSIG, TypeNSEC, TypeNSEC3, TypeNSEC3PARAM}
+
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+func (d Denial) String() string {
+	return denialNames[d]
+}
+
+// denialChain indexes the names of a signed zone, to find the NSEC or NSEC3 records proving a name doesn't exist.
+// It's built once for each version of the zone by NewZoneTrie, and never changed after.
+// The records are made from the index for zones signed online, and are records of the zone if it's pre-signed.
+type denialChain struct {
+	names      []string     // Owner names of the NSEC records: zone relative lowercase names in canonical order.
+	hashes     []nsec3Owner // Owners of the NSEC3 records, by hash. Empty unless the zone uses NSEC3.
+	nsec3      bool
+	salt       []byte // NSEC3 salt.
+	iterations uint16 // NSEC3 extra hash iterations.
+	presigned  bool
+}
+
+// nsec3Owner is a name of a zone with its NSEC3 hash.
+type nsec3Owner struct {
+	hash []byte
+	name string // Zone relative and lowercase.
+}
+
+// newDenialChain builds the denial chain of zone. Names below zone cuts aren't authoritative, so they're left out.
+func newDenialChain(zone *Zone) *denialChain {
+	if zone.presigned() {
+		return presignedChain(zone)
+	}
+	chain := &denialChain{nsec3: zone.Denial == DenialNSEC3, salt: zone.NSEC3Salt, iterations: zone.NSEC3Iterations}
+	for name := range zone.Records {
+		if cut, ok := zone.ZoneCut(name); ok && cut != name {
+			continue
+		}
+		chain.names = append(chain.names, name)
+	}
+	slices.SortFunc(chain.names, canonicalCompare)
+	if !chain.nsec3 {
+		return chain
+	}
+
+	// Empty non-terminals get NSEC3 records too (RFC 5155 section 7.1), so every ancestor of a name is hashed.
+	names := make(map[string]bool)
+	for _, name := range chain.names {
+		for labels := labelsFor(name); len(labels) > 0; labels = labels[1:] {
+			names[strings.Join(labels, ".")] = true
+		}
+	}
+	names[""] = true
+	for name := range maps.Keys(names) {
+		chain.hashes = append(chain.hashes, nsec3Owner{hash: chain.hash(zone, name), name: name})
+	}
+	slices.SortFunc(chain.hashes, func(a, b nsec3Owner) int { return bytes.Compare(a.hash, b.hash) })
+	return chain
+}
+
+// presignedChain indexes the NSEC or NSEC3 records of a pre-signed zone. Names are hashed with the parameters of
+// its NSEC3 records.
+func presignedChain(zone *Zone) *denialChain {
+	chain := &denialChain{presigned: true}
+	for name, rrset := range zone.Records {
+		if len(rrset.RRSet[TypeNSEC]) > 0 {
+			chain.names = append(chain.names, name)
+		}
+		if nsec3 := rrset.RRSet[TypeNSEC3]; len(nsec3) > 0 {
+			hash, err := nsec3Encoding.DecodeString(strings.ToUpper(labelsFor(name)[0]))
+			if err != nil {
+				continue
+			}
+			chain.hashes = append(chain.hashes, nsec3Owner{hash: hash, name: name})
+			chain.nsec3, chain.salt, chain.iterations = true, nsec3[0].Salt, nsec3[0].Iterations
+		}
+	}
+	slices.SortFunc(chain.names, canonicalCompare)
+	slices.SortFunc(chain.hashes, func(a, b nsec3Owner) int { return bytes.Compare(a.hash, b.hash) })
+	return chain
+}
+
+// canonicalCompare compares the zone relative lowercase names a and b in canonical DNS name order
+// (RFC 4034 section 6.1): label by label, starting from the rightmost.
+func canonicalCompare(a, b string) int {
+	la, lb := labelsFor(a), labelsFor(b)
+	for i := 1; i <= min(len(la), len(lb)); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(la), len(lb))
+}
+
+// hash returns the NSEC3 hash of the zone relative lowercase name of zone, with the chain's salt and iterations.
+func (c *denialChain) hash(zone *Zone, name string) []byte {
+	return nsec3Hash(zone.AbsoluteName(name), c.salt, c.iterations)
+}
+
+// nsec3Hash returns the NSEC3 hash of the absolute name (RFC 5155 section 5).
+func nsec3Hash(name Domain, salt []byte, iterations uint16) []byte {
+	owner := appendName(nil, Domain(strings.ToLower(name.AsFQDN().String())), nil)
+	hash := sha1.Sum(append(owner, salt...))
+	for range iterations {
+		hash = sha1.Sum(append(hash[:], salt...))
+	}
+	return hash[:]
+}
+
+// nsecIndex returns the index of the NSEC record of the chain which matches name, or covers it if match is false.
+func (c *denialChain) nsecIndex(name string) (i int, match bool) {
+	i, match = slices.BinarySearchFunc(c.names, name, canonicalCompare)
+	if match {
+		return i, true
+	}
+	// The apex comes first, so a name of the zone always has a predecessor.
+	return max(i-1, 0), false
+}
+
+// nsec3Index returns the index of the NSEC3 record of the chain which matches hash, or covers it if match is false.
+func (c *denialChain) nsec3Index(hash []byte) (i int, match bool) {
+	i, match = slices.BinarySearchFunc(c.hashes, hash, func(o nsec3Owner, h []byte) int { return bytes.Compare(o.hash, h) })
+	if match {
+		return i, true
+	}
+	if i == 0 {
+		return len(c.hashes) - 1, false // The last record covers hashes before the first, as the chain wraps around.
+	}
+	return i - 1, false
+}
+
+// typeBitmap returns the types of the records at the zone relative name, for an NSEC or NSEC3 record there.
+// Only NS and DS records are authoritative at a zone cut. withNSEC adds the NSEC record itself.
+func (z *Zone) typeBitmap(name string, withNSEC bool) []RecType {
+	rrset := z.Records[name]
+	cut := name != "" && len(rrset.RRSet[TypeNS]) > 0
+	var types []RecType
+	for t := range rrset.RRSet {
+		if !cut || t == TypeNS || t == TypeDS {
+			types = append(types, t)
+		}
+	}
+	if len(rrset.RRSet[TypeALIAS]) > 0 && !cut {
+		types = append(types, TypeA, TypeAAAA) // Looked up from the ALIAS target when queried.
+	}
+	// The records are signed, except for the NS records at a zone cut. The NSEC record is always signed.
+	if (len(types) > 0 && !cut) || len(rrset.RRSet[TypeDS]) > 0 && cut || withNSEC {
+		types = append(types, TypeRRSIG)
+	}
+	if withNSEC {
+		types = append(types, TypeNSEC)
+	}
+	slices.Sort(types)
+	return types
+}
+
+// nsecRecord returns the NSEC record at index i of the chain, with the given TTL unless the zone is pre-signed.
+func (z *Zone) nsecRecord(i int, ttl uint32) RR {
+	name := z.chain.names[i]
+	if z.chain.presigned {
+		return z.RR(z.Records[name].RRSet[TypeNSEC][0], z.AbsoluteName(name))
+	}
+	next := z.chain.names[(i+1)%len(z.chain.names)]
+	rdata := RData{Type: TypeNSEC, TTL: uint(ttl), NextName: z.AbsoluteName(next), Types: z.typeBitmap(name, true)}
+	return rdata.RR(z.AbsoluteName(name))
+}
+
+// nsec3Record returns the NSEC3 record at index i of the chain, with the given TTL unless the zone is pre-signed.
+func (z *Zone) nsec3Record(i int, ttl uint32) RR {
+	owner := z.chain.hashes[i]
+	if z.chain.presigned {
+		return z.RR(z.Records[owner.name].RRSet[TypeNSEC3][0], z.AbsoluteName(owner.name))
+	}
+	next := z.chain.hashes[(i+1)%len(z.chain.hashes)]
+	rdata := RData{
+		Type:       TypeNSEC3,
+		TTL:        uint(ttl),
+		Algorithm:  nsec3SHA1,
+		Iterations: z.chain.iterations,
+		Salt:       z.chain.salt,
+		NextHashed: next.hash,
+		Types:      z.typeBitmap(owner.name, false),
+	}
+	label := strings.ToLower(nsec3Encoding.EncodeToString(owner.hash))
+	return rdata.RR(z.AbsoluteName(label))
+}
+
+// nsec3Param returns the NSEC3PARAM record of the zone, telling secondaries how its names are hashed.
+func (z *Zone) nsec3Param() RData {
+	return RData{
+		Name:       "@",
+		Type:       TypeNSEC3PARAM,
+		Algorithm:  nsec3SHA1,
+		Iterations: z.NSEC3Iterations,
+		Salt:       z.NSEC3Salt,
+	}
+}
+
+// wantsDenial reports whether reply, from zone, should prove the nonexistence of what it doesn't answer.
+// That's the case when the client asked for DNSSEC records, and the zone is signed.
+func wantsDenial(zone *Zone, reply *DNSMsg) bool {
+	return reply.EDNS != nil && reply.EDNS.DO && (len(zone.DNSSECKeys) > 0 || zone.presigned())
+}
+
+// compactDenial reports whether the zone uses compact denial. Only zones signed online can.
+func (z *Zone) compactDenial() bool {
+	return z.Denial == DenialCompact && len(z.DNSSECKeys) > 0
+}
+
+// addDenial adds the records proving what reply doesn't say about name, an absolute name in zone, to the
+// authority section of reply (RFC 4035 section 3.1.3, RFC 5155 section 7.2). That's one of:
+//   - That there's no DS record at a zone cut, for a referral to an unsigned zone.
+//   - That name doesn't exist, and nor does a wildcard that could have matched it.
+//   - That name has no records of the queried type, which may be because a matching wildcard has none.
+//   - That name doesn't exist, so a wildcard matched it. answered is true for these wildcard answers.
+//
+// Compact denial, which has no chain, instead makes a single NSEC record at name listing its types, or none
+// at all if it doesn't exist. The NXDOMAIN rcode is then left out by the caller.
+func addDenial(zone *Zone, name Domain, answered bool, reply *DNSMsg) {
+	soa, ok := zone.NegativeSOA()
+	if !ok {
+		return
+	}
+	ttl := soa.TTL // Denial records are cached like the negative answer they prove (RFC 9077).
+	qname := queryStr(zone, name).String()
+	cut, isCut := zone.ZoneCut(qname)
+	// For names which don't exist: the closest encloser, the next closer name below it and the wildcard at it.
+	encloser, exists := zone.names.Closest(qname)
+	var nextCloser string
+	if labels := labelsFor(qname); !exists && len(labels) > 0 {
+		nextCloser = strings.Join(labels[len(labels)-len(labelsFor(encloser))-1:], ".")
+	}
+	wildcard := WildcardAt(encloser)
+
+	if zone.compactDenial() {
+		if answered {
+			return // Wildcard answers are signed as if the name existed, so there's nothing to prove.
+		}
+		owner, types := Domain(strings.ToLower(name.AsFQDN().String())), []RecType{TypeRRSIG, TypeNSEC}
+		switch {
+		case isCut:
+			owner, types = zone.AbsoluteName(cut), zone.typeBitmap(cut, true)
+		case exists:
+			types = zone.typeBitmap(qname, true)
+		default:
+			if _, ok := zone.Records[wildcard]; ok {
+				types = zone.typeBitmap(wildcard, true) // A NODATA answer from the wildcard.
+			} else if _, wildcardExists := zone.names.Closest(wildcard); !wildcardExists {
+				types = append(types, TypeNXNAME)
+			}
+		}
+		// The next name is the first possible name after the owner, so no other names are proven not to exist.
+		rdata := RData{Type: TypeNSEC, TTL: uint(ttl), NextName: "\x00." + owner, Types: types}
+		reply.Authority = append(reply.Authority, rdata.RR(owner))
+		return
+	}
+	if zone.chain == nil || len(zone.chain.names) == 0 && len(zone.chain.hashes) == 0 {
+		return
+	}
+
+	if zone.chain.nsec3 {
+		var proofs []int
+		prove := func(name string) {
+			if i, _ := zone.chain.nsec3Index(zone.chain.hash(zone, name)); !slices.Contains(proofs, i) {
+				proofs = append(proofs, i)
+			}
+		}
+		switch {
+		case isCut:
+			prove(cut)
+		case exists:
+			prove(qname)
+		case answered:
+			prove(nextCloser)
+		default:
+			prove(encloser)
+			prove(nextCloser)
+			prove(wildcard)
+		}
+		for _, i := range proofs {
+			reply.Authority = append(reply.Authority, zone.nsec3Record(i, ttl))
+		}
+		return
+	}
+
+	var proofs []int
+	prove := func(name string) {
+		if i, _ := zone.chain.nsecIndex(name); !slices.Contains(proofs, i) {
+			proofs = append(proofs, i)
+		}
+	}
+	switch {
+	case isCut:
+		prove(cut)
+	case exists:
+		prove(qname)
+	default:
+		prove(qname)
+		if !answered {
+			prove(wildcard)
+		}
+	}
+	for _, i := range proofs {
+		reply.Authority = append(reply.Authority, zone.nsecRecord(i, ttl))
+	}
+}
@@ -0,0 +1,140 @@
+package dns
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testSignedServer loads example.com, signed with the keys of testDNSSECKeys, with the given denial keyword line.
+func testSignedServer(t *testing.T, denial string) *Server {
+	dir := t.TempDir()
+	testDNSSECKeys(t, dir)
+	testZoneFile(t, dir, 1, denial+"\ndnssec-key ed.pem\na A 192.0.2.1\nc A 192.0.2.3\n*.w A 192.0.2.2")
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+	return server
+}
+
+// testVerifyDenial checks every NSEC or NSEC3 record in the authority section of reply is validly signed, and
+// returns them.
+func testVerifyDenial(t *testing.T, server *Server, reply DNSMsg, rtype RecType) []RR {
+	t.Helper()
+	dnskeys, _ := testSplitRRSIGs(testDNSSECQuery(t, server, "example.com", TypeDNSKEY).Answer, TypeDNSKEY)
+	var records []RR
+	for _, rr := range reply.Authority {
+		if rr.Type != rtype {
+			continue
+		}
+		records = append(records, rr)
+		var signed bool
+		for _, sig := range reply.Authority {
+			if sig.Type == TypeRRSIG && sig.RData.TypeCovered == rtype && strings.EqualFold(sig.Name.String(), rr.Name.String()) {
+				testVerifyRRSIG(t, rr.Name, []RR{rr}, sig, dnskeys)
+				signed = true
+			}
+		}
+		if !signed {
+			t.Errorf("%v record of %v isn't signed", rtype, rr.Name)
+		}
+	}
+	return records
+}
+
+// TestNSEC ensures NXDOMAIN and NODATA answers of signed zones carry the NSEC records proving them.
+func TestNSEC(t *testing.T) {
+	server := testSignedServer(t, "denial nsec")
+
+	// The names of the zone in canonical order are example.com, a, c and *.w. The NSEC record of a covers b,
+	// and the apex's covers the wildcard *.example.com.
+	reply := testDNSSECQuery(t, server, "b.example.com", TypeA)
+	if reply.Header.Rcode != rcodeNxdomain {
+		t.Fatalf("Expected NXDOMAIN, got rcode %v", reply.Header.Rcode)
+	}
+	var chain []string
+	for _, nsec := range testVerifyDenial(t, server, reply, TypeNSEC) {
+		chain = append(chain, nsec.Name.String()+" "+nsec.RData.NextName.String())
+	}
+	slices.Sort(chain)
+	if want := []string{"a.example.com c.example.com", "example.com a.example.com"}; !slices.Equal(chain, want) {
+		t.Errorf("Expected NSEC records %q, got %q", want, chain)
+	}
+
+	reply = testDNSSECQuery(t, server, "a.example.com", TypeAAAA)
+	nsecs := testVerifyDenial(t, server, reply, TypeNSEC)
+	if len(nsecs) != 1 || !slices.Equal(nsecs[0].RData.Types, []RecType{TypeA, TypeRRSIG, TypeNSEC}) {
+		t.Errorf("Expected an NSEC record listing the types of a, got %v", nsecs)
+	}
+
+	// The wildcard answer proves there was no closer match: x.w comes after *.w, the last name.
+	reply = testDNSSECQuery(t, server, "x.w.example.com", TypeA)
+	if nsecs := testVerifyDenial(t, server, reply, TypeNSEC); len(nsecs) != 1 || nsecs[0].Name != "*.w.example.com" {
+		t.Errorf("Expected the NSEC record of *.w.example.com for a wildcard answer, got %v", nsecs)
+	}
+}
+
+// TestNSEC3 ensures NSEC3 hashes match RFC 5155, and that NXDOMAIN answers prove the closest encloser.
+func TestNSEC3(t *testing.T) {
+	// From the example zone of RFC 5155 appendix A.
+	for name, want := range map[Domain]string{
+		"example.":     "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example.":   "35mthgpgcu1qg68fab165klnsnk3dpvl",
+		"ns1.example.": "2t7b4g4vsa5smi47k61mv5bv1a22bojr",
+	} {
+		hash := nsec3Hash(name, []byte{0xaa, 0xbb, 0xcc, 0xdd}, 12)
+		if hash := strings.ToLower(nsec3Encoding.EncodeToString(hash)); hash != want {
+			t.Errorf("Expected NSEC3 hash %v for %q, got %v", want, name, hash)
+		}
+	}
+
+	server := testSignedServer(t, "denial nsec3 1 aabbccdd")
+	signed, _ := findZone(server.Zones(), "example.com")
+	reply := testDNSSECQuery(t, server, "b.example.com", TypeA)
+	nsec3s := testVerifyDenial(t, server, reply, TypeNSEC3)
+	if reply.Header.Rcode != rcodeNxdomain || len(nsec3s) == 0 {
+		t.Fatalf("Expected NXDOMAIN with NSEC3 records, got %+v", reply)
+	}
+	// The apex is the closest encloser, b is the next closer name, and * the wildcard that doesn't exist.
+	for _, name := range []string{"", "b", "*"} {
+		hash := signed.chain.hash(signed, name)
+		var proven bool
+		for _, nsec3 := range nsec3s {
+			owner, _ := nsec3Encoding.DecodeString(strings.ToUpper(nsec3.Name.Labels()[0]))
+			next := nsec3.RData.NextHashed
+			switch {
+			case slices.Equal(owner, hash):
+				proven = name == "" // Only the closest encloser should match.
+			case string(owner) < string(next):
+				proven = proven || (string(owner) < string(hash) && string(hash) < string(next))
+			default: // The last record of the chain wraps around.
+				proven = proven || string(owner) < string(hash) || string(hash) < string(next)
+			}
+		}
+		if !proven {
+			t.Errorf("No NSEC3 record proves %q", name)
+		}
+	}
+}
+
+// TestCompactDenial ensures compact denial answers NXDOMAIN with NOERROR and an NSEC record made for the name.
+func TestCompactDenial(t *testing.T) {
+	server := testSignedServer(t, "denial compact")
+	reply := testDNSSECQuery(t, server, "b.example.com", TypeA)
+	nsecs := testVerifyDenial(t, server, reply, TypeNSEC)
+	if reply.Header.Rcode != rcodeNoError || len(nsecs) != 1 {
+		t.Fatalf("Expected NOERROR with an NSEC record, got %+v", reply)
+	}
+	nsec := nsecs[0]
+	if nsec.Name != "b.example.com" || nsec.RData.NextName != "\x00.b.example.com" ||
+		!slices.Equal(nsec.RData.Types, []RecType{TypeRRSIG, TypeNSEC, TypeNXNAME}) {
+		t.Errorf("Expected a compact NSEC record for b.example.com, got %v", nsec.RData.DataString())
+	}
+
+	// Without the DO bit, the rcode is still NXDOMAIN.
+	query := testQuery("b.example.com", TypeA)
+	if reply := testRespond(t, server, query); reply.Header.Rcode != rcodeNxdomain {
+		t.Errorf("Expected NXDOMAIN without the DO bit, got %v", reply.Header.Rcode)
+	}
+}
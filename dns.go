@@ -1,90 +1,363 @@
-package main
+package dns
 
 import (
 	"fmt"
+	"math"
+	"net/netip"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// Respond will respond to a DNS query using the given zones.
+// Client describes where a query came from.
+type Client struct {
+	Addr netip.AddrPort
+	TCP  bool
+	Key  *TSIGKey // The TSIG key the query was signed with, nil if it isn't signed.
+}
+
+// Respond will respond to a DNS query using the server's zones.
 // query is the full query from the wire, truncated to the request data (no zeroes from the buffer).
+// UDP replies are truncated to the size the client can accept.
 // logHead is a string containing information about the request for logging purposes.
-func Respond(queryBuf []byte, zones *Trie[Zone], logHead string) []byte {
+func (s *Server) Respond(queryBuf []byte, client Client, logHead string) []byte {
+	var reply []byte
+	s.RespondStream(queryBuf, client, logHead, func(msg []byte) error {
+		reply = msg
+		return nil
+	})
+	return reply
+}
+
+// RespondStream will respond to a DNS query like Respond, passing each reply message to send.
+// Most queries get a single reply message, but zone transfers over TCP are streamed over many messages.
+// An error is returned if send fails.
+func (s *Server) RespondStream(queryBuf []byte, client Client, logHead string, send func([]byte) error) error {
 	query, err := ParseDNSMsg(queryBuf)
 	if err != nil {
 		log.Errorf("%v Error when parsing request: %v", logHead, err)
-		return errReply(query, rcodeFormErr, logHead)
+		return send(errReply(query, rcodeFormErr, logHead))
 	}
 
 	logHead = fmt.Sprintf("%s [%s]", logHead, queryInfo(query))
 
-	answers := make(map[Domain][]RData)
+	// Replies to signed queries are signed too (RFC 8945).
+	if query.TSIG != nil {
+		var reply []byte
+		if client.Key, reply = s.verifyRequest(queryBuf, query, logHead); client.Key == nil {
+			return send(reply)
+		}
+		send = tsigSigner(client.Key, query.TSIG.MAC, send)
+	}
+
+	switch query.Header.Opcode {
+	case opcodeQuery:
+	case opcodeNotify:
+		return send(s.HandleNotify(query, client, logHead))
+	case opcodeUpdate:
+		return send(s.HandleUpdate(query, client, logHead))
+	default:
+		log.Infof("%v [NOTIMP] Unsupported opcode %v", logHead, query.Header.Opcode)
+		return send(errReply(query, rcodeNotImplemented, logHead))
+	}
+	if len(query.Question) == 1 && query.Question[0].Type == TypeAXFR {
+		if !client.TCP {
+			log.Infof("%v [NOTIMP] AXFR is only supported over TCP", logHead)
+			return send(errReply(query, rcodeNotImplemented, logHead))
+		}
+		return s.TransferZone(query, client, logHead, send)
+	}
+	if len(query.Question) == 1 && query.Question[0].Type == TypeIXFR {
+		return s.IncrementalTransfer(query, client, logHead, send)
+	}
+	return send(s.respond(query, client, logHead))
+}
+
+// respond answers a parsed query with a single reply message.
+func (s *Server) respond(query DNSMsg, client Client, logHead string) []byte {
+	if query.EDNS != nil && query.EDNS.Version > ednsVersion {
+		log.Infof("%v Unsupported EDNS version %v, returning BADVERS", logHead, query.EDNS.Version)
+		reply := NewDNSMsgErr(query, rcodeNoError)
+		reply.SetRcode(rcodeBadVers)
+		payload, err := reply.Serialise()
+		if err != nil {
+			log.Errorf("%v Could not serialise BADVERS reply: %v", logHead, err)
+			return errReply(query, rcodeServFail, logHead)
+		}
+		return payload
+	}
+
+	zones := s.Zones()
+	reply := NewDNSMsg(query)
 	for _, q := range query.Question {
-		a, rcode, errMsg := answer(q, zones, query, logHead, 0)
+		rcode := s.answer(q, zones, &reply, logHead, 0)
+		if rcode == rcodeServFail || rcode == rcodeRefused {
+			return errReply(query, rcode, logHead)
+		}
 		if rcode != rcodeNoError {
-			return errMsg
+			reply.Header.Rcode = rcode
+			break
 		}
-		answers[q.Name] = append(answers[q.Name], a...)
 	}
-
-	replyMsg, err := NewDNSMsg(query, answers)
-	if err != nil {
-		log.Errorf("%v Error when constructing NewDNSMsg for reply: %v", logHead, err)
-		return errReply(query, rcodeServFail, logHead)
+	if !s.MinimalResponses {
+		addAdditional(zones, &reply)
+	}
+	if query.EDNS != nil && query.EDNS.DO {
+		if err := s.signReply(zones, &reply); err != nil {
+			log.Errorf("%v Could not sign reply: %v", logHead, err)
+			return errReply(query, rcodeServFail, logHead)
+		}
 	}
 
-	reply, err := replyMsg.Serialise()
+	limit := math.MaxUint16
+	if !client.TCP {
+		limit = query.EDNS.MaxUDPSize()
+	}
+	if client.Key != nil {
+		limit -= client.Key.recordLen() // Leave room to sign the reply.
+	}
+	payload, err := reply.SerialiseLimit(limit)
 	if err != nil {
 		log.Errorf("%v Could not serialise reply: %v", logHead, err)
 		return errReply(query, rcodeServFail, logHead)
 	}
 
-	log.Infof("%v [NoError]", logHead)
-	return reply
+	if reply.Header.Rcode == rcodeNoError {
+		log.Infof("%v [NoError]", logHead)
+	}
+	return payload
 }
 
-// answer attempts to recursively answer one question using all the given zones.
-func answer(q Question, zones *Trie[Zone], orig DNSMsg, logHead string, recurCount uint) (answers []RData, rcode byte, errMsg []byte) {
+// answer attempts to recursively answer one question using all the given zones, adding records to reply.
+// CNAMEs, and those synthesised from DNAME records, are followed through our zones. ALIAS records are answered
+// with the addresses of their targets.
+// NXDOMAIN and NODATA answers get the zone's SOA record in the authority section.
+// The returned rcode is that of the last name in any CNAME chain followed.
+func (s *Server) answer(q Question, zones *Trie[Zone], reply *DNSMsg, logHead string, recurCount uint) (rcode byte) {
 	if recurCount > 50 {
 		log.Errorf("%v Recursion hit maximum limit", logHead)
-		errMsg = errReply(orig, rcodeServFail, logHead)
-		return
+		return rcodeServFail
 	}
 	recurCount++
 
-	zone, _ := zones.Search(q.Name.AsFQDN().String())
-	rrset, found, err := zone.Query(queryStr(zone, q.Name))
+	zone, ok := findZone(zones, q.Name)
+	if !ok {
+		if recurCount > 1 {
+			// A CNAME led out of our zones, the client will have to follow it from here.
+			return rcodeNoError
+		}
+		log.Infof("%v [REFUSED] Not authoritative for this name", logHead)
+		return rcodeRefused
+	}
+	if _, ok := zone.SOA(); !ok && zone.Secondary() {
+		log.Errorf("%v [SERVFAIL] Secondary zone %v hasn't been transferred from its primary", logHead, zone.Name)
+		return rcodeServFail
+	}
+
+	rrset, result, err := zone.Query(queryStr(zone, q.Name))
 	if err != nil {
 		log.Errorf("%v Error when querying zone for query, returning SERVFAIL: %v", logHead, err)
-		rcode = rcodeServFail
-		errMsg = errReply(orig, rcodeServFail, logHead)
-		return
+		return rcodeServFail
 	}
-	if !found {
+	denial := wantsDenial(zone, reply)
+	switch result {
+	case ResultNXDomain:
 		log.Infof("%v [NXDOMAIN]", logHead)
-		rcode = rcodeNxdomain
-		errMsg = errReply(orig, rcodeNxdomain, logHead)
-		return
+		addNegativeSOA(zone, reply)
+		if denial {
+			addDenial(zone, q.Name, false, reply)
+			if zone.compactDenial() {
+				return rcodeNoError // The NSEC record says the name doesn't exist instead.
+			}
+		}
+		return rcodeNxdomain
+	case ResultEmptyNonTerminal:
+		log.Infof("%v [NODATA] Empty non-terminal", logHead)
+		addNegativeSOA(zone, reply)
+		if denial {
+			addDenial(zone, q.Name, false, reply)
+		}
+		return rcodeNoError
+	case ResultWildcard:
+		log.Debugf("%v Synthesising answer from wildcard", logHead)
+	case ResultDelegation:
+		qname := queryStr(zone, q.Name).String()
+		if cut, _ := zone.ZoneCut(qname); q.Type == TypeDS && cut == qname {
+			// DS records live on the parent side of the cut, so we're authoritative for them (RFC 4035 section 3.1.4.1).
+			log.Debugf("%v Answering DS query at a zone cut", logHead)
+			break
+		}
+		log.Infof("%v [Referral]", logHead)
+		addReferral(zone, rrset, reply)
+		if denial {
+			addDelegationSigner(zone, q.Name, rrset, reply)
+		}
+		return rcodeNoError
+	case ResultDNAME:
+		// The name is redirected by a CNAME synthesised from the DNAME, which is followed (RFC 6672 section 3.1).
+		owner, _ := zone.DNAMEAbove(queryStr(zone, q.Name).String())
+		ownerName := zone.AbsoluteName(owner).AsFQDN()
+		dname := rrset.RRSet[TypeDNAME][0]
+		reply.Answer = append(reply.Answer, zone.RR(dname, ownerName))
+
+		prefix := q.Name.AsFQDN()[:len(q.Name.AsFQDN())-len(ownerName)]
+		target := prefix + dname.Target.AsFQDN()
+		if len(appendName(nil, target, nil)) > 255 {
+			log.Infof("%v [YXDOMAIN] Name is too long once redirected by the DNAME of %v", logHead, ownerName)
+			return rcodeYXDomain
+		}
+		cname := RData{Type: TypeCNAME, Target: target, TTL: dname.TTLOrDefault(*zone)}
+		reply.Answer = append(reply.Answer, cname.RR(q.Name))
+		log.Debugf("%v Synthesised CNAME to %v from the DNAME of %v", logHead, target, ownerName)
+		if q.Type == TypeCNAME {
+			return rcodeNoError
+		}
+
+		recurQ := Question{Name: target, Type: q.Type, Class: q.Class}
+		return s.answer(recurQ, zones, reply, logHead, recurCount)
 	}
 
 	// Recursively search for an answer if we got a CNAME where none was requested.
 	if q.Type != TypeCNAME && rrset.HasCNAME {
 		cname := rrset.CNAME()
-		answers = append(answers, cname)
+		reply.Answer = append(reply.Answer, zone.RR(cname, q.Name))
+		if denial && result == ResultWildcard {
+			addDenial(zone, q.Name, true, reply)
+		}
 
 		recurQ := Question{Name: cname.Target, Type: q.Type, Class: q.Class}
-		ans, code, errMsg := answer(recurQ, zones, orig, logHead, recurCount)
-		answers = append(answers, ans...)
-		return answers, code, errMsg
+		return s.answer(recurQ, zones, reply, logHead, recurCount)
+	}
+
+	numAnswers := len(reply.Answer)
+	// ALIAS records are only sent in zone transfers, so queries for them get NODATA.
+	if q.Type != TypeALIAS {
+		for rdata := range rrset.Get(q.Type) {
+			reply.Answer = append(reply.Answer, zone.RR(rdata, q.Name))
+		}
+	}
+	if alias := rrset.RRSet[TypeALIAS]; len(alias) > 0 && (q.Type == TypeA || q.Type == TypeAAAA) {
+		addrs, err := s.aliasAddresses(zones, zone, alias[0], q.Type, logHead, recurCount)
+		if err != nil {
+			log.Errorf("%v [SERVFAIL] Could not look up the addresses of ALIAS target %v: %v", logHead, alias[0].Target, err)
+			return rcodeServFail
+		}
+		for _, rdata := range addrs {
+			reply.Answer = append(reply.Answer, rdata.RR(q.Name))
+		}
+	}
+	answered := len(reply.Answer) > numAnswers
+	if !answered {
+		log.Infof("%v [NODATA]", logHead)
+		addNegativeSOA(zone, reply)
+	}
+	if denial && (!answered || result == ResultWildcard) {
+		addDenial(zone, q.Name, answered, reply)
+	}
+
+	return rcodeNoError
+}
+
+// addAdditional adds the addresses of the targets of CNAME, MX, NS, SRV, SVCB and HTTPS records in the answer
+// section of reply to its additional section (RFC 1035 3.3.9, 3.3.11, RFC 2782, RFC 9460 section 4.1), as long
+// as the targets are in our zones.
+// Answers reached by following CNAMEs are included, so clients needn't look up e.g. mail servers separately.
+func addAdditional(zones *Trie[Zone], reply *DNSMsg) {
+	// Addresses which are already in the reply, or have already been looked up.
+	seen := make(map[string]bool)
+	for _, section := range [][]RR{reply.Answer, reply.Additional} {
+		for _, rr := range section {
+			if rr.Type == TypeA || rr.Type == TypeAAAA {
+				seen[strings.ToLower(rr.Name.AsFQDN().String())] = true
+			}
+		}
 	}
 
-	for rdata := range rrset.Get(q.Type) {
-		answers = append(answers, rdata)
+	for _, rr := range reply.Answer {
+		var target Domain
+		switch rr.Type {
+		case TypeCNAME, TypeMX, TypeNS, TypeSRV:
+			target = rr.RData.Target
+		case TypeSVCB, TypeHTTPS:
+			target = rr.RData.Target
+			if target.AsFQDN() == "." && rr.RData.Pref > 0 {
+				target = rr.Name // The service is at the owner name itself.
+			}
+		default:
+			continue
+		}
+		key := strings.ToLower(target.AsFQDN().String())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		reply.Additional = append(reply.Additional, addresses(zones, target)...)
 	}
+}
 
-	rcode = rcodeNoError
-	return
+// addresses returns the A and AAAA records we have for name, which may be in any of our zones.
+// Wildcards are followed, and glue is returned for names below a zone cut.
+func addresses(zones *Trie[Zone], name Domain) []RR {
+	zone, ok := findZone(zones, name)
+	if !ok {
+		return nil
+	}
+	rrset, result, err := zone.Query(queryStr(zone, name))
+	if err != nil {
+		return nil
+	}
+	switch result {
+	case ResultDelegation:
+		return zone.Glue(name)
+	case ResultFound, ResultWildcard:
+		var addrs []RR
+		for _, t := range []RecType{TypeA, TypeAAAA} {
+			for rdata := range rrset.Get(t) {
+				addrs = append(addrs, zone.RR(rdata, name))
+			}
+		}
+		return addrs
+	}
+	return nil
+}
+
+// findZone returns the zone which is authoritative for name. The bool is false if we have no such zone.
+func findZone(zones *Trie[Zone], name Domain) (*Zone, bool) {
+	zone, _ := zones.Search(strings.ToLower(name.AsFQDN().String()))
+	return zone, zone.Name != ""
+}
+
+// addReferral adds a referral to the delegation with the NS records in cut to reply.
+// The NS records go in the authority section and any glue we have for them in the additional section.
+// We're not authoritative for the data below a cut, so the AA bit is cleared.
+func addReferral(zone *Zone, cut RRSet, reply *DNSMsg) {
+	reply.Header.AA = false
+	for ns := range cut.Get(TypeNS) {
+		reply.Authority = append(reply.Authority, zone.RR(ns, zone.AbsoluteName(ns.Name.String())))
+	}
+	for ns := range cut.Get(TypeNS) {
+		reply.Additional = append(reply.Additional, zone.Glue(ns.Target)...)
+	}
+}
+
+// addDelegationSigner adds the DS records of the zone cut above name to the authority section of a referral, or
+// the proof that there are none if the delegated zone isn't signed (RFC 4035 section 3.1.4).
+func addDelegationSigner(zone *Zone, name Domain, cut RRSet, reply *DNSMsg) {
+	if len(cut.RRSet[TypeDS]) == 0 {
+		addDenial(zone, name, false, reply)
+		return
+	}
+	owner := zone.AbsoluteName(cut.RRSet[TypeNS][0].Name.String())
+	for ds := range cut.Get(TypeDS) {
+		reply.Authority = append(reply.Authority, zone.RR(ds, owner))
+	}
+}
+
+// addNegativeSOA adds the SOA record of zone to the authority section of a negative reply, if the zone has one.
+func addNegativeSOA(zone *Zone, reply *DNSMsg) {
+	if soa, ok := zone.NegativeSOA(); ok {
+		reply.Authority = append(reply.Authority, soa)
+	}
 }
 
 // errReply constructs a serialised error response.
@@ -110,11 +383,13 @@ func queryInfo(msg DNSMsg) string {
 }
 
 // queryStr returns the appropriate query key to use to search for the (absolute) name given in zone.
+// Names are compared case-insensitively.
 func queryStr(zone *Zone, name Domain) Domain {
-	nameFQDN := name.AsFQDN()
-	if nameFQDN == zone.Name {
+	nameFQDN := strings.ToLower(name.AsFQDN().String())
+	zoneName := strings.ToLower(zone.Name.String())
+	if nameFQDN == zoneName {
 		return ""
 	}
-	key, _ := strings.CutSuffix(nameFQDN.String(), "."+zone.Name.String())
+	key, _ := strings.CutSuffix(nameFQDN, "."+zoneName)
 	return Domain(key)
 }
@@ -0,0 +1,316 @@
+package dns
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testZoneTrie builds a zone trie from the given zones.
+func testZoneTrie(t *testing.T, zones ...Zone) *Trie[Zone] {
+	zoneMap := make(map[Domain]Zone)
+	for _, zone := range zones {
+		zoneMap[zone.Name] = zone
+	}
+	trie := NewZoneTrie(zoneMap)
+	return &trie
+}
+
+// testZone builds a zone with the given name and records.
+func testZone(t *testing.T, name Domain, records ...RData) Zone {
+	zone := NewZone()
+	zone.Name = name
+	zone.TTL = 300
+	for _, record := range records {
+		if err := zone.Insert(record); err != nil {
+			t.Fatalf("Could not insert %+v into zone: %v", record, err)
+		}
+	}
+	return zone
+}
+
+// testRespond sends query to server over UDP, and returns the parsed reply.
+func testRespond(t *testing.T, server *Server, query DNSMsg) DNSMsg {
+	payload, err := query.Serialise()
+	if err != nil {
+		t.Fatalf("Could not serialise query: %v", err)
+	}
+	reply, err := ParseDNSMsg(server.Respond(payload, Client{}, "[test]"))
+	if err != nil {
+		t.Fatalf("Could not parse reply: %v", err)
+	}
+	return reply
+}
+
+// TestNegativeAnswers ensures NXDOMAIN and NODATA replies carry the zone's SOA record in the authority section, with
+// the negative caching TTL (RFC 2308), and that positive answers don't.
+func TestNegativeAnswers(t *testing.T) {
+	zone, err := testParse("www A 192.0.2.1\nalias CNAME www\ngone CNAME nowhere")
+	if err != nil {
+		t.Fatalf("Could not parse zone: %v", err)
+	}
+	server := NewServer(testZoneTrie(t, zone), Config{})
+
+	tests := []struct {
+		name    Domain
+		rtype   RecType
+		rcode   byte
+		answers int
+		soa     bool
+	}{
+		{"www.example.com", TypeA, rcodeNoError, 1, false},
+		{"www.example.com", TypeAAAA, rcodeNoError, 0, true},
+		{"nowhere.example.com", TypeA, rcodeNxdomain, 0, true},
+		{"alias.example.com", TypeAAAA, rcodeNoError, 1, true}, // The CNAME, and NODATA for its target.
+		{"gone.example.com", TypeA, rcodeNxdomain, 1, true},    // The CNAME, and NXDOMAIN for its target.
+	}
+	for _, test := range tests {
+		reply := testRespond(t, server, testQuery(test.name, test.rtype))
+		if reply.Header.Rcode != test.rcode || len(reply.Answer) != test.answers {
+			t.Errorf("%v %v: expected rcode %v and %v answers, got %v and %+v",
+				test.name, test.rtype, test.rcode, test.answers, reply.Header.Rcode, reply.Answer)
+		}
+		if !test.soa {
+			if len(reply.Authority) != 0 {
+				t.Errorf("%v %v: expected no authority records, got %+v", test.name, test.rtype, reply.Authority)
+			}
+			continue
+		}
+		if len(reply.Authority) != 1 {
+			t.Errorf("%v %v: expected the SOA record in the authority section, got %+v",
+				test.name, test.rtype, reply.Authority)
+			continue
+		}
+		soa := reply.Authority[0]
+		if soa.Type != TypeSOA || soa.Name != "example.com" || soa.TTL != 60 || soa.RData.Serial != 1 {
+			t.Errorf("%v %v: expected the zone's SOA record with TTL 60, got %+v", test.name, test.rtype, soa)
+		}
+	}
+
+	// Without an SOA record, negative answers have an empty authority section.
+	zone = NewZone()
+	zone.Name = "example.org."
+	reply := testRespond(t, NewServer(testZoneTrie(t, zone), Config{}), testQuery("nowhere.example.org", TypeA))
+	if reply.Header.Rcode != rcodeNxdomain || len(reply.Authority) != 0 {
+		t.Errorf("Expected NXDOMAIN with no authority records, got %v and %+v", reply.Header.Rcode, reply.Authority)
+	}
+}
+
+// TestAdditionalSection ensures MX targets in any of our zones get their addresses added, unless
+// minimal responses are enabled.
+func TestAdditionalSection(t *testing.T) {
+	zones := testZoneTrie(t,
+		testZone(t, "example.com.",
+			RData{Name: "@", Type: TypeMX, Pref: 10, Target: "mail.example.net."},
+			RData{Name: "@", Type: TypeMX, Pref: 20, Target: "backup.example.com."},
+			RData{Name: "backup", Type: TypeA, Addr: netip.MustParseAddr("192.0.2.2")},
+			RData{Name: "www", Type: TypeCNAME, Target: "web.example.net."},
+		),
+		testZone(t, "example.net.",
+			RData{Name: "mail", Type: TypeA, Addr: netip.MustParseAddr("192.0.2.1")},
+			RData{Name: "mail", Type: TypeAAAA, Addr: netip.MustParseAddr("2001:db8::1")},
+			RData{Name: "web", Type: TypeA, Addr: netip.MustParseAddr("192.0.2.3")},
+		),
+	)
+
+	reply := testRespond(t, NewServer(zones, Config{}), testQuery("example.com", TypeMX))
+	if len(reply.Answer) != 2 {
+		t.Fatalf("Expected 2 MX answers, got %v", reply.Answer)
+	}
+	found := make(map[string]bool)
+	for _, rr := range reply.Additional {
+		found[rr.Name.String()+" "+rr.Type.String()] = true
+	}
+	for _, expected := range []string{"mail.example.net A", "mail.example.net AAAA", "backup.example.com A"} {
+		if !found[expected] {
+			t.Errorf("Missing %v in additional section: %v", expected, reply.Additional)
+		}
+	}
+
+	// The CNAME target has no TXT records, but its address is still added.
+	reply = testRespond(t, NewServer(zones, Config{}), testQuery("www.example.com", TypeTXT))
+	if len(reply.Answer) != 1 || len(reply.Additional) != 1 || reply.Additional[0].Name != "web.example.net" ||
+		reply.Additional[0].RData.Addr != netip.MustParseAddr("192.0.2.3") {
+		t.Errorf("Expected the CNAME and the address of its target, got %v and %v", reply.Answer, reply.Additional)
+	}
+	// Addresses already in the answer aren't repeated.
+	reply = testRespond(t, NewServer(zones, Config{}), testQuery("www.example.com", TypeA))
+	if len(reply.Answer) != 2 || len(reply.Additional) != 0 {
+		t.Errorf("Expected the CNAME and its target's address only in the answer, got %v and %v",
+			reply.Answer, reply.Additional)
+	}
+
+	reply = testRespond(t, NewServer(zones, Config{MinimalResponses: true}), testQuery("example.com", TypeMX))
+	if len(reply.Additional) != 0 {
+		t.Errorf("Expected no additional records with minimal responses, got %v", reply.Additional)
+	}
+}
+
+// TestSRV ensures SRV records are read from zone files with their targets made absolute, served with the
+// addresses of their targets, and that names may have underscores.
+func TestSRV(t *testing.T) {
+	dir := t.TempDir()
+	testZoneFile(t, dir, 1, "_sip._tcp SRV 10 60 5060 sip\n_sip._tcp SRV 20 0 5060 backup.example.net.\n"+
+		"_ftp._tcp SRV 0 0 0 .\nsip A 192.0.2.1")
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+
+	payload, err := testQuery("_sip._tcp.example.com", TypeSRV).Serialise()
+	if err != nil {
+		t.Fatalf("Could not serialise query: %v", err)
+	}
+	buf := server.Respond(payload, Client{}, "[test]")
+	reply, err := ParseDNSMsg(buf)
+	if err != nil {
+		t.Fatalf("Could not parse reply: %v", err)
+	}
+	if len(reply.Answer) != 2 {
+		t.Fatalf("Expected 2 SRV answers, got %+v", reply)
+	}
+	var srvs []string
+	for _, rr := range reply.Answer {
+		srvs = append(srvs, rr.RData.DataString())
+	}
+	slices.Sort(srvs)
+	if want := []string{"10 60 5060 sip.example.com.", "20 0 5060 backup.example.net."}; !slices.Equal(srvs, want) {
+		t.Errorf("Expected SRV records %q, got %q", want, srvs)
+	}
+	if !bytes.Contains(buf, []byte("\x03sip\x07example\x03com\x00")) {
+		t.Errorf("SRV target was compressed")
+	}
+	if len(reply.Additional) != 1 || reply.Additional[0].Name != "sip.example.com" {
+		t.Errorf("Expected the address of sip.example.com in the additional section, got %v", reply.Additional)
+	}
+
+	reply = testRespond(t, server, testQuery("_ftp._tcp.example.com", TypeSRV))
+	if len(reply.Answer) != 1 || reply.Answer[0].RData.Target.AsFQDN() != "." {
+		t.Errorf("Expected an SRV record with the root as target, got %v", reply.Answer)
+	}
+}
+
+// TestSecurityRecords ensures CAA, TLSA and SSHFP records are read from zone files, and served and written back
+// unchanged.
+func TestSecurityRecords(t *testing.T) {
+	records := []struct {
+		name  Domain
+		rtype RecType
+		data  string
+	}{
+		{"example.com", TypeCAA, `128 issue "ca.example.net; account=230123"`},
+		{"_25._tcp.mail.example.com", TypeTLSA, "3 1 1 0C72AC70B745AC19998811B131D662C9AC69DBDBE7CB23E5B514B56664C5D3D6"},
+		{"host.example.com", TypeSSHFP, "4 2 123456789ABCDEF67890123456789ABCDEF67890123456789ABCDEF123456789"},
+	}
+	dir := t.TempDir()
+	var lines []string
+	for _, record := range records {
+		owner := strings.TrimSuffix(record.name.String(), ".example.com")
+		if owner == "example.com" {
+			owner = "@"
+		}
+		lines = append(lines, fmt.Sprintf("%v %v %v", owner, record.rtype, record.data))
+	}
+	testZoneFile(t, dir, 1, strings.Join(lines, "\n"))
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+
+	zone, _ := findZone(server.Zones(), "example.com")
+	for i, record := range records {
+		reply := testRespond(t, server, testQuery(record.name, record.rtype))
+		if len(reply.Answer) != 1 || reply.Answer[0].RData.DataString() != record.data {
+			t.Errorf("Expected %v %v record %q, got %v", record.name, record.rtype, record.data, reply.Answer)
+		}
+		if !strings.Contains(string(zone.ZoneFile()), lines[i]+"\n") {
+			t.Errorf("Expected %q in the zone file, got:\n%s", lines[i], zone.ZoneFile())
+		}
+	}
+}
+
+// TestUnknownTypes ensures records of types we don't know are read from zone files in the generic form of
+// RFC 3597, passed through as they are, and that queries for unknown types get NODATA rather than an error.
+func TestUnknownTypes(t *testing.T) {
+	dir := t.TempDir()
+	testZoneFile(t, dir, 1, "x TYPE65280 \\# 6 0A0B 0C0D0E0F 600\ny TYPE65281 \\# 0\nz A 192.0.2.1")
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+
+	reply := testRespond(t, server, testQuery("x.example.com", 65280))
+	if len(reply.Answer) != 1 || !bytes.Equal(reply.Answer[0].RData.Data, []byte{10, 11, 12, 13, 14, 15}) || reply.Answer[0].TTL != 600 {
+		t.Errorf("Expected the opaque TYPE65280 record, got %v", reply.Answer)
+	}
+	zone, _ := findZone(server.Zones(), "example.com")
+	for _, line := range []string{`x TYPE65280 \# 6 0A0B0C0D0E0F 600`, `y TYPE65281 \# 0`} {
+		if !strings.Contains(string(zone.ZoneFile()), line+"\n") {
+			t.Errorf("Expected %q in the zone file, got:\n%s", line, zone.ZoneFile())
+		}
+	}
+
+	reply = testRespond(t, server, testQuery("z.example.com", 65282))
+	if reply.Header.Rcode != rcodeNoError || len(reply.Answer) != 0 || len(reply.Authority) != 1 {
+		t.Errorf("Expected NODATA for an unknown type, got %+v", reply)
+	}
+
+	testZoneFile(t, dir, 1, "x TYPE65280 \\# 4 0A0B")
+	if _, err := LoadZoneFiles(dir); err == nil {
+		t.Errorf("Expected generic RDATA shorter than its length not to load")
+	}
+}
+
+// TestDNAME ensures names below a DNAME record are redirected with a synthesised CNAME which is followed, and
+// that zones with names below a DNAME record don't load.
+func TestDNAME(t *testing.T) {
+	dir := t.TempDir()
+	label := strings.Repeat("a", 63)
+	testZoneFile(t, dir, 1, "old DNAME new.example.com.\nwww.new A 192.0.2.1\nother DNAME example.net.\n"+
+		"long DNAME "+label+"."+label+".example.com.")
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+
+	tests := []struct {
+		name   Domain
+		rtype  RecType
+		answer []string
+	}{
+		{"www.old.example.com", TypeA, []string{"old.example.com. DNAME new.example.com.",
+			"www.old.example.com. CNAME www.new.example.com.", "www.new.example.com. A 192.0.2.1"}},
+		{"www.old.example.com", TypeCNAME, []string{"old.example.com. DNAME new.example.com.",
+			"www.old.example.com. CNAME www.new.example.com."}},
+		{"x.y.other.example.com", TypeA, []string{"other.example.com. DNAME example.net.",
+			"x.y.other.example.com. CNAME x.y.example.net."}},
+		{"old.example.com", TypeDNAME, []string{"old.example.com. DNAME new.example.com."}},
+		{"old.example.com", TypeA, nil},
+	}
+	for _, test := range tests {
+		reply := testRespond(t, server, testQuery(test.name, test.rtype))
+		var answer []string
+		for _, rr := range reply.Answer {
+			answer = append(answer, fmt.Sprintf("%v %v %v", rr.Name.AsFQDN(), rr.Type, rr.RData.DataString()))
+		}
+		if reply.Header.Rcode != rcodeNoError || !slices.Equal(answer, test.answer) {
+			t.Errorf("%v %v: expected %q, got rcode %v and %q", test.name, test.rtype, test.answer, reply.Header.Rcode, answer)
+		}
+	}
+
+	name := Domain(strings.Repeat(label+".", 3) + "long.example.com")
+	if reply := testRespond(t, server, testQuery(name, TypeA)); reply.Header.Rcode != rcodeYXDomain {
+		t.Errorf("Expected YXDOMAIN for a name too long once redirected, got %+v", reply)
+	}
+
+	for _, records := range []string{"old DNAME new.example.com.\nwww.old A 192.0.2.1", "www.old A 192.0.2.1\nold DNAME new.example.com.",
+		"old DNAME new.example.com.\nold DNAME new.example.net."} {
+		testZoneFile(t, dir, 1, records)
+		if _, err := LoadZoneFiles(dir); err == nil {
+			t.Errorf("Expected %q not to load", records)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package dns
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DNSSEC algorithm numbers (RFC 8624) of the keys we can sign with.
+	algECDSAP256SHA256 byte = 13
+	algED25519         byte = 15
+	// dnskeyFlags marks a key as a zone key and a secure entry point (RFC 4034 section 2.1.1), so a single key
+	// signs the whole zone and is what the parent's DS record refers to.
+	dnskeyFlags    uint16 = 257
+	dnskeyProtocol byte   = 3
+	// dsSHA256 is the DS digest type of the DS records we make (RFC 4509).
+	dsSHA256 byte = 2
+	// sigValidity is how long the signatures we make are valid for. They're made again once less than
+	// sigRefresh of it is left, so validators caching the records never see an expired signature.
+	sigValidity = 7 * 24 * time.Hour
+	sigRefresh  = 2 * 24 * time.Hour
+	// sigBackdate is how far before now signatures become valid, for validators whose clock is behind ours.
+	sigBackdate = time.Hour
+	// sigCacheMax is the number of signatures cached before the cache is emptied.
+	sigCacheMax = 10000
+)
+
+// DNSSECKey is a private key a zone's records are signed with online (RFC 4034, RFC 4035).
+type DNSSECKey struct {
+	signer crypto.Signer
+	DNSKEY RData  // The DNSKEY record published at the zone apex, without a name or TTL.
+	Tag    uint16 // Key tag of DNSKEY, identifying it in RRSIG records.
+}
+
+// LoadDNSSECKey will read the PEM encoded private key at path. ECDSA P-256 keys (PKCS #8 or SEC 1) and Ed25519
+// keys (PKCS #8) are supported, as generated by e.g. openssl genpkey -algorithm ed25519.
+func LoadDNSSECKey(path string) (*DNSSECKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		errStr := fmt.Sprintf("DNSSEC key %v is not PEM encoded", path)
+		return nil, errors.New(errStr)
+	}
+	var priv any
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		priv, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		errStr := fmt.Sprintf("DNSSEC key %v is a %v, not a private key", path, block.Type)
+		return nil, errors.New(errStr)
+	}
+	if err != nil {
+		errStr := fmt.Sprintf("Invalid DNSSEC key %v: %v", path, err)
+		return nil, errors.New(errStr)
+	}
+	key, err := newDNSSECKey(priv, dnskeyFlags)
+	if err != nil {
+		errStr := fmt.Sprintf("DNSSEC key %v: %v", path, err)
+		return nil, errors.New(errStr)
+	}
+	return key, nil
+}
+
+// GenerateDNSSECKey returns a new key for the algorithm given by its mnemonic (RFC 8624): ECDSAP256SHA256 or
+// ED25519. Its DNSKEY record has the secure entry point flag, see ZSK.
+func GenerateDNSSECKey(algorithm string) (*DNSSECKey, error) {
+	var priv any
+	var err error
+	switch strings.ToUpper(algorithm) {
+	case "ECDSAP256SHA256":
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ED25519":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		errStr := fmt.Sprintf("Unsupported DNSSEC algorithm %v, only ECDSAP256SHA256 and ED25519 are supported", algorithm)
+		return nil, errors.New(errStr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newDNSSECKey(priv, dnskeyFlags)
+}
+
+// newDNSSECKey returns the DNSSEC key for the private key priv, with the given DNSKEY flags.
+func newDNSSECKey(priv any, flags uint16) (*DNSSECKey, error) {
+	key := &DNSSECKey{DNSKEY: RData{Type: TypeDNSKEY, Flags: flags, Protocol: dnskeyProtocol}}
+	switch priv := priv.(type) {
+	case *ecdsa.PrivateKey:
+		if priv.Curve != elliptic.P256() {
+			errStr := fmt.Sprintf("Curve %v is not supported, only P-256 is", priv.Curve.Params().Name)
+			return nil, errors.New(errStr)
+		}
+		pub, err := priv.PublicKey.ECDH()
+		if err != nil {
+			return nil, err
+		}
+		key.signer = priv
+		key.DNSKEY.Algorithm = algECDSAP256SHA256
+		key.DNSKEY.PublicKey = pub.Bytes()[1:] // X and Y, without the uncompressed point prefix (RFC 6605).
+	case ed25519.PrivateKey:
+		key.signer = priv
+		key.DNSKEY.Algorithm = algED25519
+		key.DNSKEY.PublicKey = priv.Public().(ed25519.PublicKey) // RFC 8080
+	default:
+		errStr := fmt.Sprintf("Key is a %T, only ECDSA P-256 and Ed25519 keys are supported", priv)
+		return nil, errors.New(errStr)
+	}
+
+	rdata, err := key.DNSKEY.appendTo(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	key.Tag = keyTag(rdata)
+	return key, nil
+}
+
+// ZSK returns the key as a zone signing key: its DNSKEY record doesn't have the secure entry point flag, as the
+// parent's DS records refer to the key signing keys instead (RFC 6781 section 3.1).
+func (k *DNSSECKey) ZSK() (*DNSSECKey, error) {
+	return newDNSSECKey(k.signer, dnskeyFlags&^1)
+}
+
+// PEM returns the private key PEM encoded in PKCS #8 form, as read by LoadDNSSECKey.
+func (k *DNSSECKey) PEM() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.signer)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// DS returns the DS record referring to the key's DNSKEY record at the apex of zone, for the parent zone
+// (RFC 4034 section 5). The digest is SHA-256 (RFC 4509).
+func (k *DNSSECKey) DS(zone Domain) (RData, error) {
+	rdata, err := k.DNSKEY.appendTo(nil, nil)
+	if err != nil {
+		return RData{}, err
+	}
+	digest := sha256.Sum256(append(appendName(nil, Domain(strings.ToLower(zone.AsFQDN().String())), nil), rdata...))
+	return RData{Type: TypeDS, KeyTag: k.Tag, Algorithm: k.DNSKEY.Algorithm, DigestType: dsSHA256, Digest: digest[:]}, nil
+}
+
+// keyTag returns the key tag of a DNSKEY record from its RDATA (RFC 4034 appendix B).
+func keyTag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac)
+}
+
+// sign returns the signature of data with the key, in the form used in RRSIG records.
+func (k *DNSSECKey) sign(data []byte) ([]byte, error) {
+	switch priv := k.signer.(type) {
+	case ed25519.PrivateKey:
+		return ed25519.Sign(priv, data), nil
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(data)
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+		if err != nil {
+			return nil, err
+		}
+		// r and s, each padded to 32 bytes (RFC 6605 section 4).
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	}
+	return nil, errors.New("Unsupported DNSSEC key type")
+}
+
+// sigCache holds the signatures made for RRsets, so they needn't be made for every query.
+type sigCache struct {
+	mu   sync.Mutex
+	sigs map[string]RData // RRSIG records by signing key and signed RRset, see signRRSet.
+}
+
+// get returns the cached signature for key, if there is one that won't need refreshing until after now.
+func (c *sigCache) get(key string, now time.Time) (RData, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sig, ok := c.sigs[key]
+	if !ok || now.Add(sigRefresh).Unix() >= int64(sig.Expiration) {
+		return RData{}, false
+	}
+	return sig, true
+}
+
+// put will cache sig under key. The whole cache is emptied when it's full, as the records being signed change
+// far less often than it fills up.
+func (c *sigCache) put(key string, sig RData) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sigs == nil || len(c.sigs) >= sigCacheMax {
+		c.sigs = make(map[string]RData)
+	}
+	c.sigs[key] = sig
+}
+
+// signRRSet returns an RRSIG record for rrset, the records of one type owned by owner (the wildcard owner for
+// wildcard answers) in zone, made with key at the time now. Cached signatures are used if they're still fresh.
+func (s *Server) signRRSet(zone *Zone, key *DNSSECKey, owner Domain, rrset []RData, now time.Time) (RData, error) {
+	sig, data, err := rrsigFor(zone, key, owner, rrset)
+	if err != nil {
+		return sig, err
+	}
+	cacheKey := string(key.DNSKEY.PublicKey) + string(sig.appendRRSIGFields(nil)) + string(data)
+	if cached, ok := s.signatures.get(cacheKey, now); ok {
+		return cached, nil
+	}
+	sig, err = key.signRRSIG(sig, data, now.Add(-sigBackdate), now.Add(sigValidity))
+	if err != nil {
+		return sig, err
+	}
+	s.signatures.put(cacheKey, sig)
+	return sig, nil
+}
+
+// rrsigFor returns the RRSIG record for rrset, owned by owner in zone, to be signed by key, without its validity
+// period or signature. The RRset in the form it's signed in is returned with it (RFC 4034 section 3.1.8.1).
+func rrsigFor(zone *Zone, key *DNSSECKey, owner Domain, rrset []RData) (sig RData, data []byte, err error) {
+	owner = Domain(strings.ToLower(owner.AsFQDN().String()))
+	var labels int
+	for _, label := range owner.Labels() {
+		// Neither the root nor a wildcard label are counted (RFC 4034 section 3.1.3).
+		if label != "" && label != "*" {
+			labels++
+		}
+	}
+	sig = RData{
+		Type:        TypeRRSIG,
+		TypeCovered: rrset[0].Type,
+		Algorithm:   key.DNSKEY.Algorithm,
+		Labels:      byte(labels),
+		OrigTTL:     uint32(rrset[0].TTLOrDefault(*zone)),
+		KeyTag:      key.Tag,
+		SignerName:  Domain(strings.ToLower(zone.Name.AsFQDN().String())),
+	}
+
+	// The RRset in canonical form and order (RFC 4034 section 6), without duplicates.
+	var rdatas [][]byte
+	for _, rdata := range rrset {
+		canonical, err := rdata.canonical()
+		if err != nil {
+			return sig, nil, err
+		}
+		rdatas = append(rdatas, canonical)
+	}
+	slices.SortFunc(rdatas, bytes.Compare)
+	rdatas = slices.CompactFunc(rdatas, bytes.Equal)
+	for _, rdata := range rdatas {
+		data = appendName(data, owner, nil)
+		data = binary.BigEndian.AppendUint16(data, uint16(sig.TypeCovered))
+		data = binary.BigEndian.AppendUint16(data, uint16(QClassIN))
+		data = binary.BigEndian.AppendUint32(data, sig.OrigTTL)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rdata)))
+		data = append(data, rdata...)
+	}
+	return sig, data, nil
+}
+
+// signRRSIG returns sig, made by rrsigFor for data, signed with the key and valid from inception to expiration.
+func (k *DNSSECKey) signRRSIG(sig RData, data []byte, inception, expiration time.Time) (RData, error) {
+	sig.Inception = uint32(inception.Unix())
+	sig.Expiration = uint32(expiration.Unix())
+	signature, err := k.sign(append(sig.appendRRSIGFields(nil), data...))
+	if err != nil {
+		return sig, err
+	}
+	sig.Signature = signature
+	return sig, nil
+}
+
+// signReply will add RRSIG records for the authoritative RRsets in reply, from zones with DNSSEC keys, after
+// each RRset (RFC 4035 section 3.1). Referrals and glue aren't authoritative, so they aren't signed.
+func (s *Server) signReply(zones *Trie[Zone], reply *DNSMsg) error {
+	now := time.Now()
+	for _, section := range []*[]RR{&reply.Answer, &reply.Authority, &reply.Additional} {
+		var signed []RR
+		rrs := *section
+		for len(rrs) > 0 {
+			end := 1
+			for end < len(rrs) && sameRRSet(rrs[0], rrs[end]) {
+				end++
+			}
+			sigs, err := s.rrsetSignatures(zones, rrs[:end], now)
+			if err != nil {
+				return err
+			}
+			signed = append(append(signed, rrs[:end]...), sigs...)
+			rrs = rrs[end:]
+		}
+		*section = signed
+	}
+	return nil
+}
+
+// sameRRSet reports whether a and b are records of the same RRset.
+func sameRRSet(a, b RR) bool {
+	return a.Type == b.Type && a.Class == b.Class && strings.EqualFold(a.Name.AsFQDN().String(), b.Name.AsFQDN().String())
+}
+
+// rrsetSignatures returns the RRSIG records for rrs, an RRset of a reply, made with each key of the zone the
+// RRset is from, or those stored with it if the zone is pre-signed. None are returned if the zone isn't signed,
+// or the RRset isn't authoritative data of the zone.
+func (s *Server) rrsetSignatures(zones *Trie[Zone], rrs []RR, now time.Time) ([]RR, error) {
+	name, t := rrs[0].Name, rrs[0].Type
+	zone, ok := findZone(zones, name)
+	if !ok || (len(zone.DNSSECKeys) == 0 && !zone.presigned()) || t == TypeRRSIG || t == TypeOPT {
+		return nil, nil
+	}
+	owner := name
+	var rdatas []RData
+	var stored RRSet // The records the RRset is from, with its RRSIG records if the zone is pre-signed.
+	switch t {
+	case TypeNSEC, TypeNSEC3:
+		// Made for the reply rather than from the zone's records, see addDenial.
+		for _, rr := range rrs {
+			rdatas = append(rdatas, rr.RData)
+		}
+		stored = zone.Records[queryStr(zone, name).String()]
+	default:
+		qname := queryStr(zone, name).String()
+		rrset, result, err := zone.Query(Domain(qname))
+		if err != nil {
+			return nil, err
+		}
+		// The DS records at a zone cut are the only authoritative ones there.
+		cut, _ := zone.ZoneCut(qname)
+		atCut := result == ResultDelegation && t == TypeDS && cut == qname
+		rdatas, stored = rrset.RRSet[t], rrset
+		if (t == TypeA || t == TypeAAAA) && len(rrset.RRSet[TypeALIAS]) > 0 {
+			// The addresses were looked up from the ALIAS target for the reply.
+			rdatas = nil
+			for _, rr := range rrs {
+				rdata := rr.RData
+				rdata.TTL = uint(rr.TTL)
+				rdatas = append(rdatas, rdata)
+			}
+		}
+		if (result != ResultFound && result != ResultWildcard && !atCut) || len(rdatas) == 0 {
+			return nil, nil
+		}
+		// Wildcard answers are signed as the wildcard, unless compact denial pretends the name exists.
+		if result == ResultWildcard && zone.Denial != DenialCompact {
+			owner = zone.AbsoluteName(strings.ToLower(rdatas[0].Name.String()))
+		}
+	}
+
+	var sigs []RR
+	if zone.presigned() {
+		for sig := range stored.Get(TypeRRSIG) {
+			if sig.TypeCovered == t {
+				rr := sig.RR(name)
+				rr.TTL = rrs[0].TTL
+				sigs = append(sigs, rr)
+			}
+		}
+		return sigs, nil
+	}
+	for _, key := range zone.DNSSECKeys {
+		sig, err := s.signRRSet(zone, key, owner, rdatas, now)
+		if err != nil {
+			errStr := fmt.Sprintf("Could not sign %v %v with key %v: %v", name, t, key.Tag, err)
+			return nil, errors.New(errStr)
+		}
+		rr := sig.RR(name)
+		rr.TTL = rrs[0].TTL // The TTL of the RRset it covers (RFC 4034 section 3).
+		sigs = append(sigs, rr)
+	}
+	return sigs, nil
+}
+
+// dnskeyRecords returns the DNSKEY records of keys, for the apex of a zone.
+func dnskeyRecords(keys []*DNSSECKey) []RData {
+	records := make([]RData, len(keys))
+	for i, key := range keys {
+		records[i] = key.DNSKEY
+		records[i].Name = "@"
+	}
+	return records
+}
@@ -0,0 +1,180 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testDNSSECKeys writes an Ed25519 key to ed.pem and an ECDSA P-256 key to ec.pem in dir.
+func testDNSSECKeys(t *testing.T, dir string) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %v", err)
+	}
+	for file, block := range map[string]*pem.Block{
+		"ed.pem": {Type: "PRIVATE KEY", Bytes: edDER},
+		"ec.pem": {Type: "EC PRIVATE KEY", Bytes: ecDER},
+	} {
+		if err := os.WriteFile(filepath.Join(dir, file), pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("Could not write key: %v", err)
+		}
+	}
+}
+
+// testDNSSECQuery sends a query for name with the DO bit set to server, and returns the reply.
+func testDNSSECQuery(t *testing.T, server *Server, name Domain, rtype RecType) DNSMsg {
+	query := testQuery(name, rtype)
+	query.EDNS = &EDNS{UDPSize: 4096, DO: true}
+	return testRespond(t, server, query)
+}
+
+// testVerifyRRSIG checks sig is a valid signature of rrset, owned by owner, made with one of the keys in dnskeys.
+func testVerifyRRSIG(t *testing.T, owner Domain, rrset []RR, sig RR, dnskeys []RR) {
+	t.Helper()
+	data := sig.RData.appendRRSIGFields(nil)
+	var rdatas [][]byte
+	for _, rr := range rrset {
+		rdata, err := rr.RData.canonical()
+		if err != nil {
+			t.Fatalf("Could not serialise %v: %v", rr, err)
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	slices.SortFunc(rdatas, bytes.Compare)
+	for _, rdata := range rdatas {
+		data = appendName(data, Domain(strings.ToLower(owner.String())), nil)
+		data = binary.BigEndian.AppendUint16(data, uint16(sig.RData.TypeCovered))
+		data = binary.BigEndian.AppendUint16(data, uint16(QClassIN))
+		data = binary.BigEndian.AppendUint32(data, sig.RData.OrigTTL)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(rdata)))
+		data = append(data, rdata...)
+	}
+
+	for _, dnskey := range dnskeys {
+		rdata, _ := dnskey.RData.appendTo(nil, nil)
+		if keyTag(rdata) != sig.RData.KeyTag {
+			continue
+		}
+		var valid bool
+		switch dnskey.RData.Algorithm {
+		case algED25519:
+			valid = ed25519.Verify(dnskey.RData.PublicKey, data, sig.RData.Signature)
+		case algECDSAP256SHA256:
+			pub := dnskey.RData.PublicKey
+			key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(pub[:32]), Y: new(big.Int).SetBytes(pub[32:])}
+			digest := sha256.Sum256(data)
+			sigBytes := sig.RData.Signature
+			valid = ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sigBytes[:32]), new(big.Int).SetBytes(sigBytes[32:]))
+		}
+		if !valid {
+			t.Errorf("Signature of %v %v with key %v doesn't verify", owner, sig.RData.TypeCovered, sig.RData.KeyTag)
+		}
+		return
+	}
+	t.Errorf("No DNSKEY with tag %v", sig.RData.KeyTag)
+}
+
+// testSplitRRSIGs splits rrs into the records of type t and the RRSIG records covering them.
+func testSplitRRSIGs(rrs []RR, t RecType) (rrset, sigs []RR) {
+	for _, rr := range rrs {
+		switch {
+		case rr.Type == t:
+			rrset = append(rrset, rr)
+		case rr.Type == TypeRRSIG && rr.RData.TypeCovered == t:
+			sigs = append(sigs, rr)
+		}
+	}
+	return rrset, sigs
+}
+
+// TestDNSSEC ensures DNSKEY records are served at the apex, and that replies to queries with the DO bit set
+// get valid signatures, made once and then cached.
+func TestDNSSEC(t *testing.T) {
+	dir := t.TempDir()
+	testDNSSECKeys(t, dir)
+	testZoneFile(t, dir, 1, "dnssec-key ed.pem\ndnssec-key ec.pem\na A 192.0.2.1\n*.w A 192.0.2.2")
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+
+	reply := testDNSSECQuery(t, server, "example.com", TypeDNSKEY)
+	dnskeys, sigs := testSplitRRSIGs(reply.Answer, TypeDNSKEY)
+	if len(dnskeys) != 2 || len(sigs) != 2 {
+		t.Fatalf("Expected 2 signed DNSKEY records, got %v", reply.Answer)
+	}
+	for _, sig := range sigs {
+		testVerifyRRSIG(t, "example.com.", dnskeys, sig, dnskeys)
+	}
+
+	tests := []struct {
+		name, owner Domain
+		labels      byte
+	}{
+		{"a.example.com", "a.example.com.", 3},
+		{"x.y.w.example.com", "*.w.example.com.", 3},
+	}
+	for _, test := range tests {
+		reply := testDNSSECQuery(t, server, test.name, TypeA)
+		rrset, sigs := testSplitRRSIGs(reply.Answer, TypeA)
+		if len(rrset) != 1 || len(sigs) != 2 {
+			t.Errorf("%v: expected a signed A record, got %v", test.name, reply.Answer)
+			continue
+		}
+		for _, sig := range sigs {
+			if sig.RData.Labels != test.labels || sig.TTL != rrset[0].TTL {
+				t.Errorf("%v: expected %v labels and TTL %v, got %+v", test.name, test.labels, rrset[0].TTL, sig)
+			}
+			testVerifyRRSIG(t, test.owner, rrset, sig, dnskeys)
+		}
+	}
+
+	reply = testDNSSECQuery(t, server, "b.example.com", TypeA)
+	soa, sigs := testSplitRRSIGs(reply.Authority, TypeSOA)
+	if reply.Header.Rcode != rcodeNxdomain || len(soa) != 1 || len(sigs) != 2 {
+		t.Fatalf("Expected NXDOMAIN with a signed SOA record, got %+v", reply)
+	}
+	for _, sig := range sigs {
+		testVerifyRRSIG(t, "example.com.", soa, sig, dnskeys)
+	}
+
+	// ECDSA signatures are randomised, so getting the same one again means it was cached.
+	first := testDNSSECQuery(t, server, "a.example.com", TypeA)
+	second := testDNSSECQuery(t, server, "a.example.com", TypeA)
+	if !slices.EqualFunc(first.Answer, second.Answer, func(a, b RR) bool {
+		return bytes.Equal(a.RData.Signature, b.RData.Signature)
+	}) {
+		t.Errorf("Expected cached signatures to be reused")
+	}
+
+	query := testQuery("a.example.com", TypeA)
+	query.EDNS = &EDNS{UDPSize: 4096}
+	if reply := testRespond(t, server, query); len(reply.Answer) != 1 {
+		t.Errorf("Expected no signatures without the DO bit, got %v", reply.Answer)
+	}
+}
@@ -0,0 +1,109 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	ednsVersion byte   = 0    // The highest EDNS version we support.
+	ednsUDPSize uint16 = 1232 // The UDP payload size we advertise. Avoids IP fragmentation on most paths.
+	ednsMinSize uint16 = 512  // Advertised sizes smaller than this must be treated as 512.
+	// Extended response codes, which need an OPT record to be represented.
+	rcodeBadVers uint16 = 16 // Bad OPT version
+)
+
+// EDNS holds the contents of an OPT pseudo-RR (RFC 6891).
+// In a message, the OPT RR lives in the additional section. DNSMsg keeps it separately.
+type EDNS struct {
+	UDPSize  uint16 // Maximum UDP payload size of the sender, from the CLASS field.
+	ExtRcode byte   // Upper 8 bits of the 12-bit extended RCODE.
+	Version  byte
+	DO       bool // DNSSEC OK
+	Options  []EDNSOption
+}
+
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// NewEDNS returns the OPT record we include in replies to a query with the given EDNS record.
+func NewEDNS(query *EDNS) *EDNS {
+	return &EDNS{
+		UDPSize: ednsUDPSize,
+		Version: ednsVersion,
+		DO:      query.DO,
+	}
+}
+
+// ednsFromRR decodes the OPT pseudo-RR rr.
+func ednsFromRR(rr RR) (*EDNS, error) {
+	if rr.Name != "" {
+		errStr := fmt.Sprintf("OPT record has non-root owner name %q", rr.Name)
+		return nil, errors.New(errStr)
+	}
+	return &EDNS{
+		UDPSize:  uint16(rr.Class),
+		ExtRcode: byte(rr.TTL >> 24),
+		Version:  byte(rr.TTL >> 16),
+		DO:       rr.TTL&(1<<15) != 0,
+		Options:  rr.RData.Options,
+	}, nil
+}
+
+// RR converts e into an OPT pseudo-RR.
+func (e EDNS) RR() RR {
+	ttl := uint32(e.ExtRcode)<<24 | uint32(e.Version)<<16
+	if e.DO {
+		ttl |= 1 << 15
+	}
+	return RR{
+		Name:  "",
+		Type:  TypeOPT,
+		Class: QClass(e.UDPSize),
+		TTL:   ttl,
+		RData: RData{Type: TypeOPT, Options: e.Options},
+	}
+}
+
+// MaxUDPSize returns the largest reply which may be sent over UDP to the sender of e.
+// Senders without EDNS (nil e) are limited to 512 bytes. We never send more than we advertise ourselves.
+func (e *EDNS) MaxUDPSize() int {
+	if e == nil || e.UDPSize < ednsMinSize {
+		return int(ednsMinSize)
+	}
+	return int(min(e.UDPSize, ednsUDPSize))
+}
+
+// parseEDNSOptions decodes the option list found in the RDATA of an OPT record.
+func parseEDNSOptions(buf []byte) (opts []EDNSOption, err error) {
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			err = errors.New("OPT RDATA too small for option header")
+			return
+		}
+		code := binary.BigEndian.Uint16(buf[0:2])
+		length := int(binary.BigEndian.Uint16(buf[2:4]))
+		buf = buf[4:]
+		if len(buf) < length {
+			err = errors.New("OPT RDATA too small for given option length")
+			return
+		}
+		opts = append(opts, EDNSOption{Code: code, Data: buf[:length]})
+		buf = buf[length:]
+	}
+	return
+}
+
+// serialiseEDNSOptions encodes opts into the RDATA of an OPT record.
+func serialiseEDNSOptions(opts []EDNSOption) (payload []byte) {
+	payload = []byte{}
+	for _, opt := range opts {
+		payload = binary.BigEndian.AppendUint16(payload, opt.Code)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(opt.Data)))
+		payload = append(payload, opt.Data...)
+	}
+	return
+}
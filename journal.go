@@ -0,0 +1,309 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// journalMaxDiffs is the number of zone changes kept in a journal. Older changes are dropped, and clients that
+// far behind get a full zone transfer instead.
+const journalMaxDiffs = 100
+
+// ZoneDiff is one change to a zone, from the version with OldSOA to the version with NewSOA.
+// Deleted and Added don't include the SOA records.
+type ZoneDiff struct {
+	OldSOA, NewSOA RR
+	Deleted, Added []RR
+}
+
+// Journal is the history of changes to a zone, used to answer IXFR queries (RFC 1995).
+// It's persisted to Path, as the changes in wire format in IXFR order: for each diff, the old SOA, the deleted
+// records, the new SOA and then the added records.
+type Journal struct {
+	Path  string
+	Diffs []ZoneDiff // Oldest first, each diff continuing from the one before.
+}
+
+// LoadJournal will read the journal at path. A journal that doesn't exist yet is empty.
+func LoadJournal(path string) (*Journal, error) {
+	j := &Journal{Path: path}
+	rrs, err := readRRFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		errStr := fmt.Sprintf("Corrupt journal %v: %v", path, err)
+		return nil, errors.New(errStr)
+	}
+
+	j.Diffs, err = parseDiffs(rrs)
+	if err != nil {
+		errStr := fmt.Sprintf("Corrupt journal %v: %v", path, err)
+		return nil, errors.New(errStr)
+	}
+	return j, nil
+}
+
+// parseDiffs splits records in IXFR order (for each diff: the old SOA, the deleted records, the new SOA and then
+// the added records) into diffs.
+func parseDiffs(rrs []RR) (diffs []ZoneDiff, err error) {
+	var diff *ZoneDiff
+	for _, rr := range rrs {
+		switch {
+		case diff == nil && rr.Type != TypeSOA:
+			return nil, errors.New("Diff doesn't start with an SOA record")
+		case rr.Type == TypeSOA && (diff == nil || diff.NewSOA.Type == TypeSOA):
+			diffs = append(diffs, ZoneDiff{OldSOA: rr})
+			diff = &diffs[len(diffs)-1]
+		case rr.Type == TypeSOA:
+			diff.NewSOA = rr
+		case diff.NewSOA.Type == TypeSOA:
+			diff.Added = append(diff.Added, rr)
+		default:
+			diff.Deleted = append(diff.Deleted, rr)
+		}
+	}
+	if diff != nil && diff.NewSOA.Type != TypeSOA {
+		return nil, errors.New("Last diff is incomplete")
+	}
+	return diffs, nil
+}
+
+// Serial returns the serial of the zone version the journal ends at, or false if the journal is empty.
+func (j *Journal) Serial() (uint32, bool) {
+	if j == nil || len(j.Diffs) == 0 {
+		return 0, false
+	}
+	return j.Diffs[len(j.Diffs)-1].NewSOA.RData.Serial, true
+}
+
+// Since returns the diffs that bring a zone with the given serial up to date, or false if the journal
+// doesn't go back that far.
+func (j *Journal) Since(serial uint32) ([]ZoneDiff, bool) {
+	if j == nil {
+		return nil, false
+	}
+	for i, diff := range j.Diffs {
+		if diff.OldSOA.RData.Serial == serial {
+			return j.Diffs[i:], true
+		}
+	}
+	return nil, false
+}
+
+// Append will add diff to the end of the journal and write the journal to disk.
+// The oldest diffs are dropped to keep at most journalMaxDiffs.
+func (j *Journal) Append(diff ZoneDiff) error {
+	if serial, ok := j.Serial(); ok && serial != diff.OldSOA.RData.Serial {
+		errStr := fmt.Sprintf("Diff from serial %v doesn't continue journal at serial %v", diff.OldSOA.RData.Serial, serial)
+		return errors.New(errStr)
+	}
+	diffs := append(j.Diffs[:len(j.Diffs):len(j.Diffs)], diff)
+	if len(diffs) > journalMaxDiffs {
+		diffs = diffs[len(diffs)-journalMaxDiffs:]
+	}
+	if err := writeJournal(j.Path, diffs); err != nil {
+		return err
+	}
+	j.Diffs = diffs
+	return nil
+}
+
+// Reset will empty the journal, removing it from disk.
+func (j *Journal) Reset() error {
+	j.Diffs = nil
+	if err := os.Remove(j.Path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// writeJournal will replace the journal file at path with diffs.
+func writeJournal(path string, diffs []ZoneDiff) error {
+	return writeRRFile(path, func(yield func(RR) bool) {
+		for _, diff := range diffs {
+			for _, rrs := range [][]RR{{diff.OldSOA}, diff.Deleted, {diff.NewSOA}, diff.Added} {
+				for _, rr := range rrs {
+					if !yield(rr) {
+						return
+					}
+				}
+			}
+		}
+	})
+}
+
+// readRRFile reads a file of records in uncompressed wire format, as written by writeRRFile.
+func readRRFile(path string) ([]RR, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []RR
+	for offset := uint(0); offset < uint(len(buf)); {
+		var rr RR
+		rr, offset, err = parseRR(buf, offset)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// writeRRFile will replace the file at path with rrs in uncompressed wire format, see writeFileAtomic.
+func writeRRFile(path string, rrs iter.Seq[RR]) error {
+	var buf []byte
+	for rr := range rrs {
+		bin, err := rr.Serialise()
+		if err != nil {
+			return err
+		}
+		buf = append(buf, bin...)
+	}
+
+	return writeFileAtomic(path, buf)
+}
+
+// DiffZones returns the changes from the zone from to the zone to. Both zones must have an SOA record.
+func DiffZones(from, to *Zone) (diff ZoneDiff, err error) {
+	oldSOA, ok := from.SOA()
+	newSOA, ok2 := to.SOA()
+	if !ok || !ok2 {
+		return diff, errors.New("Zones without an SOA record can't be diffed")
+	}
+	diff.OldSOA = from.RR(oldSOA, from.Name)
+	diff.NewSOA = to.RR(newSOA, to.Name)
+
+	oldRRs, err := zoneRRKeys(from)
+	if err != nil {
+		return diff, err
+	}
+	newRRs, err := zoneRRKeys(to)
+	if err != nil {
+		return diff, err
+	}
+	for rr := range from.All() {
+		if key, _ := rrKey(rr); rr.Type != TypeSOA && !newRRs[key] {
+			diff.Deleted = append(diff.Deleted, rr)
+		}
+	}
+	for rr := range to.All() {
+		if key, _ := rrKey(rr); rr.Type != TypeSOA && !oldRRs[key] {
+			diff.Added = append(diff.Added, rr)
+		}
+	}
+	return diff, nil
+}
+
+// zoneRRKeys returns the set of rrKeys of all records in zone.
+func zoneRRKeys(zone *Zone) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	for rr := range zone.All() {
+		key, err := rrKey(rr)
+		if err != nil {
+			return nil, err
+		}
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+// rrKey returns a key identifying rr, to compare records. Owner names are compared case-insensitively.
+func rrKey(rr RR) (string, error) {
+	rr.Name = Domain(strings.ToLower(rr.Name.AsFQDN().String()))
+	bin, err := rr.Serialise()
+	return string(bin), err
+}
+
+// CondenseDiffs merges consecutive diffs into one, with only the net changes (RFC 1995 section 5).
+// A record added by one diff and deleted by a later one, or the other way around, isn't included.
+func CondenseDiffs(diffs []ZoneDiff) (condensed ZoneDiff) {
+	condensed.OldSOA = diffs[0].OldSOA
+	condensed.NewSOA = diffs[len(diffs)-1].NewSOA
+
+	type change struct {
+		rr    RR
+		added bool
+	}
+	changes := make(map[string]change)
+	var order []string
+	record := func(rr RR, added bool) {
+		key, _ := rrKey(rr)
+		if c, ok := changes[key]; ok {
+			if c.added != added {
+				delete(changes, key)
+			}
+			return
+		}
+		changes[key] = change{rr: rr, added: added}
+		order = append(order, key)
+	}
+	for _, diff := range diffs {
+		for _, rr := range diff.Deleted {
+			record(rr, false)
+		}
+		for _, rr := range diff.Added {
+			record(rr, true)
+		}
+	}
+
+	for _, key := range order {
+		c, ok := changes[key]
+		if !ok {
+			continue
+		}
+		delete(changes, key) // A key can be in order twice, if it was cancelled out and then changed again.
+		if c.added {
+			condensed.Added = append(condensed.Added, c.rr)
+		} else {
+			condensed.Deleted = append(condensed.Deleted, c.rr)
+		}
+	}
+	return condensed
+}
+
+// updateJournal will record the changes from prev, the version of the zone served until now (nil if there is
+// none), to zone in zone's journal. If the journal can't be brought up to date with zone, it's reset.
+func updateJournal(prev, zone *Zone) error {
+	soa, ok := zone.SOA()
+	if !ok || zone.Journal == nil {
+		return nil
+	}
+
+	if prev != nil {
+		if prevSOA, ok := prev.SOA(); ok {
+			diff, err := DiffZones(prev, zone)
+			if err != nil {
+				return err
+			}
+			changed := len(diff.Deleted) > 0 || len(diff.Added) > 0
+			switch {
+			case serialLess(prevSOA.Serial, soa.Serial):
+				if err := zone.Journal.Append(diff); err != nil {
+					// The journal no longer leads to the zone, so it can't be used for IXFR.
+					return errors.Join(err, zone.Journal.Reset())
+				}
+			case changed && prevSOA.Serial == soa.Serial:
+				log.Warnf("Zone %v changed without its serial being increased, secondaries won't see the change", zone.Name)
+			}
+		}
+	}
+
+	if serial, ok := zone.Journal.Serial(); ok && serial != soa.Serial {
+		log.Warnf("Journal for zone %v ends at serial %v, but the zone has serial %v. Discarding it.",
+			zone.Name, serial, soa.Serial)
+		return zone.Journal.Reset()
+	}
+	return nil
+}
+
+// serialLess reports whether SOA serial a is before serial b, using serial number arithmetic (RFC 1982).
+func serialLess(a, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
@@ -0,0 +1,108 @@
+package dns
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testZoneFile writes a zone file for example.com with the given serial and records to dir.
+func testZoneFile(t *testing.T, dir string, serial uint32, records string) {
+	contents := fmt.Sprintf(`zone example.com.
+ttl 300
+soa ns.example.com. hostmaster.example.com. %v 3600 600 604800 60
+allow-transfer 192.0.2.0/24 127.0.0.1
+@ NS ns.example.com.
+%v
+`, serial, records)
+	if err := os.WriteFile(filepath.Join(dir, "example.zone"), []byte(contents), 0o644); err != nil {
+		t.Fatalf("Could not write zone file: %v", err)
+	}
+}
+
+// testIXFR sends an IXFR query for example.com from a client with the given serial, and returns the records
+// of all the replies.
+func testIXFR(t *testing.T, server *Server, serial uint32) []RR {
+	query := testQuery("example.com", TypeIXFR)
+	soa := RData{Type: TypeSOA, MName: "ns.example.com.", RName: "hostmaster.example.com.", Serial: serial}
+	query.Authority = []RR{soa.RR("example.com")}
+	var answers []RR
+	for _, reply := range testTransfer(t, server, query, "192.0.2.10") {
+		if reply.Header.Rcode != rcodeNoError {
+			t.Fatalf("IXFR failed with rcode %v", reply.Header.Rcode)
+		}
+		answers = append(answers, reply.Answer...)
+	}
+	return answers
+}
+
+// TestIXFR ensures zone reloads are journaled, and IXFR clients get the condensed changes since their serial.
+func TestIXFR(t *testing.T) {
+	dir := t.TempDir()
+	testZoneFile(t, dir, 1, "a A 192.0.2.1\nb A 192.0.2.2")
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+	testZoneFile(t, dir, 2, "a A 192.0.2.1\nb A 192.0.2.3\nc A 192.0.2.4")
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not reload zones: %v", err)
+	}
+	testZoneFile(t, dir, 3, "a A 192.0.2.1\nb A 192.0.2.3")
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not reload zones: %v", err)
+	}
+
+	// From serial 1, c was added and deleted again, so only the change to b remains.
+	answers := testIXFR(t, server, 1)
+	var summary []string
+	for _, rr := range answers {
+		if rr.Type == TypeSOA {
+			summary = append(summary, fmt.Sprintf("SOA %v", rr.RData.Serial))
+		} else {
+			summary = append(summary, fmt.Sprintf("%v %v", rr.Name, rr.RData.Addr))
+		}
+	}
+	expected := []string{"SOA 3", "SOA 1", "b.example.com 192.0.2.2", "SOA 3", "b.example.com 192.0.2.3", "SOA 3"}
+	if fmt.Sprint(summary) != fmt.Sprint(expected) {
+		t.Errorf("Wrong IXFR from serial 1:\n got %v\nwant %v", summary, expected)
+	}
+
+	if answers := testIXFR(t, server, 3); len(answers) != 1 || answers[0].Type != TypeSOA {
+		t.Errorf("Expected only the SOA record for an up to date client, got %v", answers)
+	}
+
+	// The journal doesn't go back to serial 0, so the whole zone is transferred instead.
+	if answers := testIXFR(t, server, 0); len(answers) != 5 {
+		t.Errorf("Expected a full zone transfer of 5 records, got %v", answers)
+	}
+
+	// The journal survives restarts.
+	restarted := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := restarted.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+	if restartedAnswers := testIXFR(t, restarted, 1); len(restartedAnswers) != len(answers) {
+		t.Errorf("Expected the same IXFR after a restart, got %v", restartedAnswers)
+	}
+}
+
+// TestSerialLess ensures serials are compared with wrap around (RFC 1982).
+func TestSerialLess(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		less bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{1, 1, false},
+		{0xFFFFFFFF, 0, true},
+		{0, 0xFFFFFFFF, false},
+	}
+	for _, test := range tests {
+		if serialLess(test.a, test.b) != test.less {
+			t.Errorf("serialLess(%v, %v) should be %v", test.a, test.b, test.less)
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package dns
 
 import (
 	"bufio"
@@ -27,6 +27,16 @@ const (
 var Keywords = [...]string{
 	"zone",
 	"ttl",
+	"soa",
+	"allow-transfer",
+	"primary",
+	"notify",
+	"allow-notify",
+	"allow-update",
+	"tsig-key",
+	"dnssec-key",
+	"denial",
+	"ptr-from",
 }
 
 type Token struct {
@@ -35,8 +45,9 @@ type Token struct {
 }
 
 type Lexer struct {
-	input *bufio.Reader
-	Line  int // Current line number
+	input  *bufio.Reader
+	Line   int    // Current line number
+	peeked *Token // Token read by Peek, which Next returns next.
 }
 
 func NewLexer(input *bufio.Reader) Lexer {
@@ -46,6 +57,11 @@ func NewLexer(input *bufio.Reader) Lexer {
 // Next scans input for the next token and returns it.
 // This method will always return a TokenEOF upon EOF.
 func (l *Lexer) Next() (Token, error) {
+	if l.peeked != nil {
+		token := *l.peeked
+		l.peeked = nil
+		return token, nil
+	}
 	s, eof, err := l.getToken()
 
 	if err != nil {
@@ -63,6 +79,18 @@ func (l *Lexer) Next() (Token, error) {
 	return token, nil
 }
 
+// Peek returns the next token without consuming it, so it's returned by Next as well.
+func (l *Lexer) Peek() (Token, error) {
+	if l.peeked == nil {
+		token, err := l.Next()
+		if err != nil {
+			return token, err
+		}
+		l.peeked = &token
+	}
+	return *l.peeked, nil
+}
+
 // getToken reads runes from the input reader and builds a token value for
 // analysis. It throws away comments and whitespace, returning a word.
 // If EOF is true, input hit EOF on the first read, and no value is returned.
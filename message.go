@@ -1,11 +1,15 @@
-package main
+package dns
 
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"math"
 	"net/netip"
+	"slices"
 	"strings"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // iota isn't used here for clarity regarding the DNS protocol.
@@ -17,15 +21,22 @@ const (
 	opcodeQuery  byte = 0
 	opcodeIquery byte = 1
 	opcodeStatus byte = 2
-	opcodeMax    byte = 3 // Invalid opcodes start here.
+	opcodeNotify byte = 4 // RFC 1996
+	opcodeUpdate byte = 5 // RFC 2136
+	opcodeMax    byte = 6 // Invalid opcodes start here.
 	// Header response code flags
 	rcodeNoError        byte = 0
 	rcodeFormErr        byte = 1 // Format error - The name server was unable to interpret the query.
 	rcodeServFail       byte = 2 // Server failure - The name server was unable to process this query due to a problem with the name server.
 	rcodeNxdomain       byte = 3 // Name Error - signifies that the domain name referenced in the query does not exist.
 	rcodeNotImplemented byte = 4
-	rcodeRefused        byte = 5 // Server is refusing to answer
-	rcodeMax            byte = 6 // Invalid rcodes start here.
+	rcodeRefused        byte = 5  // Server is refusing to answer
+	rcodeYXDomain       byte = 6  // UPDATE: a name exists when it should not.
+	rcodeYXRRSet        byte = 7  // UPDATE: an RRset exists when it should not.
+	rcodeNXRRSet        byte = 8  // UPDATE: an RRset that should exist does not.
+	rcodeNotAuth        byte = 9  // UPDATE: the server is not authoritative for the zone.
+	rcodeNotZone        byte = 10 // UPDATE: a name is not within the zone.
+	rcodeMax            byte = 11 // Invalid rcodes start here.
 )
 
 type Header struct {
@@ -64,55 +75,97 @@ type DNSMsg struct {
 	Question   []Question
 	Answer     []RR
 	Authority  []RR
-	Additional []RR
+	Additional []RR  // Excluding the OPT and TSIG pseudo-RRs, which are kept in EDNS and TSIG.
+	EDNS       *EDNS // nil if the message has no OPT record.
+	TSIG       *TSIG // nil if the message isn't signed. Only set by ParseDNSMsg, messages are signed once serialised.
 }
 
 // ParseDNSMsg will construct a DNSMsg from a binary DNS message payload.
 func ParseDNSMsg(buf []byte) (msg DNSMsg, err error) {
 	// Header
-	headerBuf := [12]byte(buf)
-	buf = buf[12:]
-	msg.Header, err = parseHeader(headerBuf)
+	if len(buf) < 12 {
+		err = errors.New("Message is too small for a DNS header")
+		return
+	}
+	msg.Header, err = parseHeader([12]byte(buf))
 	if err != nil {
 		return
 	}
+	offset := uint(12)
 	// Question
-	var offset uint
 	for i := 0; i < int(msg.Header.QDCount); i++ {
-		q, offset, err := parseQuestion(buf)
+		var q Question
+		q, offset, err = parseQuestion(buf, offset)
 		if err != nil {
-			return msg, err
+			return
 		}
 		msg.Question = append(msg.Question, q)
-		buf = buf[offset:]
 	}
 	// Answer
-	msg.Answer, offset, err = parseRRs(buf, msg.Header.ANCount)
+	msg.Answer, offset, err = parseRRs(buf, offset, msg.Header.ANCount)
 	if err != nil {
 		return
 	}
-	buf = buf[offset:]
 	// Authority
-	msg.Authority, offset, err = parseRRs(buf, msg.Header.NSCount)
+	msg.Authority, offset, err = parseRRs(buf, offset, msg.Header.NSCount)
 	if err != nil {
 		return
 	}
-	buf = buf[offset:]
-	// Additional
-	msg.Additional, offset, err = parseRRs(buf, msg.Header.ARCount)
+	// Additional. A TSIG record must be the last record of the message.
+	var additional []RR
+	for range msg.Header.ARCount {
+		if msg.TSIG != nil {
+			err = errors.New("TSIG record isn't the last record of the message")
+			return
+		}
+		var rr RR
+		msg.TSIG, rr, offset, err = parseAdditionalRR(buf, offset)
+		if err != nil {
+			return
+		}
+		if msg.TSIG == nil {
+			additional = append(additional, rr)
+		}
+	}
+	for _, rr := range additional {
+		if rr.Type != TypeOPT {
+			msg.Additional = append(msg.Additional, rr)
+			continue
+		}
+		if msg.EDNS != nil {
+			err = errors.New("Message contains more than one OPT record")
+			return
+		}
+		msg.EDNS, err = ednsFromRR(rr)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
 
-// parseRRs parses numRRs RRs from a DNS message.
-// offset is the length of the parsed RRs read from buf in bytes.
-func parseRRs(buf []byte, numRRs uint16) (rrs []RR, offset uint, err error) {
+// parseAdditionalRR parses an RR of the additional section of the DNS message msg, starting at msg[offset].
+// If the RR is a TSIG record, it's returned as tsig rather than rr.
+func parseAdditionalRR(msg []byte, offset uint) (tsig *TSIG, rr RR, next uint, err error) {
+	tsig, next, err = parseTSIG(msg, offset)
+	if tsig != nil || err != nil {
+		return
+	}
+	rr, next, err = parseRR(msg, offset)
+	return
+}
+
+// parseRRs parses numRRs RRs from the DNS message msg, starting at msg[offset].
+// next is the offset of whatever follows the parsed RRs in msg.
+func parseRRs(msg []byte, offset uint, numRRs uint16) (rrs []RR, next uint, err error) {
+	next = offset
 	for i := 0; i < int(numRRs); i++ {
-		rr, thisOffset, err := parseRR(buf)
+		var rr RR
+		rr, next, err = parseRR(msg, next)
 		if err != nil {
-			return rrs, offset, err
+			return
 		}
 		rrs = append(rrs, rr)
-		offset += thisOffset
 	}
 	return
 }
@@ -145,31 +198,22 @@ func (t TXTData) Serialise() (buf []byte) {
 	return
 }
 
-// NewDNSMsg constructs a no-error reply DNSMsg given an original query and answer Rdata,
-// mapped by the original queried domain.
-func NewDNSMsg(original DNSMsg, answers map[Domain][]RData) (reply DNSMsg, err error) {
-	for domain, answers := range answers {
-		for _, rdata := range answers {
-			reply.Answer = append(reply.Answer, rdata.RR(domain))
-		}
-	}
-
-	if len(reply.Answer) > math.MaxUint16 { // Unlikely, but...
-		err = errors.New("Too many answers given")
-		return
-	}
-
+// NewDNSMsg constructs a no-error reply DNSMsg to an original query, with empty answer,
+// authority and additional sections to be filled in by the caller.
+func NewDNSMsg(original DNSMsg) (reply DNSMsg) {
 	reply.Header = Header{
-		ID:      original.Header.ID,
-		QR:      qrReply,
-		Opcode:  original.Header.Opcode,
-		AA:      true, // We're an authoritive-only DNS server.
-		Rcode:   rcodeNoError,
-		QDCount: uint16(len(original.Question)),
-		ANCount: uint16(len(reply.Answer)),
+		ID:     original.Header.ID,
+		QR:     qrReply,
+		Opcode: original.Header.Opcode,
+		AA:     true, // We're an authoritive-only DNS server.
+		RD:     original.Header.RD,
+		Rcode:  rcodeNoError,
 	}
 
 	reply.Question = original.Question
+	if original.EDNS != nil {
+		reply.EDNS = NewEDNS(original.EDNS)
+	}
 
 	return
 }
@@ -183,26 +227,104 @@ func NewDNSMsgErr(original DNSMsg, rcode byte) DNSMsg {
 		AA:     true,
 		Rcode:  rcode,
 	}
-	return DNSMsg{Header: header}
+	reply := DNSMsg{Header: header}
+	if original.EDNS != nil {
+		reply.EDNS = NewEDNS(original.EDNS)
+	}
+	return reply
+}
+
+// SetRcode sets the response code of m, which may be an extended RCODE if m has an OPT record.
+func (m *DNSMsg) SetRcode(rcode uint16) {
+	m.Header.Rcode = byte(rcode & 0xF)
+	if m.EDNS != nil {
+		m.EDNS.ExtRcode = byte(rcode >> 4)
+	}
 }
 
 // Serialise will serialise a DNSMsg into a binary DNS Message payload.
+// The section counts in the header are set from the lengths of the sections.
 func (m DNSMsg) Serialise() ([]byte, error) {
-	var payload []byte
-	payload = append(payload, m.Header.Serialise()...)
-	for _, q := range m.Question {
-		payload = append(payload, q.Serialise()...)
+	return m.SerialiseLimit(math.MaxInt)
+}
+
+// SerialiseLimit will serialise a DNSMsg into a binary DNS Message payload of at most limit bytes.
+// If the message doesn't fit, whole RRsets are dropped from the end of the message. The TC bit is set if an RRset
+// had to be dropped from the answer or authority sections, so the client knows to retry over TCP.
+// The OPT record is never dropped.
+func (m DNSMsg) SerialiseLimit(limit int) ([]byte, error) {
+	if max(len(m.Question), len(m.Answer), len(m.Authority), len(m.Additional)+1) > math.MaxUint16 {
+		return nil, errors.New("Too many records in a message section")
 	}
-	for _, rr := range m.Answer {
-		bin, err := rr.Serialise()
+
+	var opt []byte
+	if m.EDNS != nil {
+		var err error
+		opt, err = m.EDNS.RR().Serialise()
 		if err != nil {
-			return payload, err
+			return nil, err
+		}
+	}
+
+	header := m.Header
+	header.QDCount = uint16(len(m.Question))
+	header.ANCount, header.NSCount, header.ARCount = 0, 0, 0
+
+	payload := make([]byte, 12) // The header is filled in last, when the section counts are known.
+	comp := compressionMap{}
+	for _, q := range m.Question {
+		payload = q.appendTo(payload, comp)
+	}
+	if len(payload)+len(opt) > limit {
+		return nil, errors.New("Message header and question don't fit in the size limit")
+	}
+
+	counts := []*uint16{&header.ANCount, &header.NSCount, &header.ARCount}
+sections:
+	for i, section := range [][]RR{m.Answer, m.Authority, m.Additional} {
+		for start := 0; start < len(section); {
+			end := rrsetEnd(section, start)
+			setStart := len(payload)
+			for _, rr := range section[start:end] {
+				var err error
+				payload, err = rr.appendTo(payload, comp)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if len(payload)+len(opt) > limit {
+				// Only missing additional data is harmless, everything else means the client needs to retry.
+				// Nothing more is written after this, so comp may safely refer to the discarded RRset.
+				payload = payload[:setStart]
+				header.TC = i < len(counts)-1
+				break sections
+			}
+			*counts[i] += uint16(end - start)
+			start = end
 		}
-		payload = append(payload, bin...)
 	}
+	if header.TC {
+		log.Debugf("Truncated reply for message ID %v to %v bytes", header.ID, limit)
+	}
+
+	if m.EDNS != nil {
+		payload = append(payload, opt...)
+		header.ARCount++
+	}
+	copy(payload, header.Serialise())
 	return payload, nil
 }
 
+// rrsetEnd returns the index after the end of the RRset starting at rrs[start].
+// RRs of one RRset are expected to be adjacent.
+func rrsetEnd(rrs []RR, start int) int {
+	end := start + 1
+	for end < len(rrs) && rrs[end].Name == rrs[start].Name && rrs[end].Type == rrs[start].Type {
+		end++
+	}
+	return end
+}
+
 // RR converts r into an RR. name must be given, as an RData RecordName could contain ambiguous wildcards, etc.
 func (r RData) RR(name Domain) RR {
 	return RR{
@@ -214,38 +336,94 @@ func (r RData) RR(name Domain) RR {
 	}
 }
 
-// serialiseName will serialise a domain into a "name" section of a DNS message.
-func serialiseName(name Domain) (payload []byte) {
-	for _, l := range name.Labels() {
+// compressionMap maps the names already written to a message to their offsets, for name compression
+// (RFC 1035 4.1.4). Keys are lowercase, so names differing only in case share a pointer.
+type compressionMap map[string]int
+
+// serialiseName will serialise a domain into a "name" section of a DNS message, without compression.
+func serialiseName(name Domain) []byte {
+	return appendName(nil, name, nil)
+}
+
+// appendName appends the wire form of name to the message payload. Any suffix of name which has already been
+// written is replaced by a compression pointer. The suffixes written are added to comp.
+// payload must start at the beginning of the message, as pointers are offsets from the start of the message.
+// If comp is nil, the name is written in full.
+func appendName(payload []byte, name Domain, comp compressionMap) []byte {
+	labels := name.Labels()
+	for i, l := range labels {
+		if l == "" { // The root domain has no labels.
+			continue
+		}
+		if comp != nil {
+			suffix := strings.ToLower(strings.Join(labels[i:], "."))
+			if ptr, ok := comp[suffix]; ok {
+				return binary.BigEndian.AppendUint16(payload, 0xC000|uint16(ptr))
+			}
+			if len(payload) <= 0x3FFF { // Pointers only have 14 bits.
+				comp[suffix] = len(payload)
+			}
+		}
 		payload = append(payload, byte(len(l)))
 		payload = append(payload, []byte(l)...)
 	}
-	payload = append(payload, 0)
-	return
+	return append(payload, 0)
 }
 
-// parseName will parse the "name" section or a domain of a DNS message segment.
-// d is the parsed domain, offset is the total length of the name section,
-// i.e. buf[offset] is the start of the next section.
-func parseName(buf []byte) (d Domain, offset uint, err error) {
-	sep := ""
+// parseName will parse a possibly compressed domain name of a DNS message, starting at msg[offset].
+// d is the parsed domain, next is the offset of whatever follows the name in msg,
+// i.e. after the first compression pointer if there is one.
+func parseName(msg []byte, offset uint) (d Domain, next uint, err error) {
+	var labels []string
+	nameLen := 1 // The zero octet of the root label
+	jumped := false
+	pos := offset
 	for {
-		octets := uint(buf[offset])
-		offset++
-		if octets == 0 { // NULL, end of QNAME.
-			break
-		}
-		if uint(len(buf)) <= offset+octets {
+		if pos >= uint(len(msg)) {
 			err = errors.New("Name buffer is too small for domain")
 			return
 		}
-		label := string(buf[offset : offset+octets])
-		d += Domain(sep + label)
-		sep = "."
-		offset += octets
+		octets := uint(msg[pos])
+		switch octets & 0xC0 {
+		case 0x00: // Label, or NULL at the end of the name.
+			if octets == 0 {
+				if !jumped {
+					next = pos + 1
+				}
+				return Domain(strings.Join(labels, ".")), next, nil
+			}
+			if uint(len(msg)) <= pos+octets {
+				err = errors.New("Name buffer is too small for domain")
+				return
+			}
+			// Along with pointers only pointing backwards, this length limit also guarantees we can't loop forever.
+			nameLen += int(octets) + 1
+			if nameLen > 255 {
+				err = errors.New("Domain name is longer than 255 octets")
+				return
+			}
+			labels = append(labels, string(msg[pos+1:pos+1+octets]))
+			pos += octets + 1
+		case 0xC0: // Compression pointer
+			if uint(len(msg)) <= pos+1 {
+				err = errors.New("Name buffer is too small for compression pointer")
+				return
+			}
+			ptr := uint(binary.BigEndian.Uint16(msg[pos:pos+2]) & 0x3FFF)
+			if ptr >= pos {
+				err = errors.New("Compression pointer does not point to an earlier name")
+				return
+			}
+			if !jumped {
+				next = pos + 2
+				jumped = true
+			}
+			pos = ptr
+		default:
+			err = errors.New("Unsupported label type in domain name")
+			return
+		}
 	}
-
-	return
 }
 
 func parseHeader(buf [12]byte) (Header, error) {
@@ -278,34 +456,30 @@ func parseHeader(buf [12]byte) (Header, error) {
 	return header, nil
 }
 
-// parseQuestion decodes one question from a question section of a DNS message from the start of buf.
-// offset is the length of the parsed question read from buf in bytes.
-func parseQuestion(buf []byte) (question Question, offset uint, err error) {
+// parseQuestion decodes one question from a question section of the DNS message msg, starting at msg[offset].
+// next is the offset of whatever follows the question in msg.
+func parseQuestion(msg []byte, offset uint) (question Question, next uint, err error) {
 	err_small := errors.New("Question buffer is too small")
-	if len(buf) <= 0 {
-		err = err_small
-		return
-	}
 
-	question.Name, offset, err = parseName(buf)
+	question.Name, next, err = parseName(msg, offset)
 	if err != nil {
 		return
 	}
 
-	if uint(len(buf)) < offset+4 { // +4 for QTYPE + QCLASS
+	if uint(len(msg)) < next+4 { // +4 for QTYPE + QCLASS
 		err = err_small
 		return
 	}
 
-	question.Type = RecType(binary.BigEndian.Uint16(buf[offset : offset+2]))
-	offset += 2
-	question.Class = QClass(binary.BigEndian.Uint16(buf[offset : offset+2]))
-	offset += 2
+	question.Type = RecType(binary.BigEndian.Uint16(msg[next : next+2]))
+	next += 2
+	question.Class = QClass(binary.BigEndian.Uint16(msg[next : next+2]))
+	next += 2
 
 	if !question.Name.Valid() {
 		err = errors.New("Invalid Domain in question section")
 	}
-	if !question.Type.Valid() {
+	if !question.Type.ValidQType() {
 		err = errors.New("Invalid or unsupported record type in question section")
 	}
 	if !question.Class.Valid() {
@@ -315,64 +489,214 @@ func parseQuestion(buf []byte) (question Question, offset uint, err error) {
 	return
 }
 
-func parseRR(buf []byte) (rr RR, offset uint, err error) {
+// parseRR decodes one RR of the DNS message msg, starting at msg[offset].
+// next is the offset of whatever follows the RR in msg.
+func parseRR(msg []byte, offset uint) (rr RR, next uint, err error) {
 	err_small := errors.New("RR buffer is too small")
-	if len(buf) <= 0 {
-		err = err_small
-		return
-	}
 
-	rr.Name, offset, err = parseName(buf)
+	rr.Name, next, err = parseName(msg, offset)
 	if err != nil {
 		return
 	}
 
-	if uint(len(buf)) < offset+10 {
+	if uint(len(msg)) < next+10 {
 		err = err_small
 		return
 	}
 
-	rr.Type = RecType(binary.BigEndian.Uint16(buf[offset : offset+2]))
-	offset += 2
-	rr.Class = QClass(binary.BigEndian.Uint16(buf[offset : offset+2]))
-	offset += 2
-	rr.TTL = binary.BigEndian.Uint32(buf[offset : offset+4])
-	offset += 4
+	rr.Type = RecType(binary.BigEndian.Uint16(msg[next : next+2]))
+	next += 2
+	rr.Class = QClass(binary.BigEndian.Uint16(msg[next : next+2]))
+	next += 2
+	rr.TTL = binary.BigEndian.Uint32(msg[next : next+4])
+	next += 4
+
+	rdLen := uint(binary.BigEndian.Uint16(msg[next : next+2]))
+	next += 2
 
-	rdLen := binary.BigEndian.Uint16(buf[offset : offset+2])
-	offset += 2
+	if rdLen == 0 && (rr.Class == QClassANY || rr.Class == QClassNONE) {
+		// Prerequisites and deletions in UPDATE messages (RFC 2136) have no RDATA, which is kept as the zero RData.
+		return
+	}
 
-	if uint(len(buf)) < offset+uint(rdLen) {
+	if uint(len(msg)) < next+rdLen {
 		err = err_small
 		return
 	}
 
-	rr.RData, err = parseRData(rr.Type, rr.TTL, buf[offset:offset+uint(rdLen)])
+	rr.RData, err = parseRData(rr.Type, rr.TTL, msg, next, rdLen)
+	next += rdLen
 
 	return
 }
 
-func parseRData(t RecType, ttl uint32, buf []byte) (rdata RData, err error) {
-	if !t.Valid() {
-		err = errors.New("Unknown RDATA type")
+// parseRData decodes the rdLen bytes of RDATA at msg[offset]. The whole message is needed,
+// as domain names in the RDATA may be compressed.
+func parseRData(t RecType, ttl uint32, msg []byte, offset uint, rdLen uint) (rdata RData, err error) {
+	if !t.Valid() && t.Meta() {
+		errStr := fmt.Sprintf("%v isn't a type of record", t)
+		err = errors.New(errStr)
 		return
 	}
 
 	rdata.Type = t
 	rdata.TTL = uint(ttl)
+	buf := msg[offset : offset+rdLen]
+	end := offset + rdLen
 
 	switch t {
 	case TypeA:
+		if len(buf) != 4 {
+			err = errors.New("Invalid A address length in RDATA")
+			return
+		}
 		rdata.Addr = netip.AddrFrom4([4]byte(buf))
-	case TypeNS, TypeCNAME, TypePTR:
-		rdata.Target, _, err = parseName(buf)
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME, TypeALIAS:
+		rdata.Target, err = parseRDataName(msg[:end], offset)
 	case TypeMX:
+		if len(buf) < 3 {
+			err = errors.New("MX RDATA is too small")
+			return
+		}
+		rdata.Pref = binary.BigEndian.Uint16(buf)
+		rdata.Target, err = parseRDataName(msg[:end], offset+2)
+	case TypeSRV:
+		if len(buf) < 7 {
+			err = errors.New("SRV RDATA is too small")
+			return
+		}
 		rdata.Pref = binary.BigEndian.Uint16(buf)
-		rdata.Target, _, err = parseName(buf[2:])
+		rdata.Weight = binary.BigEndian.Uint16(buf[2:])
+		rdata.Port = binary.BigEndian.Uint16(buf[4:])
+		rdata.Target, err = parseRDataName(msg[:end], offset+6)
 	case TypeTXT:
 		rdata.TXT, err = parseTXTData(buf)
 	case TypeAAAA:
+		if len(buf) != 16 {
+			err = errors.New("Invalid AAAA address length in RDATA")
+			return
+		}
 		rdata.Addr = netip.AddrFrom16([16]byte(buf))
+	case TypeOPT:
+		rdata.Options, err = parseEDNSOptions(buf)
+	case TypeDNSKEY:
+		if len(buf) < 4 {
+			err = errors.New("DNSKEY RDATA is too small")
+			return
+		}
+		rdata.Flags = binary.BigEndian.Uint16(buf)
+		rdata.Protocol, rdata.Algorithm = buf[2], buf[3]
+		rdata.PublicKey = slices.Clone(buf[4:])
+	case TypeRRSIG:
+		if len(buf) < 19 {
+			err = errors.New("RRSIG RDATA is too small")
+			return
+		}
+		rdata.TypeCovered = RecType(binary.BigEndian.Uint16(buf))
+		rdata.Algorithm, rdata.Labels = buf[2], buf[3]
+		rdata.OrigTTL = binary.BigEndian.Uint32(buf[4:])
+		rdata.Expiration = binary.BigEndian.Uint32(buf[8:])
+		rdata.Inception = binary.BigEndian.Uint32(buf[12:])
+		rdata.KeyTag = binary.BigEndian.Uint16(buf[16:])
+		var next uint
+		rdata.SignerName, next, err = parseName(msg[:end], offset+18)
+		if err != nil {
+			return
+		}
+		rdata.Signature = slices.Clone(msg[next:end])
+	case TypeDS:
+		if len(buf) < 5 {
+			err = errors.New("DS RDATA is too small")
+			return
+		}
+		rdata.KeyTag = binary.BigEndian.Uint16(buf)
+		rdata.Algorithm, rdata.DigestType = buf[2], buf[3]
+		rdata.Digest = slices.Clone(buf[4:])
+	case TypeCAA:
+		if len(buf) < 2 || len(buf) < 2+int(buf[1]) || buf[1] == 0 {
+			err = errors.New("Invalid CAA tag length in RDATA")
+			return
+		}
+		rdata.Flags = uint16(buf[0])
+		rdata.Tag = string(buf[2 : 2+buf[1]])
+		rdata.Value = string(buf[2+buf[1]:])
+	case TypeTLSA:
+		if len(buf) < 3 {
+			err = errors.New("TLSA RDATA is too small")
+			return
+		}
+		rdata.Usage, rdata.Selector, rdata.DigestType = buf[0], buf[1], buf[2]
+		rdata.Digest = slices.Clone(buf[3:])
+	case TypeSSHFP:
+		if len(buf) < 2 {
+			err = errors.New("SSHFP RDATA is too small")
+			return
+		}
+		rdata.Algorithm, rdata.DigestType = buf[0], buf[1]
+		rdata.Digest = slices.Clone(buf[2:])
+	case TypeSVCB, TypeHTTPS:
+		if len(buf) < 3 {
+			err = errors.New("SVCB RDATA is too small")
+			return
+		}
+		rdata.Pref = binary.BigEndian.Uint16(buf)
+		var next uint
+		if rdata.Target, next, err = parseName(msg[:end], offset+2); err != nil {
+			return
+		}
+		rdata.Target = rdata.Target.AsFQDN()
+		if rdata.Params, err = parseSvcParams(msg[next:end]); err != nil {
+			return
+		}
+		err = validateSvcParams(rdata.Pref, rdata.Params)
+	case TypeNSEC:
+		var next uint
+		rdata.NextName, next, err = parseName(msg[:end], offset)
+		if err != nil {
+			return
+		}
+		rdata.Types, err = parseTypeBitmap(msg[next:end])
+	case TypeNSEC3, TypeNSEC3PARAM:
+		if len(buf) < 5 || len(buf) < 5+int(buf[4]) {
+			errStr := fmt.Sprintf("%v RDATA is too small", t)
+			err = errors.New(errStr)
+			return
+		}
+		rdata.Algorithm, rdata.Flags = buf[0], uint16(buf[1])
+		rdata.Iterations = binary.BigEndian.Uint16(buf[2:])
+		rest := buf[5+int(buf[4]):]
+		rdata.Salt = slices.Clone(buf[5 : 5+int(buf[4])])
+		if t == TypeNSEC3PARAM {
+			break
+		}
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			err = errors.New("NSEC3 RDATA is too small")
+			return
+		}
+		rdata.NextHashed = slices.Clone(rest[1 : 1+int(rest[0])])
+		rdata.Types, err = parseTypeBitmap(rest[1+int(rest[0]):])
+	case TypeSOA:
+		var next uint
+		rdata.MName, next, err = parseName(msg[:end], offset)
+		if err != nil {
+			return
+		}
+		rdata.RName, next, err = parseName(msg[:end], next)
+		if err != nil {
+			return
+		}
+		if end-next != 20 {
+			err = errors.New("Invalid SOA RDATA length")
+			return
+		}
+		rdata.MName, rdata.RName = rdata.MName.AsFQDN(), rdata.RName.AsFQDN()
+		for _, field := range []*uint32{&rdata.Serial, &rdata.Refresh, &rdata.Retry, &rdata.Expire, &rdata.Minimum} {
+			*field = binary.BigEndian.Uint32(msg[next : next+4])
+			next += 4
+		}
+	default:
+		// We don't know the type, so its RDATA is passed through as it is (RFC 3597 section 4).
+		rdata.Data = slices.Clone(buf)
 	}
 
 	if err != nil {
@@ -386,6 +710,13 @@ func parseRData(t RecType, ttl uint32, buf []byte) (rdata RData, err error) {
 	return
 }
 
+// parseRDataName parses a domain name from RDATA at msg[offset], where msg ends at the end of the RDATA.
+// The name is returned as an FQDN, like targets parsed from zone files.
+func parseRDataName(msg []byte, offset uint) (Domain, error) {
+	name, _, err := parseName(msg, offset)
+	return name.AsFQDN(), err
+}
+
 func boolToUint16(b bool) uint16 {
 	if b {
 		return 1
@@ -420,44 +751,189 @@ func (h Header) Serialise() (payload []byte) {
 
 // Serialise will convert q into a single question of a question section of a DNS message.
 func (q Question) Serialise() (payload []byte) {
-	payload = serialiseName(q.Name)
+	return q.appendTo(nil, nil)
+}
+
+// appendTo appends q to the message payload, compressing its name with comp. See appendName.
+func (q Question) appendTo(payload []byte, comp compressionMap) []byte {
+	payload = appendName(payload, q.Name, comp)
 	payload = binary.BigEndian.AppendUint16(payload, uint16(q.Type))
 	payload = binary.BigEndian.AppendUint16(payload, uint16(q.Class))
-	return
+	return payload
 }
 
+// Serialise will convert r into RDATA, without name compression.
 func (r RData) Serialise() (payload []byte, err error) {
+	return r.appendTo([]byte{}, nil)
+}
+
+// appendTo appends r as RDATA to the message payload. Domain names are compressed using comp
+// for the record types defined in RFC 1035, see appendName.
+func (r RData) appendTo(payload []byte, comp compressionMap) ([]byte, error) {
 	switch r.Type {
 	case TypeA, TypeAAAA:
-		payload = r.Addr.AsSlice()
+		payload = append(payload, r.Addr.AsSlice()...)
 	case TypeNS, TypeCNAME, TypePTR:
-		payload = serialiseName(r.Target)
+		payload = appendName(payload, r.Target, comp)
+	case TypeDNAME, TypeALIAS:
+		payload = appendName(payload, r.Target, nil) // Never compressed (RFC 6672 section 2.5), nor are other types.
 	case TypeMX:
 		payload = binary.BigEndian.AppendUint16(payload, r.Pref)
-		payload = append(payload, serialiseName(r.Target)...)
+		payload = appendName(payload, r.Target, comp)
+	case TypeSRV:
+		for _, field := range []uint16{r.Pref, r.Weight, r.Port} {
+			payload = binary.BigEndian.AppendUint16(payload, field)
+		}
+		payload = appendName(payload, r.Target, nil) // SRV targets are never compressed (RFC 2782).
 	case TypeTXT:
-		payload = r.TXT.Serialise()
+		payload = append(payload, r.TXT.Serialise()...)
+	case TypeOPT:
+		payload = append(payload, serialiseEDNSOptions(r.Options)...)
+	case TypeSOA:
+		payload = appendName(payload, r.MName, comp)
+		payload = appendName(payload, r.RName, comp)
+		for _, field := range []uint32{r.Serial, r.Refresh, r.Retry, r.Expire, r.Minimum} {
+			payload = binary.BigEndian.AppendUint32(payload, field)
+		}
+	case TypeDNSKEY:
+		payload = binary.BigEndian.AppendUint16(payload, r.Flags)
+		payload = append(payload, r.Protocol, r.Algorithm)
+		payload = append(payload, r.PublicKey...)
+	case TypeRRSIG:
+		payload = r.appendRRSIGFields(payload)
+		payload = append(payload, r.Signature...)
+	case TypeDS:
+		payload = binary.BigEndian.AppendUint16(payload, r.KeyTag)
+		payload = append(payload, r.Algorithm, r.DigestType)
+		payload = append(payload, r.Digest...)
+	case TypeCAA:
+		if len(r.Tag) == 0 || len(r.Tag) > 255 {
+			errStr := fmt.Sprintf("Invalid CAA tag length %v", len(r.Tag))
+			return payload, errors.New(errStr)
+		}
+		payload = append(payload, byte(r.Flags), byte(len(r.Tag)))
+		payload = append(payload, r.Tag...)
+		payload = append(payload, r.Value...)
+	case TypeTLSA:
+		payload = append(payload, r.Usage, r.Selector, r.DigestType)
+		payload = append(payload, r.Digest...)
+	case TypeSSHFP:
+		payload = append(payload, r.Algorithm, r.DigestType)
+		payload = append(payload, r.Digest...)
+	case TypeSVCB, TypeHTTPS:
+		payload = binary.BigEndian.AppendUint16(payload, r.Pref)
+		payload = appendName(payload, r.Target, nil) // Never compressed (RFC 9460 section 2.2).
+		payload = appendSvcParams(payload, r.Params)
+	case TypeNSEC:
+		payload = appendName(payload, r.NextName, nil)
+		payload = appendTypeBitmap(payload, r.Types)
+	case TypeNSEC3, TypeNSEC3PARAM:
+		payload = append(payload, r.Algorithm, byte(r.Flags))
+		payload = binary.BigEndian.AppendUint16(payload, r.Iterations)
+		payload = append(payload, byte(len(r.Salt)))
+		payload = append(payload, r.Salt...)
+		if r.Type == TypeNSEC3 {
+			payload = append(payload, byte(len(r.NextHashed)))
+			payload = append(payload, r.NextHashed...)
+			payload = appendTypeBitmap(payload, r.Types)
+		}
 	default:
-		err = errors.New("Unknown RDATA type")
+		if r.Type.Valid() {
+			return payload, errors.New("Unknown RDATA type")
+		}
+		payload = append(payload, r.Data...)
 	}
 
-	return
+	return payload, nil
 }
 
+// appendRRSIGFields appends the RDATA of the RRSIG record r, except for the signature, to payload.
+// The signer name is never compressed (RFC 4034 section 3.1.7).
+func (r RData) appendRRSIGFields(payload []byte) []byte {
+	payload = binary.BigEndian.AppendUint16(payload, uint16(r.TypeCovered))
+	payload = append(payload, r.Algorithm, r.Labels)
+	payload = binary.BigEndian.AppendUint32(payload, r.OrigTTL)
+	payload = binary.BigEndian.AppendUint32(payload, r.Expiration)
+	payload = binary.BigEndian.AppendUint32(payload, r.Inception)
+	payload = binary.BigEndian.AppendUint16(payload, r.KeyTag)
+	return appendName(payload, r.SignerName, nil)
+}
+
+// appendTypeBitmap appends the type bit maps field of an NSEC or NSEC3 record listing types, which must be sorted
+// (RFC 4034 section 4.1.2), to payload.
+func appendTypeBitmap(payload []byte, types []RecType) []byte {
+	for i := 0; i < len(types); {
+		window := byte(types[i] >> 8)
+		var bitmap [32]byte
+		length := 0
+		for ; i < len(types) && byte(types[i]>>8) == window; i++ {
+			low := byte(types[i])
+			bitmap[low/8] |= 0x80 >> (low % 8)
+			length = int(low/8) + 1
+		}
+		payload = append(payload, window, byte(length))
+		payload = append(payload, bitmap[:length]...)
+	}
+	return payload
+}
+
+// parseTypeBitmap parses the type bit maps field of an NSEC or NSEC3 record into the types it lists, in order.
+func parseTypeBitmap(buf []byte) (types []RecType, err error) {
+	for len(buf) > 0 {
+		if len(buf) < 2 || buf[1] == 0 || buf[1] > 32 || len(buf) < 2+int(buf[1]) {
+			return nil, errors.New("Malformed type bit map")
+		}
+		window, length := buf[0], int(buf[1])
+		for i, b := range buf[2 : 2+length] {
+			for bit := range 8 {
+				if b&(0x80>>bit) != 0 {
+					types = append(types, RecType(uint16(window)<<8|uint16(i*8+bit)))
+				}
+			}
+		}
+		buf = buf[2+length:]
+	}
+	return types, nil
+}
+
+// canonical returns r in the canonical wire form used for DNSSEC signatures (RFC 4034 section 6.2):
+// domain names in the RDATA are written in full and in lowercase.
+// Types newer than RFC 4034, such as SVCB, keep the case of their names (RFC 3597 section 7).
+func (r RData) canonical() ([]byte, error) {
+	names := []*Domain{&r.Target, &r.MName, &r.RName, &r.SignerName}
+	if r.Type == TypeSVCB || r.Type == TypeHTTPS {
+		names = names[1:]
+	}
+	for _, name := range names {
+		*name = Domain(strings.ToLower(name.String()))
+	}
+	return r.appendTo(nil, nil)
+}
+
+// Serialise will convert r into a single RR of a DNS message, without name compression.
 func (r RR) Serialise() (payload []byte, err error) {
-	payload = serialiseName(r.Name)
+	return r.appendTo(nil, nil)
+}
+
+// appendTo appends r to the message payload, compressing names with comp. See appendName.
+func (r RR) appendTo(payload []byte, comp compressionMap) ([]byte, error) {
+	payload = appendName(payload, r.Name, comp)
 	payload = binary.BigEndian.AppendUint16(payload, uint16(r.Type))
 	payload = binary.BigEndian.AppendUint16(payload, uint16(r.Class))
 	payload = binary.BigEndian.AppendUint32(payload, r.TTL)
-	rdata, err := r.RData.Serialise()
+	lenOffset := len(payload)
+	payload = append(payload, 0, 0) // RDLENGTH, filled in once the RDATA has been written.
+	if r.RData.Type == 0 {
+		return payload, nil // No RDATA, as in some RRs of UPDATE messages.
+	}
+	payload, err := r.RData.appendTo(payload, comp)
 	if err != nil {
-		return
+		return payload, err
 	}
-	if len(rdata) > math.MaxUint16 { // This shouldn't really happen.
-		err = errors.New("RDATA length is too big for a uint16")
-		return
+	rdLen := len(payload) - lenOffset - 2
+	if rdLen > math.MaxUint16 { // This shouldn't really happen.
+		return payload, errors.New("RDATA length is too big for a uint16")
 	}
-	payload = binary.BigEndian.AppendUint16(payload, uint16(len(rdata)))
-	payload = append(payload, rdata...)
-	return
+	binary.BigEndian.PutUint16(payload[lenOffset:], uint16(rdLen))
+	return payload, nil
 }
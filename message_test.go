@@ -0,0 +1,223 @@
+package dns
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func testQuery(name Domain, t RecType) DNSMsg {
+	return DNSMsg{
+		Header:   Header{ID: 0x1234, QR: qrQuery, Opcode: opcodeQuery, RD: true},
+		Question: []Question{{Name: name, Type: t, Class: QClassIN}},
+	}
+}
+
+// TestEDNSRoundTrip ensures an OPT record survives serialisation and parsing.
+func TestEDNSRoundTrip(t *testing.T) {
+	msg := testQuery("www.example.com", TypeA)
+	msg.EDNS = &EDNS{
+		UDPSize: 4096,
+		DO:      true,
+		Options: []EDNSOption{{Code: 10, Data: []byte("cookie00")}},
+	}
+	payload, err := msg.Serialise()
+	if err != nil {
+		t.Fatalf("Could not serialise message: %v", err)
+	}
+
+	parsed, err := ParseDNSMsg(payload)
+	if err != nil {
+		t.Fatalf("Could not parse message: %v", err)
+	}
+	if parsed.EDNS == nil {
+		t.Fatalf("Parsed message has no OPT record")
+	}
+	if len(parsed.Additional) != 0 {
+		t.Errorf("OPT record was left in the additional section")
+	}
+	e := parsed.EDNS
+	if e.UDPSize != 4096 || !e.DO || e.Version != 0 {
+		t.Errorf("Wrong OPT fields parsed: %+v", e)
+	}
+	if len(e.Options) != 1 || e.Options[0].Code != 10 || string(e.Options[0].Data) != "cookie00" {
+		t.Errorf("Wrong OPT options parsed: %+v", e.Options)
+	}
+}
+
+// TestEDNSBadVers ensures that queries with an unknown EDNS version get a BADVERS reply.
+func TestEDNSBadVers(t *testing.T) {
+	msg := testQuery("www.example.com", TypeA)
+	msg.EDNS = &EDNS{UDPSize: 1232, Version: 1}
+
+	reply := testRespond(t, NewServer(testZoneTrie(t), Config{}), msg)
+	if reply.EDNS == nil {
+		t.Fatalf("Reply has no OPT record")
+	}
+	rcode := uint16(reply.EDNS.ExtRcode)<<4 | uint16(reply.Header.Rcode)
+	if rcode != rcodeBadVers {
+		t.Errorf("Expected BADVERS, got RCODE %v", rcode)
+	}
+	if reply.EDNS.Version != ednsVersion {
+		t.Errorf("Reply OPT has version %v, expected %v", reply.EDNS.Version, ednsVersion)
+	}
+}
+
+// TestTruncation ensures replies are cut down to whole RRsets and flagged as truncated when they are too big.
+func TestTruncation(t *testing.T) {
+	msg := testQuery("txt.example.com", TypeTXT)
+	msg.Header.QR = qrReply
+	txt := RData{Type: TypeTXT, TXT: NewTXTData(string(make([]byte, 200)))}
+	for range 5 {
+		msg.Answer = append(msg.Answer, txt.RR("txt.example.com"))
+	}
+	glue := RData{Type: TypeA, Addr: netip.MustParseAddr("192.0.2.1")}
+	msg.Additional = append(msg.Additional, glue.RR("ns.example.com"))
+
+	full, err := msg.Serialise()
+	if err != nil {
+		t.Fatalf("Could not serialise message: %v", err)
+	}
+	if header, _ := parseHeader([12]byte(full)); header.TC || header.ANCount != 5 || header.ARCount != 1 {
+		t.Errorf("Unlimited message should not be truncated: %+v", header)
+	}
+
+	payload, err := msg.SerialiseLimit(512)
+	if err != nil {
+		t.Fatalf("Could not serialise message: %v", err)
+	}
+	if len(payload) > 512 {
+		t.Errorf("Truncated message is %v bytes, larger than the limit", len(payload))
+	}
+	header, _ := parseHeader([12]byte(payload))
+	if !header.TC {
+		t.Errorf("TC bit not set on truncated message")
+	}
+	if header.ANCount != 0 || header.ARCount != 0 {
+		t.Errorf("Expected the whole answer RRset to be dropped, got %+v", header)
+	}
+
+	// Dropping only additional data shouldn't set TC.
+	payload, err = msg.SerialiseLimit(len(full) - 1)
+	if err != nil {
+		t.Fatalf("Could not serialise message: %v", err)
+	}
+	header, _ = parseHeader([12]byte(payload))
+	if header.TC || header.ANCount != 5 || header.ARCount != 0 {
+		t.Errorf("Expected only the additional section to be dropped, got %+v", header)
+	}
+}
+
+// TestNameCompression ensures names are compressed when serialising and decompressed again when parsing.
+func TestNameCompression(t *testing.T) {
+	msg := testQuery("example.com", TypeMX)
+	mx := RData{Type: TypeMX, Pref: 10, Target: "mail.example.com."}
+	a := RData{Type: TypeA, Addr: netip.MustParseAddr("192.0.2.1")}
+	msg.Answer = []RR{mx.RR("example.com"), mx.RR("EXAMPLE.com")}
+	msg.Additional = []RR{a.RR("mail.example.com")}
+
+	payload, err := msg.Serialise()
+	if err != nil {
+		t.Fatalf("Could not serialise message: %v", err)
+	}
+	var uncompressed int
+	for _, rr := range append(msg.Answer, msg.Additional...) {
+		bin, _ := rr.Serialise()
+		uncompressed += len(bin)
+	}
+	uncompressed += 12 + len(msg.Question[0].Serialise())
+	if len(payload) >= uncompressed {
+		t.Errorf("Message is not compressed: %v bytes, uncompressed %v bytes", len(payload), uncompressed)
+	}
+
+	parsed, err := ParseDNSMsg(payload)
+	if err != nil {
+		t.Fatalf("Could not parse message: %v", err)
+	}
+	if len(parsed.Answer) != 2 || len(parsed.Additional) != 1 {
+		t.Fatalf("Wrong number of records parsed: %+v", parsed)
+	}
+	for _, rr := range parsed.Answer {
+		if rr.Name != "example.com" || rr.RData.Target != "mail.example.com." || rr.RData.Pref != 10 {
+			t.Errorf("MX record wasn't decompressed properly: %+v", rr)
+		}
+	}
+	if rr := parsed.Additional[0]; rr.Name != "mail.example.com" || rr.RData.Addr != a.Addr {
+		t.Errorf("A record wasn't decompressed properly: %+v", rr)
+	}
+}
+
+// TestParseNameBadPointers ensures compression pointer loops and forward pointers are rejected.
+func TestParseNameBadPointers(t *testing.T) {
+	tests := map[string][]byte{
+		"self":    {3, 'w', 'w', 'w', 0xC0, 4},
+		"loop":    {3, 'w', 'w', 'w', 0xC0, 0},
+		"forward": {0xC0, 2, 0},
+		"short":   {3, 'w', 'w'},
+	}
+	for name, buf := range tests {
+		if d, _, err := parseName(buf, 0); err == nil {
+			t.Errorf("%v: expected an error, parsed %q", name, d)
+		}
+	}
+	// Each pointer points at the other, and the first one points backwards.
+	if d, _, err := parseName([]byte{0xC0, 2, 0xC0, 0}, 2); err == nil {
+		t.Errorf("two-pointer loop: expected an error, parsed %q", d)
+	}
+}
+
+// TestParseNamePointers ensures names are followed through chains of compression pointers, including into the
+// question.
+func TestParseNamePointers(t *testing.T) {
+	buf := []byte{
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, // example.com at 0
+		3, 'w', 'w', 'w', 0xC0, 0, // www.example.com at 13
+		4, 'm', 'a', 'i', 'l', 0xC0, 13, // mail.www.example.com at 19
+	}
+	tests := []struct {
+		offset, next uint
+		want         Domain
+	}{{0, 13, "example.com"}, {13, 19, "www.example.com"}, {19, 26, "mail.www.example.com"}}
+	for _, test := range tests {
+		d, next, err := parseName(buf, test.offset)
+		if err != nil || d != test.want || next != test.next {
+			t.Errorf("Expected %q followed by offset %v, parsed %q, %v, %v", test.want, test.next, d, next, err)
+		}
+	}
+
+	// The answer's owner is a pointer to the question's name, at offset 12.
+	msg := testQuery("www.example.com", TypeA)
+	payload, err := msg.Serialise()
+	if err != nil {
+		t.Fatalf("Could not serialise message: %v", err)
+	}
+	payload[7] = 1 // ANCount
+	payload = append(payload, 0xC0, 12, 0, byte(TypeA), 0, 1, 0, 0, 1, 0x2C, 0, 4, 192, 0, 2, 1)
+	parsed, err := ParseDNSMsg(payload)
+	if err != nil {
+		t.Fatalf("Could not parse message: %v", err)
+	}
+	if len(parsed.Answer) != 1 || parsed.Answer[0].Name != "www.example.com" ||
+		parsed.Answer[0].RData.Addr != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("Expected an A record for www.example.com, parsed %+v", parsed.Answer)
+	}
+}
+
+// TestParseNameLength ensures names of up to 255 octets on the wire, counting the root label, are parsed, and longer
+// ones are rejected (RFC 1035 section 3.1).
+func TestParseNameLength(t *testing.T) {
+	for _, test := range []struct {
+		last int // Length of the last label, after three of 63 octets.
+		ok   bool
+	}{{61, true}, {62, false}} {
+		var buf []byte
+		for _, length := range []int{63, 63, 63, test.last} {
+			buf = append(buf, byte(length))
+			buf = append(buf, bytes.Repeat([]byte{'a'}, length)...)
+		}
+		buf = append(buf, 0)
+		if _, _, err := parseName(buf, 0); (err == nil) != test.ok {
+			t.Errorf("Name of %v octets: expected ok to be %v, got %v", len(buf), test.ok, err)
+		}
+	}
+}
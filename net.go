@@ -1,52 +1,182 @@
-package main
+package dns
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// tcpMaxPipelined is the maximum number of queries from one TCP connection that are answered concurrently.
+// Further queries are not read from the connection until an earlier one has been answered.
+const tcpMaxPipelined = 16
+
 type SocketList []net.UDPAddr
 
-// Serve DNS on the given socket until program termination.
-func Serve(sock net.UDPAddr, zones Trie[Zone], ctx context.Context) error {
+// Config holds the settings given on the command line.
+type Config struct {
+	Sockets        SocketList
+	ZonePath       string
+	KeyFile        string        // File of TSIG keys, "" for none.
+	TCPIdleTimeout time.Duration // How long an idle TCP connection is kept open.
+	TCPMaxConns    int           // Maximum number of concurrent TCP connections.
+	// MinimalResponses disables adding the addresses of MX, NS, etc. targets to the additional section.
+	MinimalResponses bool
+	// AliasResolver is the recursive resolver ALIAS targets outside our zones are looked up with. If it isn't
+	// valid, ALIAS records can only point into our zones.
+	AliasResolver netip.AddrPort
+}
+
+// Server holds the zones being served and the settings shared by all listeners.
+type Server struct {
+	Config
+	zones       atomic.Pointer[Trie[Zone]] // Replaced whole when zones change, never modified in place.
+	zonesMu     sync.Mutex                 // Serialises changes to the zones.
+	secondaries map[string]*secondary      // Refresh state of secondary zones, by lowercase name. Guarded by zonesMu.
+	refreshNow  chan struct{}              // Wakes RunSecondaries up to refresh notified zones.
+	tcpSlots    chan struct{}              // One element per open TCP connection, to enforce TCPMaxConns.
+	Keys        map[Domain]*TSIGKey        // TSIG keys by name. Set before serving, and never changed after.
+	signatures  sigCache                   // DNSSEC signatures of the RRsets we've served.
+	aliases     aliasCache                 // Addresses of the ALIAS targets AliasResolver was asked for.
+}
+
+func NewServer(zones *Trie[Zone], cfg Config) *Server {
+	s := &Server{
+		Config:      cfg,
+		secondaries: make(map[string]*secondary),
+		refreshNow:  make(chan struct{}, 1),
+		tcpSlots:    make(chan struct{}, cfg.TCPMaxConns),
+	}
+	s.zones.Store(zones)
+	return s
+}
+
+// Zones returns the zones currently being served. A query should only call Zones once, to get a consistent view
+// of the zones even if they are reloaded while it's answered.
+func (s *Server) Zones() *Trie[Zone] {
+	return s.zones.Load()
+}
+
+// LoadZones will (re)load the zone files in ZonePath, and start serving them in place of the current zones.
+// The changes to zones already being served are recorded in their journals, for IXFR, and their secondaries
+// are notified.
+// Secondary zones keep the records transferred from their primary, or are loaded from their local copy.
+// If an error is returned, the current zones are kept.
+func (s *Server) LoadZones() error {
+	s.zonesMu.Lock()
+	defer s.zonesMu.Unlock()
+
+	zones, err := LoadZoneFiles(s.ZonePath)
+	if err != nil {
+		return err
+	}
+	for name, zone := range zones {
+		if zone.TSIGKey == "" {
+			continue
+		}
+		if _, err := s.key(zone.TSIGKey); err != nil {
+			errStr := fmt.Sprintf("Zone %v: %v", name, err)
+			return errors.New(errStr)
+		}
+	}
+	current := s.Zones()
+	secondaries := make(map[string]bool)
+	var changed []Zone
+	prevZones := make(map[Domain]*Zone)
+	for name, zone := range zones {
+		prev, ok := findZone(current, name)
+		if !ok || !strings.EqualFold(prev.Name.String(), name.String()) {
+			prev = nil
+		}
+		prevZones[name] = prev
+		if zone.Secondary() {
+			s.loadSecondary(prev, &zone)
+			secondaries[strings.ToLower(name.String())] = true
+			zones[name] = zone
+		}
+	}
+	// The journals of reverse zones record their PTR records made from forward zones too.
+	generatePTRs(zones, current)
+	for name, zone := range zones {
+		prev := prevZones[name]
+		if err := updateJournal(prev, &zone); err != nil {
+			errStr := fmt.Sprintf("Could not update journal of zone %v: %v", name, err)
+			return errors.New(errStr)
+		}
+		if prev != nil && !zone.Secondary() && !equalSOA(prev, &zone) {
+			changed = append(changed, zone)
+		}
+	}
+	for name := range s.secondaries {
+		if !secondaries[name] {
+			delete(s.secondaries, name)
+		}
+	}
+
+	trie := NewZoneTrie(zones)
+	s.zones.Store(&trie)
+	log.Infof("Loaded %v zones from %v", len(zones), s.ZonePath)
+	for _, zone := range changed {
+		s.notifySecondaries(&zone)
+	}
+	return nil
+}
+
+// ServeUDP serves DNS on the given UDP socket until program termination.
+func (s *Server) ServeUDP(sock net.UDPAddr, ctx context.Context) error {
 	conn, err := net.ListenUDP("udp", &sock)
 	if err != nil {
 		log.Errorf("Could not serve on socket %v: %v", sock, err)
 		return err
 	}
-	defer conn.Close()
 	log.Infof("Serving DNS on %v:%v", sock.IP, sock.Port)
+	return s.serveUDP(conn, ctx)
+}
 
+// serveUDP answers queries received on conn until ctx is cancelled.
+func (s *Server) serveUDP(conn *net.UDPConn, ctx context.Context) error {
+	defer conn.Close()
 	go func() {
 		<-ctx.Done()
 		conn.SetReadDeadline(time.Now())
 	}()
 
+	buf := make([]byte, math.MaxUint16)
 	for {
-		buf := make([]byte, 512)
 		n, raddr, err := conn.ReadFromUDP(buf)
 		if err := ctx.Err(); err != nil { // TODO add a timeout context to ReadFromUDP?
-			log.Errorf("Shutting down listener for socket %v: %v", sock, err)
+			log.Errorf("Shutting down listener for socket %v: %v", conn.LocalAddr(), err)
 			return err
 		}
 		if err != nil {
 			log.Errorf("Could not read UDP request: %v", err)
 			continue
 		}
+		query := bytes.Clone(buf[:n])
 		timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
-		defer cancel()
-		go Handle(conn, raddr, buf[:n], &zones, timeoutCtx)
+		go func() {
+			defer cancel()
+			s.HandleUDP(conn, raddr, query, timeoutCtx)
+		}()
 	}
 }
 
-// Handle will handle a connection.
-func Handle(conn *net.UDPConn, raddr *net.UDPAddr, query []byte, zones *Trie[Zone], ctx context.Context) {
+// HandleUDP will handle a single UDP request.
+func (s *Server) HandleUDP(conn *net.UDPConn, raddr *net.UDPAddr, query []byte, ctx context.Context) {
 	logHead := fmt.Sprintf("[%v]", raddr)
-	response := Respond(query, zones, logHead)
+	response := s.Respond(query, Client{Addr: raddr.AddrPort()}, logHead)
 	_, err := conn.WriteToUDP(response, raddr)
 	if err := ctx.Err(); err != nil {
 		log.Errorf("Stopped writing to UDP socket due to context: %v", err)
@@ -56,6 +186,139 @@ func Handle(conn *net.UDPConn, raddr *net.UDPAddr, query []byte, zones *Trie[Zon
 	}
 }
 
+// ServeTCP serves DNS over TCP (RFC 7766) on the given socket until program termination.
+func (s *Server) ServeTCP(sock net.TCPAddr, ctx context.Context) error {
+	ln, err := net.ListenTCP("tcp", &sock)
+	if err != nil {
+		log.Errorf("Could not serve on TCP socket %v: %v", sock, err)
+		return err
+	}
+	log.Infof("Serving DNS over TCP on %v:%v", sock.IP, sock.Port)
+	return s.serveTCP(ln, ctx)
+}
+
+// serveTCP accepts and handles connections from ln until ctx is cancelled.
+func (s *Server) serveTCP(ln *net.TCPListener, ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := ln.AcceptTCP()
+		if err := ctx.Err(); err != nil {
+			log.Errorf("Shutting down TCP listener for socket %v: %v", ln.Addr(), err)
+			return err
+		}
+		if err != nil {
+			log.Errorf("Could not accept TCP connection: %v", err)
+			time.Sleep(100 * time.Millisecond) // Don't spin on persistent errors, e.g. running out of file descriptors.
+			continue
+		}
+
+		select {
+		case s.tcpSlots <- struct{}{}:
+		default:
+			log.Warnf("[%v] Closing TCP connection: too many open connections", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-s.tcpSlots }()
+			s.HandleTCP(conn, ctx)
+		}()
+	}
+}
+
+// HandleTCP will handle a TCP connection until the client closes it, it has been idle for too long,
+// or ctx is cancelled. Pipelined queries are answered concurrently, so replies may be out of order.
+func (s *Server) HandleTCP(conn *net.TCPConn, ctx context.Context) {
+	defer conn.Close()
+	logHead := fmt.Sprintf("[%v tcp]", conn.RemoteAddr())
+	client := Client{Addr: conn.RemoteAddr().(*net.TCPAddr).AddrPort(), TCP: true}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	inFlight := make(chan struct{}, tcpMaxPipelined)
+
+	reader := bufio.NewReader(conn)
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(s.TCPIdleTimeout))
+		query, err := readTCPMsg(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Debugf("%v Closing TCP connection: %v", logHead, err)
+			}
+			return
+		}
+
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			err := s.RespondStream(query, client, logHead, func(response []byte) error {
+				writeMu.Lock()
+				defer writeMu.Unlock()
+				conn.SetWriteDeadline(time.Now().Add(s.TCPIdleTimeout))
+				return writeTCPMsg(conn, response)
+			})
+			if err != nil {
+				log.Errorf("%v Can't write to TCP connection: %v", logHead, err)
+			}
+		}()
+	}
+}
+
+// readTCPMsg reads a single DNS message, prefixed with its two-byte length, from r.
+func readTCPMsg(r io.Reader) ([]byte, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint16(lenBuf[:])
+	if length < 12 {
+		errStr := fmt.Sprintf("TCP message length %v is too small for a DNS header", length)
+		return nil, errors.New(errStr)
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// writeTCPMsg writes msg to w, prefixed with its two-byte length.
+func writeTCPMsg(w io.Writer, msg []byte) error {
+	if len(msg) > math.MaxUint16 {
+		return errors.New("DNS message is too large for TCP")
+	}
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, len(msg)+2), uint16(len(msg)))
+	buf = append(buf, msg...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// TCPAddr returns the TCP equivalent of the UDP socket address.
+func TCPAddr(sock net.UDPAddr) net.TCPAddr {
+	return net.TCPAddr{IP: sock.IP, Port: sock.Port, Zone: sock.Zone}
+}
+
 func (h *SocketList) Set(s string) error {
 	addr, err := net.ResolveUDPAddr("udp", s)
 	if err != nil {
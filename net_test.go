@@ -0,0 +1,236 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testServeTCP serves DNS with server over TCP on a local port until the test ends, returning its address.
+func testServeTCP(t *testing.T, server *Server) string {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.serveTCP(ln, ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ln.Addr().String()
+}
+
+// testTCPServer serves the zone example.com over TCP until the test ends, returning its address. www has an A
+// record, and big has many, for large replies.
+func testTCPServer(t *testing.T, cfg Config) string {
+	zone := NewZone()
+	zone.Name = "example.com."
+	zone.TTL = 300
+	zone.Insert(RData{Name: "www", Type: TypeA, Addr: netip.MustParseAddr("192.0.2.1")})
+	for i := range 200 {
+		zone.Insert(RData{Name: "big", Type: TypeA, Addr: netip.AddrFrom4([4]byte{198, 51, 100, byte(i)})})
+	}
+	trie := NewZoneTrie(map[Domain]Zone{zone.Name: zone})
+	return testServeTCP(t, NewServer(&trie, cfg))
+}
+
+// testDialTCP connects to the TCP server at addr, closing the connection when the test ends.
+func testDialTCP(t *testing.T, addr string) *net.TCPConn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*net.TCPConn)
+}
+
+// testTCPQuery returns a query for name and type A with the given ID, prefixed with its length.
+func testTCPQuery(t *testing.T, id uint16, name Domain) []byte {
+	query := DNSMsg{
+		Header:   Header{ID: id, QR: qrQuery, Opcode: opcodeQuery, QDCount: 1},
+		Question: []Question{{Name: name, Type: TypeA, Class: QClassIN}},
+	}
+	payload, err := query.Serialise()
+	if err != nil {
+		t.Fatalf("Could not serialise query: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := writeTCPMsg(&buf, payload); err != nil {
+		t.Fatalf("Could not frame query: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// testReadTCPReply reads a reply from conn, failing the test if there's none within a few seconds.
+func testReadTCPReply(t *testing.T, conn *net.TCPConn) DNSMsg {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	payload, err := readTCPMsg(conn)
+	if err != nil {
+		t.Fatalf("Could not read reply: %v", err)
+	}
+	reply, err := ParseDNSMsg(payload)
+	if err != nil {
+		t.Fatalf("Could not parse reply: %v", err)
+	}
+	return reply
+}
+
+// testExpectClosed fails the test unless the server closes conn within a few seconds, without replying.
+func testExpectClosed(t *testing.T, conn *net.TCPConn, desc string) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected the server to close the connection %v, got %v bytes and %v", desc, n, err)
+	}
+}
+
+// TestTCPFraming ensures messages over TCP are prefixed with their two-byte length (RFC 1035 section 4.2.2), and
+// that lengths too small for a DNS header are refused.
+func TestTCPFraming(t *testing.T) {
+	for _, msg := range [][]byte{make([]byte, 12), make([]byte, 512), make([]byte, 65535)} {
+		var buf bytes.Buffer
+		if err := writeTCPMsg(&buf, msg); err != nil {
+			t.Fatalf("Could not write message of %v bytes: %v", len(msg), err)
+		}
+		if length := buf.Bytes()[:2]; int(length[0])<<8|int(length[1]) != len(msg) || buf.Len() != len(msg)+2 {
+			t.Errorf("Expected a message of %v bytes to be prefixed with its length, got prefix %v and %v bytes",
+				len(msg), length, buf.Len())
+		}
+		read, err := readTCPMsg(&buf)
+		if err != nil || !bytes.Equal(read, msg) {
+			t.Errorf("Expected to read back the message of %v bytes, got %v bytes and %v", len(msg), len(read), err)
+		}
+	}
+	if err := writeTCPMsg(io.Discard, make([]byte, 65536)); err == nil {
+		t.Errorf("Expected a message too large for its length to fit in two bytes not to be written")
+	}
+	if _, err := readTCPMsg(bytes.NewReader([]byte{0, 11, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})); err == nil {
+		t.Errorf("Expected a message shorter than a DNS header not to be read")
+	}
+	if _, err := readTCPMsg(bytes.NewReader([]byte{0, 12, 0, 0})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected a truncated message to give io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	addr := testTCPServer(t, Config{TCPIdleTimeout: 5 * time.Second, TCPMaxConns: 4})
+	conn := testDialTCP(t, addr)
+	// The query is sent a byte at a time, so the server has to put it together from its length.
+	for _, b := range testTCPQuery(t, 1, "www.example.com") {
+		if _, err := conn.Write([]byte{b}); err != nil {
+			t.Fatalf("Could not send query: %v", err)
+		}
+	}
+	if reply := testReadTCPReply(t, conn); reply.Header.ID != 1 || len(reply.Answer) != 1 {
+		t.Errorf("Expected an answer to the query, got %+v", reply)
+	}
+
+	conn = testDialTCP(t, addr)
+	if _, err := conn.Write([]byte{0, 11}); err != nil {
+		t.Fatalf("Could not send length: %v", err)
+	}
+	testExpectClosed(t, conn, "after a length under 12 bytes")
+}
+
+// TestTCPPipelining ensures queries pipelined on one connection are all answered, and that the server stops
+// reading queries while tcpMaxPipelined of them are waiting for their replies to be sent.
+func TestTCPPipelining(t *testing.T) {
+	addr := testTCPServer(t, Config{TCPIdleTimeout: 5 * time.Second, TCPMaxConns: 4})
+	conn := testDialTCP(t, addr)
+	var queries []byte
+	for i := range 3 * tcpMaxPipelined {
+		queries = append(queries, testTCPQuery(t, uint16(i), "www.example.com")...)
+	}
+	if _, err := conn.Write(queries); err != nil {
+		t.Fatalf("Could not send queries: %v", err)
+	}
+	seen := make(map[uint16]bool)
+	for range 3 * tcpMaxPipelined {
+		reply := testReadTCPReply(t, conn)
+		if len(reply.Answer) != 1 || seen[reply.Header.ID] {
+			t.Errorf("Expected one answer to each query, got %+v", reply)
+		}
+		seen[reply.Header.ID] = true
+	}
+
+	// The replies aren't read, so once the socket buffers are full the server can't send them. Once tcpMaxPipelined
+	// queries are waiting to be answered the server stops reading, and so in turn the queries can't be sent.
+	goroutines := runtime.NumGoroutine()
+	conn = testDialTCP(t, addr)
+	batch := bytes.Repeat(testTCPQuery(t, 1, "big.example.com"), 1000)
+	for sent := 0; ; sent += len(batch) {
+		if sent > 16<<20 {
+			t.Fatalf("Expected the server to stop reading queries, but %v bytes of them were sent", sent)
+		}
+		conn.SetWriteDeadline(time.Now().Add(250 * time.Millisecond))
+		if _, err := conn.Write(batch); errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		} else if err != nil {
+			t.Fatalf("Could not send queries: %v", err)
+		}
+	}
+	// The connection has a goroutine reading queries, and one for each query being answered.
+	if n := runtime.NumGoroutine() - goroutines; n > 1+tcpMaxPipelined {
+		t.Errorf("Expected at most %v queries to be answered at once, got %v goroutines", tcpMaxPipelined, n)
+	}
+	// Once the replies are read, the server carries on.
+	for range 100 {
+		if reply := testReadTCPReply(t, conn); len(reply.Answer) != 200 {
+			t.Fatalf("Expected 200 answers, got %v", len(reply.Answer))
+		}
+	}
+}
+
+// TestTCPMaxConns ensures connections beyond TCPMaxConns are closed straight away, and accepted again once an
+// open connection is closed.
+func TestTCPMaxConns(t *testing.T) {
+	addr := testTCPServer(t, Config{TCPIdleTimeout: 5 * time.Second, TCPMaxConns: 2})
+	var conns []*net.TCPConn
+	for i := range 2 {
+		conn := testDialTCP(t, addr)
+		conn.Write(testTCPQuery(t, uint16(i), "www.example.com"))
+		testReadTCPReply(t, conn) // The connection has a slot once it's answered.
+		conns = append(conns, conn)
+	}
+	testExpectClosed(t, testDialTCP(t, addr), "beyond TCPMaxConns")
+
+	conns[0].Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn := testDialTCP(t, addr)
+		conn.Write(testTCPQuery(t, 3, "www.example.com"))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := readTCPMsg(conn); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a connection to be accepted once another was closed")
+		}
+	}
+}
+
+// TestTCPIdleTimeout ensures connections are closed once they've been idle for TCPIdleTimeout, and kept open
+// while they're in use.
+func TestTCPIdleTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	addr := testTCPServer(t, Config{TCPIdleTimeout: timeout, TCPMaxConns: 4})
+	conn := testDialTCP(t, addr)
+	for i := range 4 {
+		time.Sleep(timeout / 2)
+		conn.Write(testTCPQuery(t, uint16(i), "www.example.com"))
+		testReadTCPReply(t, conn)
+	}
+	start := time.Now()
+	testExpectClosed(t, conn, "once idle")
+	if idle := time.Since(start); idle < timeout/2 {
+		t.Errorf("Expected the connection to be closed after %v idle, it was closed after %v", timeout, idle)
+	}
+}
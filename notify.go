@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// notifyAttempts is how many times a NOTIFY is sent to a secondary before giving up on it acknowledging.
+	notifyAttempts = 5
+	// notifyTimeout is how long to wait for the first NOTIFY to be acknowledged. It doubles with every retry.
+	notifyTimeout = 2 * time.Second
+)
+
+// HandleNotify answers a NOTIFY message (RFC 1996) telling us a secondary zone has changed on its primary,
+// and refreshes the zone as soon as possible. Only the primary of the zone, and clients in the zone's
+// allow-notify ACL, may notify us. If the zone has a TSIG key, the primary is only known by signing with it.
+func (s *Server) HandleNotify(query DNSMsg, client Client, logHead string) []byte {
+	if len(query.Question) != 1 || query.Question[0].Type != TypeSOA {
+		log.Infof("%v [FORMERR] NOTIFY without a single SOA question", logHead)
+		return errReply(query, rcodeFormErr, logHead)
+	}
+	q := query.Question[0]
+	zone, ok := findZone(s.Zones(), q.Name)
+	if !ok || queryStr(zone, q.Name) != "" || !zone.Secondary() {
+		log.Infof("%v [REFUSED] NOTIFY for a name which isn't one of our secondary zones", logHead)
+		return errReply(query, rcodeRefused, logHead)
+	}
+	fromPrimary := client.Addr.Addr().Unmap() == zone.Primary.Addr().Unmap()
+	if zone.TSIGKey != "" {
+		fromPrimary = client.Key != nil && client.Key.Name == zone.TSIGKey
+	}
+	if !fromPrimary && !zone.AllowNotify.Allows(client) {
+		log.Warnf("%v [REFUSED] Client may not notify zone %v", logHead, zone.Name)
+		return errReply(query, rcodeRefused, logHead)
+	}
+
+	s.zonesMu.Lock()
+	if state, ok := s.secondaries[strings.ToLower(zone.Name.String())]; ok {
+		if state.refreshing {
+			state.notified = true // Refresh again once the current refresh is done, it may have missed the change.
+		} else {
+			state.refreshAt = time.Now()
+		}
+	}
+	s.zonesMu.Unlock()
+	select {
+	case s.refreshNow <- struct{}{}:
+	default: // A refresh check is already pending.
+	}
+
+	log.Infof("%v Zone %v was changed on its primary, refreshing", logHead, zone.Name)
+	reply := NewDNSMsg(query)
+	payload, err := reply.Serialise()
+	if err != nil {
+		log.Errorf("%v Could not serialise NOTIFY reply: %v", logHead, err)
+		return errReply(query, rcodeServFail, logHead)
+	}
+	return payload
+}
+
+// notifySecondaries will send NOTIFY messages for zone, which has just changed, to every server in the zone's
+// notify list. Each is sent in the background, and retried until the server acknowledges it.
+// The messages are signed with the zone's TSIG key, if it has one.
+func (s *Server) notifySecondaries(zone *Zone) {
+	soa, ok := zone.SOA()
+	if !ok || len(zone.Notify) == 0 {
+		return
+	}
+	var key *TSIGKey
+	if zone.TSIGKey != "" {
+		var err error
+		if key, err = s.key(zone.TSIGKey); err != nil {
+			log.Errorf("[%v notify] Not sending NOTIFY: %v", zone.Name, err)
+			return
+		}
+	}
+	msg := DNSMsg{
+		Header:   Header{QR: qrQuery, Opcode: opcodeNotify, AA: true},
+		Question: []Question{{Name: zone.Name, Type: TypeSOA, Class: QClassIN}},
+		Answer:   []RR{zone.RR(soa, zone.Name)},
+	}
+	for _, target := range zone.Notify {
+		msg := msg
+		msg.Header.ID = uint16(rand.Uint32())
+		go func() {
+			logHead := fmt.Sprintf("[%v notify %v]", zone.Name, target)
+			if err := sendNotify(msg, target, key); err != nil {
+				log.Errorf("%v Secondary didn't acknowledge NOTIFY: %v", logHead, err)
+				return
+			}
+			log.Debugf("%v Secondary acknowledged NOTIFY for serial %v", logHead, soa.Serial)
+		}()
+	}
+}
+
+// sendNotify will send the NOTIFY message msg to target over UDP until it's acknowledged, up to notifyAttempts
+// times, backing off between attempts. If key isn't nil, the message is signed with it, and so must the
+// acknowledgement be.
+func sendNotify(msg DNSMsg, target netip.AddrPort, key *TSIGKey) error {
+	payload, err := msg.Serialise()
+	if err != nil {
+		return err
+	}
+	var verifier *tsigVerifier
+	if key != nil {
+		payload, verifier = signRequest(payload, key)
+	}
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(target))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, ednsMinSize)
+	timeout := notifyTimeout
+	for range notifyAttempts {
+		if _, err = conn.Write(payload); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(timeout)
+		conn.SetReadDeadline(deadline)
+		timeout *= 2
+		for time.Now().Before(deadline) {
+			var n int
+			n, err = conn.Read(buf)
+			if err != nil {
+				// Timed out, or an ICMP error such as port unreachable. Try again after the timeout either way.
+				time.Sleep(time.Until(deadline))
+				break
+			}
+			reply, err := ParseDNSMsg(buf[:n])
+			if err != nil || reply.Header.ID != msg.Header.ID || reply.Header.QR != qrReply ||
+				reply.Header.Opcode != opcodeNotify {
+				continue // Not a reply to our NOTIFY.
+			}
+			if verifier != nil {
+				check := *verifier // The same request is sent every attempt, so each reply is checked afresh.
+				if err := check.verify(buf[:n], reply); err != nil {
+					return err
+				}
+			}
+			if reply.Header.Rcode != rcodeNoError {
+				errStr := fmt.Sprintf("Secondary replied with rcode %v", reply.Header.Rcode)
+				return errors.New(errStr)
+			}
+			return nil
+		}
+	}
+	errStr := fmt.Sprintf("No reply after %v attempts, last error: %v", notifyAttempts, err)
+	return errors.New(errStr)
+}
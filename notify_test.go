@@ -0,0 +1,56 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestNotify ensures a primary notifies its secondaries when a zone changes, and that they refresh the zone
+// straight away.
+func TestNotify(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	notify := fmt.Sprintf("notify %v\n", conn.LocalAddr())
+
+	primaryDir, secondaryDir := t.TempDir(), t.TempDir()
+	testZoneFile(t, primaryDir, 1, notify+"a A 192.0.2.1")
+	primary, addr := testPrimary(t, primaryDir)
+	secondary := testSecondary(t, secondaryDir, addr)
+	if err := secondary.RefreshZone("example.com."); err != nil {
+		t.Fatalf("Could not transfer zone: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go secondary.serveUDP(conn, ctx)
+	go secondary.RunSecondaries(ctx)
+
+	testZoneFile(t, primaryDir, 2, notify+"a A 192.0.2.2")
+	if err := primary.LoadZones(); err != nil {
+		t.Fatalf("Could not reload primary zones: %v", err)
+	}
+	// The zone refresh is well before the SOA refresh interval, so it can only be due to the NOTIFY.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, addr := testLookup(t, secondary, "a.example.com"); addr == "192.0.2.2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Secondary didn't refresh the zone after being notified")
+		}
+	}
+
+	query := testQuery("example.com", TypeSOA)
+	query.Header.Opcode = opcodeNotify
+	if reply := testRespond(t, secondary, query); reply.Header.Rcode != rcodeRefused {
+		t.Errorf("Expected NOTIFY from a client other than the primary to be REFUSED, got %v", reply.Header.Rcode)
+	}
+	query.Header.Opcode = opcodeStatus
+	if reply := testRespond(t, secondary, query); reply.Header.Rcode != rcodeNotImplemented {
+		t.Errorf("Expected NOTIMP for the STATUS opcode, got %v", reply.Header.Rcode)
+	}
+}
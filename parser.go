@@ -1,10 +1,17 @@
-package main
+package dns
 
 import (
+	"cmp"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/netip"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -32,15 +39,28 @@ parseLoop:
 			return zone, err
 		}
 
+		// Keywords are only directives at the start of a line, and not even there when they're the name of a record,
+		// e.g. primary A 192.0.2.1.
+		if tok.Type == TokenKeyword {
+			next, err := p.Lexer.Peek()
+			if err != nil {
+				return zone, err
+			}
+			if next.Type == TokenRecType {
+				tok.Type = TokenIdent
+			}
+		}
+
 		switch tok.Type {
-		case TokenIdent:
+		case TokenIdent, TokenInt, TokenIP: // Names in reverse zones, like 1 or 1.2.0.192, look like numbers.
 			record, err := p.parseRecord(tok, zone)
 			if err != nil {
 				return zone, err
 			}
 			err = zone.Insert(record)
 			if err != nil {
-				return zone, err
+				errStr := fmt.Sprintf("%v %v", p.Pos(), err)
+				return zone, errors.New(errStr)
 			}
 		case TokenKeyword:
 			if tok.Value == "zone" {
@@ -67,6 +87,30 @@ parseLoop:
 		}
 	}
 
+	if len(zone.DNSSECKeyFiles) > 0 {
+		for rr := range zone.All() {
+			if slices.Contains(dnssecTypes, rr.Type) {
+				errStr := fmt.Sprintf("%v %v records are made from the keys given with the dnssec-key keyword", p.Name, rr.Type)
+				return zone, errors.New(errStr)
+			}
+		}
+	}
+	if zone.Secondary() && len(zone.PTRFrom) > 0 {
+		errStr := fmt.Sprintf("%v Secondary zones can't have ptr-from, their records are transferred from the primary", p.Name)
+		return zone, errors.New(errStr)
+	}
+	if zone.presigned() && len(zone.PTRFrom) > 0 {
+		errStr := fmt.Sprintf("%v Zones signed offline can't have ptr-from, the PTR records it makes wouldn't be signed", p.Name)
+		return zone, errors.New(errStr)
+	}
+	if zone.presigned() && zone.hasALIAS() {
+		errStr := fmt.Sprintf("%v Zones signed offline can't have ALIAS records, the addresses they give wouldn't be signed", p.Name)
+		return zone, errors.New(errStr)
+	}
+	if zone.Secondary() && len(zone.Records) > 0 {
+		errStr := fmt.Sprintf("%v Secondary zones can't have records or an soa, they're transferred from the primary", p.Name)
+		return zone, errors.New(errStr)
+	}
 	return zone, nil
 }
 
@@ -78,6 +122,19 @@ func (p *Parser) parseRecord(nameToken Token, zone Zone) (RData, error) {
 
 	// Name (domain) field
 	name := RecordName(nameToken.Value)
+	if domain := Domain(nameToken.Value); domain.FQDN() {
+		// Names in the zone may be given fully qualified, as ZoneFile does for those that look like keywords.
+		fqdn, zoneName := domain.String(), zone.Name.AsFQDN().String()
+		switch {
+		case strings.EqualFold(fqdn, zoneName):
+			name = "@"
+		case len(fqdn) > len(zoneName) && strings.EqualFold(fqdn[len(fqdn)-len(zoneName)-1:], "."+zoneName):
+			name = RecordName(fqdn[:len(fqdn)-len(zoneName)-1])
+		default:
+			errStr := fmt.Sprintf("%v %v is outside the zone", p.Pos(), domain)
+			return record, errors.New(errStr)
+		}
+	}
 	if !name.Valid() {
 		errStr := fmt.Sprintf("%v %v is an invalid name", p.Pos(), name)
 		return record, errors.New(errStr)
@@ -97,6 +154,10 @@ func (p *Parser) parseRecord(nameToken Token, zone Zone) (RData, error) {
 	if err != nil {
 		return record, err
 	}
+	if record.Type == TypeSOA {
+		errStr := fmt.Sprintf("%v SOA records must be given with the soa keyword", p.Pos())
+		return record, errors.New(errStr)
+	}
 
 	// Data/target field
 	data, err := p.Lexer.Next()
@@ -108,7 +169,15 @@ func (p *Parser) parseRecord(nameToken Token, zone Zone) (RData, error) {
 		return record, errors.New(errStr)
 	}
 	// We interpret and handle the data in different ways depending on the record type.
-	switch record.Type {
+	// Any type may be given in the generic form of RFC 3597 section 5, which is read as for types we don't know.
+	var ttlTok Token
+	ttlRead := false // Whether ttlTok was already read after the data.
+	generic := data.Value == "#"
+	dataType := record.Type
+	if generic {
+		dataType = 0
+	}
+	switch dataType {
 	case TypeA, TypeAAAA:
 		if data.Type != TokenIP {
 			errStr := fmt.Sprintf("%v Expected IP address, got: %v", p.Pos(), data)
@@ -119,24 +188,83 @@ func (p *Parser) parseRecord(nameToken Token, zone Zone) (RData, error) {
 			return record, err
 		}
 		record.Addr = ip
-	case TypeCNAME, TypeMX, TypeNS:
-		target := Domain(data.Value)
-		if !target.Valid() {
-			errStr := fmt.Sprintf("%v Invalid RDATA domain: %v", p.Pos(), target)
-			return record, errors.New(errStr)
+	case TypeMX:
+		// The preference is optional, and defaults to 0.
+		if data.Type == TokenInt {
+			pref, err := strconv.ParseUint(data.Value, 10, 16)
+			if err != nil {
+				errStr := fmt.Sprintf("%v Invalid MX preference: %v", p.Pos(), err)
+				return record, errors.New(errStr)
+			}
+			record.Pref = uint16(pref)
+			if data, err = p.Lexer.Next(); err != nil {
+				return record, err
+			}
+		}
+		record.Target, err = p.parseDomain(data, zone)
+		if err != nil {
+			return record, err
 		}
-		if !target.FQDN() {
-			target = target + "." + zone.Name.AsFQDN()
+	case TypeSRV:
+		// Priority, weight and port, then the target, which is "." if the service isn't available.
+		fields := []struct {
+			name  string
+			value *uint16
+		}{{"priority", &record.Pref}, {"weight", &record.Weight}, {"port", &record.Port}}
+		for _, field := range fields {
+			n, err := strconv.ParseUint(data.Value, 10, 16)
+			if data.Type != TokenInt || err != nil {
+				errStr := fmt.Sprintf("%v Invalid SRV %v: %v", p.Pos(), field.name, data.Value)
+				return record, errors.New(errStr)
+			}
+			*field.value = uint16(n)
+			if data, err = p.Lexer.Next(); err != nil {
+				return record, err
+			}
+		}
+		if data.Value == "." {
+			record.Target = "."
+		} else if record.Target, err = p.parseDomain(data, zone); err != nil {
+			return record, err
+		}
+	case TypeCNAME, TypeNS, TypePTR, TypeDNAME, TypeALIAS:
+		record.Target, err = p.parseDomain(data, zone)
+		if err != nil {
+			return record, err
 		}
-		record.Target = target
 	case TypeTXT:
 		record.TXT = NewTXTData(data.Value)
+	case TypeDNSKEY, TypeRRSIG, TypeNSEC, TypeNSEC3, TypeNSEC3PARAM, TypeDS, TypeCAA, TypeTLSA, TypeSSHFP, TypeSVCB, TypeHTTPS:
+		// NSEC, NSEC3 and SVCB records end with a list, so the token after the data is read to find its end.
+		ttlTok, err = p.parseFields(&record, data, zone)
+		if err != nil {
+			return record, err
+		}
+		ttlRead = true
+	default:
+		// Types we don't know, and data in the generic form.
+		if ttlTok, err = p.parseFields(&record, data, zone); err != nil {
+			return record, err
+		}
+		ttlRead = true
+	}
+	if generic && record.Type.Valid() {
+		// Types we know are decoded from the generic form, so they're as if given in their own format.
+		rdata, err := parseRData(record.Type, 0, record.Data, 0, uint(len(record.Data)))
+		if err != nil {
+			errStr := fmt.Sprintf("%v Invalid %v RDATA: %v", p.Pos(), record.Type, err)
+			return record, errors.New(errStr)
+		}
+		rdata.Name = record.Name
+		record = rdata
 	}
 
 	// TTL
-	ttlTok, err := p.Lexer.Next()
-	if err != nil {
-		return record, err
+	if !ttlRead {
+		ttlTok, err = p.Lexer.Next()
+		if err != nil {
+			return record, err
+		}
 	}
 
 	if ttlTok.Type == TokenNewline || ttlTok.Type == TokenEOF {
@@ -159,6 +287,343 @@ func (p *Parser) parseRecord(nameToken Token, zone Zone) (RData, error) {
 	return record, nil
 }
 
+// parseFields parses the data of a record with several fields, such as the DNSSEC records written by
+// cmd/zone-sign, or of a type we don't know, into record. first is the first token of the data. The token after the data is returned.
+// Data fields are as in the presentation format of the record type's RFC, with hex and base64 fields in a single
+// token.
+func (p *Parser) parseFields(record *RData, first Token, zone Zone) (Token, error) {
+	tok := first
+	// next returns the current token's value and reads the one after it.
+	next := func(field string) (string, error) {
+		if tok.Type == TokenNewline || tok.Type == TokenEOF {
+			errStr := fmt.Sprintf("%v Expected %v in %v record, got end of line", p.Pos(), field, record.Type)
+			return "", errors.New(errStr)
+		}
+		value := tok.Value
+		var err error
+		tok, err = p.Lexer.Next()
+		return value, err
+	}
+	// number reads an unsigned integer of the given size.
+	number := func(field string, bits int) (uint64, error) {
+		value, err := next(field)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseUint(value, 10, bits)
+		if err != nil {
+			errStr := fmt.Sprintf("%v Invalid %v in %v record: %v", p.Pos(), field, record.Type, value)
+			return 0, errors.New(errStr)
+		}
+		return n, nil
+	}
+	// decoded reads a field encoded with decode.
+	decoded := func(field string, decode func(string) ([]byte, error)) ([]byte, error) {
+		value, err := next(field)
+		if err != nil {
+			return nil, err
+		}
+		b, err := decode(value)
+		if err != nil {
+			errStr := fmt.Sprintf("%v Invalid %v in %v record: %v", p.Pos(), field, record.Type, err)
+			return nil, errors.New(errStr)
+		}
+		return b, nil
+	}
+	salt := func(s string) ([]byte, error) {
+		if s == "-" {
+			return nil, nil
+		}
+		return hex.DecodeString(s)
+	}
+	// types reads the type list ending NSEC and NSEC3 records, up to the TTL or the end of the line.
+	types := func() error {
+		for tok.Type != TokenNewline && tok.Type != TokenEOF && tok.Type != TokenInt {
+			value, err := next("type")
+			if err != nil {
+				return err
+			}
+			t, err := ParseRecType(value)
+			if n, ok := strings.CutPrefix(value, "TYPE"); err != nil && ok {
+				var code uint64
+				code, err = strconv.ParseUint(n, 10, 16)
+				t = RecType(code)
+			}
+			if err != nil {
+				errStr := fmt.Sprintf("%v Invalid type in %v record: %v", p.Pos(), record.Type, value)
+				return errors.New(errStr)
+			}
+			record.Types = append(record.Types, t)
+		}
+		return nil
+	}
+	var err error
+	var n uint64
+	dataType := record.Type
+	if first.Value == "#" {
+		dataType = 0 // Any type may be given in the generic form, see the default case.
+	}
+	switch dataType {
+	case TypeDNSKEY:
+		if n, err = number("flags", 16); err != nil {
+			return tok, err
+		}
+		record.Flags = uint16(n)
+		if n, err = number("protocol", 8); err != nil {
+			return tok, err
+		}
+		record.Protocol = byte(n)
+		if n, err = number("algorithm", 8); err != nil {
+			return tok, err
+		}
+		record.Algorithm = byte(n)
+		record.PublicKey, err = decoded("public key", base64.StdEncoding.DecodeString)
+	case TypeRRSIG:
+		var value string
+		if value, err = next("type covered"); err != nil {
+			return tok, err
+		}
+		if record.TypeCovered, err = ParseRecType(value); err != nil {
+			return tok, err
+		}
+		if n, err = number("algorithm", 8); err != nil {
+			return tok, err
+		}
+		record.Algorithm = byte(n)
+		if n, err = number("labels", 8); err != nil {
+			return tok, err
+		}
+		record.Labels = byte(n)
+		if n, err = number("original TTL", 32); err != nil {
+			return tok, err
+		}
+		record.OrigTTL = uint32(n)
+		for _, field := range []*uint32{&record.Expiration, &record.Inception} {
+			if value, err = next("signature time"); err != nil {
+				return tok, err
+			}
+			if *field, err = parseSigTime(value); err != nil {
+				errStr := fmt.Sprintf("%v Invalid signature time in RRSIG record: %v", p.Pos(), value)
+				return tok, errors.New(errStr)
+			}
+		}
+		if n, err = number("key tag", 16); err != nil {
+			return tok, err
+		}
+		record.KeyTag = uint16(n)
+		signer := tok
+		if _, err = next("signer name"); err != nil {
+			return tok, err
+		}
+		if record.SignerName, err = p.parseDomain(signer, zone); err != nil {
+			return tok, err
+		}
+		record.Signature, err = decoded("signature", base64.StdEncoding.DecodeString)
+	case TypeNSEC:
+		nextName := tok
+		if _, err = next("next name"); err != nil {
+			return tok, err
+		}
+		// The next name may be a wildcard.
+		wildcard := strings.HasPrefix(nextName.Value, "*.")
+		nextName.Value = strings.TrimPrefix(nextName.Value, "*.")
+		if record.NextName, err = p.parseDomain(nextName, zone); err != nil {
+			return tok, err
+		}
+		if wildcard {
+			record.NextName = "*." + record.NextName
+		}
+		err = types()
+	case TypeNSEC3, TypeNSEC3PARAM:
+		if n, err = number("algorithm", 8); err != nil {
+			return tok, err
+		}
+		record.Algorithm = byte(n)
+		if n, err = number("flags", 8); err != nil {
+			return tok, err
+		}
+		record.Flags = uint16(n)
+		if n, err = number("iterations", 16); err != nil {
+			return tok, err
+		}
+		record.Iterations = uint16(n)
+		if record.Salt, err = decoded("salt", salt); err != nil || record.Type == TypeNSEC3PARAM {
+			return tok, err
+		}
+		decode := func(s string) ([]byte, error) { return nsec3Encoding.DecodeString(strings.ToUpper(s)) }
+		if record.NextHashed, err = decoded("next hashed name", decode); err != nil {
+			return tok, err
+		}
+		err = types()
+	case TypeDS:
+		if n, err = number("key tag", 16); err != nil {
+			return tok, err
+		}
+		record.KeyTag = uint16(n)
+		if n, err = number("algorithm", 8); err != nil {
+			return tok, err
+		}
+		record.Algorithm = byte(n)
+		if n, err = number("digest type", 8); err != nil {
+			return tok, err
+		}
+		record.DigestType = byte(n)
+		record.Digest, err = decoded("digest", hex.DecodeString)
+	case TypeCAA:
+		if n, err = number("flags", 8); err != nil {
+			return tok, err
+		}
+		record.Flags = uint16(n)
+		if record.Tag, err = next("tag"); err != nil {
+			return tok, err
+		}
+		if !caaTagRegex.MatchString(record.Tag) {
+			errStr := fmt.Sprintf("%v Invalid CAA tag: %v", p.Pos(), record.Tag)
+			return tok, errors.New(errStr)
+		}
+		record.Value, err = next("value")
+	case TypeTLSA:
+		for _, field := range []struct {
+			name  string
+			value *byte
+		}{{"certificate usage", &record.Usage}, {"selector", &record.Selector}, {"matching type", &record.DigestType}} {
+			if n, err = number(field.name, 8); err != nil {
+				return tok, err
+			}
+			*field.value = byte(n)
+		}
+		record.Digest, err = decoded("certificate data", hex.DecodeString)
+	case TypeSSHFP:
+		if n, err = number("algorithm", 8); err != nil {
+			return tok, err
+		}
+		record.Algorithm = byte(n)
+		if n, err = number("fingerprint type", 8); err != nil {
+			return tok, err
+		}
+		record.DigestType = byte(n)
+		record.Digest, err = decoded("fingerprint", hex.DecodeString)
+	case TypeSVCB, TypeHTTPS:
+		if n, err = number("priority", 16); err != nil {
+			return tok, err
+		}
+		record.Pref = uint16(n)
+		target := tok
+		if _, err = next("target"); err != nil {
+			return tok, err
+		}
+		if target.Value == "." {
+			record.Target = "."
+		} else if record.Target, err = p.parseDomain(target, zone); err != nil {
+			return tok, err
+		}
+		for tok.Type != TokenNewline && tok.Type != TokenEOF && tok.Type != TokenInt {
+			value, err := next("SvcParam")
+			if err != nil {
+				return tok, err
+			}
+			param, err := ParseSvcParam(value)
+			if err != nil {
+				errStr := fmt.Sprintf("%v %v", p.Pos(), err)
+				return tok, errors.New(errStr)
+			}
+			record.Params = append(record.Params, param)
+		}
+		// Parameters may be given in any order, but are kept in key order.
+		slices.SortStableFunc(record.Params, func(a, b SvcParam) int { return cmp.Compare(a.Key, b.Key) })
+		if err = validateSvcParams(record.Pref, record.Params); err != nil {
+			errStr := fmt.Sprintf("%v Invalid %v record: %v", p.Pos(), record.Type, err)
+			return tok, errors.New(errStr)
+		}
+	default:
+		// \# <length> <hex>..., where the hex may be split into several words. The lexer drops the backslash.
+		var marker string
+		if marker, err = next(`\#`); err != nil {
+			return tok, err
+		}
+		if marker != "#" {
+			errStr := fmt.Sprintf(`%v %v records must be given in the generic form \# <length> <hex>, got: %v`, p.Pos(), record.Type, marker)
+			return tok, errors.New(errStr)
+		}
+		if n, err = number("RDATA length", 16); err != nil {
+			return tok, err
+		}
+		for uint64(len(record.Data)) < n {
+			var b []byte
+			if b, err = decoded("RDATA", hex.DecodeString); err != nil {
+				return tok, err
+			}
+			record.Data = append(record.Data, b...)
+		}
+		if uint64(len(record.Data)) != n {
+			errStr := fmt.Sprintf("%v %v RDATA is %v bytes long, not %v", p.Pos(), record.Type, len(record.Data), n)
+			return tok, errors.New(errStr)
+		}
+	}
+	return tok, err
+}
+
+// caaTagRegex matches valid CAA property tags: up to 15 ASCII letters and digits (RFC 8659 section 4.1).
+var caaTagRegex = regexp.MustCompile(`^[A-Za-z0-9]{1,15}$`)
+
+// parseSigTime parses an RRSIG expiration or inception time, given as YYYYMMDDHHmmSS in UTC or as seconds since
+// the epoch (RFC 4034 section 3.2).
+func parseSigTime(s string) (uint32, error) {
+	if len(s) == 14 {
+		t, err := time.Parse("20060102150405", s)
+		return uint32(t.Unix()), err
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err
+}
+
+// parseDomain parses a domain name given as record data.
+// Relative names are made absolute by appending the zone name, so the returned domain is always an FQDN.
+func (p *Parser) parseDomain(tok Token, zone Zone) (Domain, error) {
+	domain := Domain(tok.Value)
+	// Keywords are only directives at the start of a line, so they may be names here, e.g. @ NS primary.
+	if (tok.Type != TokenIdent && tok.Type != TokenKeyword) || !domain.Valid() {
+		errStr := fmt.Sprintf("%v Invalid RDATA domain: %v", p.Pos(), tok.Value)
+		return "", errors.New(errStr)
+	}
+	if !domain.FQDN() {
+		domain = domain + "." + zone.Name.AsFQDN()
+	}
+	return domain, nil
+}
+
+// parseUint32 reads an unsigned 32-bit integer, named field for error messages, from the lexer.
+func (p *Parser) parseUint32(field string) (uint32, error) {
+	tok, err := p.Lexer.Next()
+	if err != nil {
+		return 0, err
+	}
+	if tok.Type != TokenInt {
+		errStr := fmt.Sprintf("%v Expected an integer for %v, got: %v", p.Pos(), field, tok)
+		return 0, errors.New(errStr)
+	}
+	n, err := strconv.ParseUint(tok.Value, 10, 32)
+	if err != nil {
+		errStr := fmt.Sprintf("%v Invalid %v: %v", p.Pos(), field, err)
+		return 0, errors.New(errStr)
+	}
+	return uint32(n), nil
+}
+
+// expectEOL consumes the end of the current line, returning an error if there's anything else on it.
+// keyword names the line's keyword for error messages.
+func (p *Parser) expectEOL(keyword string) error {
+	nl, err := p.Lexer.Next()
+	if err != nil {
+		return err
+	}
+	if nl.Type != TokenNewline && nl.Type != TokenEOF {
+		errStr := fmt.Sprintf("%v Unexpected value after %v specification: %v", p.Pos(), keyword, nl.Value)
+		return errors.New(errStr)
+	}
+	return nil
+}
+
 // handleKeyword handles the given keyword, consuming from the lexer as required.
 // It will modify zone as required, unless an error occurs, in which case an error will be returned.
 func (p *Parser) handleKeyword(keyword Token, zone *Zone) error {
@@ -167,6 +632,26 @@ func (p *Parser) handleKeyword(keyword Token, zone *Zone) error {
 		return p.handleKWTTL(zone)
 	case "zone":
 		return p.handleKWZone(zone)
+	case "soa":
+		return p.handleKWSOA(zone)
+	case "allow-transfer":
+		return p.handleKWACL(&zone.AllowTransfer, keyword.Value)
+	case "primary":
+		return p.handleKWPrimary(zone)
+	case "notify":
+		return p.handleKWNotify(zone)
+	case "allow-notify":
+		return p.handleKWACL(&zone.AllowNotify, keyword.Value)
+	case "allow-update":
+		return p.handleKWACL(&zone.AllowUpdate, keyword.Value)
+	case "tsig-key":
+		return p.handleKWTSIGKey(zone)
+	case "dnssec-key":
+		return p.handleKWDNSSECKey(zone)
+	case "denial":
+		return p.handleKWDenial(zone)
+	case "ptr-from":
+		return p.handleKWPTRFrom(zone)
 	default:
 		errStr := fmt.Sprintf("%v Unexpected keyword token value: %v. This is probably a bug in the lexer.", p.Pos(), keyword)
 		return errors.New(errStr)
@@ -195,16 +680,12 @@ func (p *Parser) handleKWZone(zone *Zone) (err error) {
 	}
 	if !domain.FQDN() {
 		log.Warningf("%v Zone domain is not an FQDN. Will assume it is.", p.Pos())
+		domain = domain.AsFQDN()
 	}
 
-	nl, err := p.Lexer.Next()
-	if err != nil {
+	if err := p.expectEOL("zone"); err != nil {
 		return err
 	}
-	if nl.Type != TokenNewline && nl.Type != TokenEOF {
-		errStr := fmt.Sprintf("%v Unexpected value after zone specification: %v", p.Pos(), nl.Value)
-		return errors.New(errStr)
-	}
 
 	zone.Name = domain
 	return nil
@@ -231,18 +712,280 @@ func (p *Parser) handleKWTTL(zone *Zone) (err error) {
 	}
 	zone.TTL = uint(ttl)
 
-	nl, err := p.Lexer.Next()
+	if err := p.expectEOL("ttl"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// handleKWSOA handles the soa keyword, which gives the SOA record of the zone:
+// soa <mname> <rname> <serial> <refresh> <retry> <expire> <minimum>
+// It will modify zone as required, unless an error occurs, in which case an error will be returned.
+func (p *Parser) handleKWSOA(zone *Zone) error {
+	if _, exists := zone.SOA(); exists {
+		errStr := fmt.Sprintf("%v Multiple soa keywords in zone file", p.Pos())
+		return errors.New(errStr)
+	}
+
+	record := RData{Name: "@", Type: TypeSOA}
+	for _, field := range []*Domain{&record.MName, &record.RName} {
+		tok, err := p.Lexer.Next()
+		if err != nil {
+			return err
+		}
+		*field, err = p.parseDomain(tok, *zone)
+		if err != nil {
+			return err
+		}
+	}
+
+	fields := []struct {
+		name  string
+		value *uint32
+	}{
+		{"serial", &record.Serial},
+		{"refresh", &record.Refresh},
+		{"retry", &record.Retry},
+		{"expire", &record.Expire},
+		{"minimum", &record.Minimum},
+	}
+	for _, field := range fields {
+		var err error
+		*field.value, err = p.parseUint32(field.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := p.expectEOL("soa"); err != nil {
+		return err
+	}
+	return zone.Insert(record)
+}
+
+// handleKWACL handles keywords which are followed by a list of client addresses, networks or TSIG keys, such as
+// allow-transfer. The entries are added to acl. keyword is used for error messages.
+func (p *Parser) handleKWACL(acl *ACL, keyword string) error {
+	entries := 0
+	for {
+		tok, err := p.Lexer.Next()
+		if err != nil {
+			return err
+		}
+		if tok.Type == TokenNewline || tok.Type == TokenEOF {
+			break
+		}
+		if tok.Type != TokenIP && tok.Type != TokenIdent {
+			errStr := fmt.Sprintf("%v Expected an address or network after %v, got: [%v]", p.Pos(), keyword, tok)
+			return errors.New(errStr)
+		}
+		entry, err := ParseACLEntry(tok.Value)
+		if err != nil {
+			errStr := fmt.Sprintf("%v %v", p.Pos(), err)
+			return errors.New(errStr)
+		}
+		*acl = append(*acl, entry)
+		entries++
+	}
+	if entries == 0 {
+		errStr := fmt.Sprintf("%v Expected an address or network after %v", p.Pos(), keyword)
+		return errors.New(errStr)
+	}
+	return nil
+}
+
+// handleKWTSIGKey handles the tsig-key keyword, which gives the name of the TSIG key to sign the transfer requests
+// and NOTIFY messages we send for the zone with: tsig-key <name>
+// It will modify zone as required, unless an error occurs, in which case an error will be returned.
+func (p *Parser) handleKWTSIGKey(zone *Zone) error {
+	tok, err := p.Lexer.Next()
 	if err != nil {
 		return err
 	}
-	if nl.Type != TokenNewline && nl.Type != TokenEOF {
-		errStr := fmt.Sprintf("%v Unexpected value after ttl specification: %v", p.Pos(), nl.Value)
+	name := Domain(strings.ToLower(tok.Value))
+	if tok.Type != TokenIdent || !name.Valid() {
+		errStr := fmt.Sprintf("%v Expected a key name after tsig-key keyword, got: [%v]", p.Pos(), tok)
 		return errors.New(errStr)
 	}
+	if zone.TSIGKey != "" {
+		errStr := fmt.Sprintf("%v tsig-key already specified for this zone", p.Pos())
+		return errors.New(errStr)
+	}
+	if err := p.expectEOL("tsig-key"); err != nil {
+		return err
+	}
+	zone.TSIGKey = name.AsFQDN()
+	return nil
+}
 
+// handleKWDNSSECKey handles the dnssec-key keyword, which gives the path of a private key to sign the zone with
+// online: dnssec-key <path>
+// It will modify zone as required, unless an error occurs, in which case an error will be returned.
+func (p *Parser) handleKWDNSSECKey(zone *Zone) error {
+	tok, err := p.Lexer.Next()
+	if err != nil {
+		return err
+	}
+	if tok.Type == TokenNewline || tok.Type == TokenEOF {
+		errStr := fmt.Sprintf("%v Expected a key file after dnssec-key keyword, got: [%v]", p.Pos(), tok)
+		return errors.New(errStr)
+	}
+	if err := p.expectEOL("dnssec-key"); err != nil {
+		return err
+	}
+	zone.DNSSECKeyFiles = append(zone.DNSSECKeyFiles, tok.Value)
+	return nil
+}
+
+// handleKWDenial handles the denial keyword, which gives how nonexistence is proven in signed replies:
+// denial nsec | nsec3 [<iterations> [<hex salt> | -]] | compact
+// It will modify zone as required, unless an error occurs, in which case an error will be returned.
+func (p *Parser) handleKWDenial(zone *Zone) error {
+	tok, err := p.Lexer.Next()
+	if err != nil {
+		return err
+	}
+	switch tok.Value {
+	case "nsec":
+		zone.Denial = DenialNSEC
+	case "compact":
+		zone.Denial = DenialCompact
+	case "nsec3":
+		zone.Denial = DenialNSEC3
+		zone.NSEC3Iterations, zone.NSEC3Salt = 0, nil
+		tok, err = p.Lexer.Next()
+		if err != nil {
+			return err
+		}
+		if tok.Type == TokenNewline || tok.Type == TokenEOF {
+			return nil
+		}
+		iterations, err := strconv.ParseUint(tok.Value, 10, 16)
+		if tok.Type != TokenInt || err != nil || iterations > nsec3MaxIterations {
+			errStr := fmt.Sprintf("%v Expected NSEC3 iterations of at most %v, got: [%v]", p.Pos(), nsec3MaxIterations, tok)
+			return errors.New(errStr)
+		}
+		zone.NSEC3Iterations = uint16(iterations)
+		tok, err = p.Lexer.Next()
+		if err != nil {
+			return err
+		}
+		if tok.Type == TokenNewline || tok.Type == TokenEOF {
+			return nil
+		}
+		if tok.Value != "-" {
+			zone.NSEC3Salt, err = hex.DecodeString(tok.Value)
+			if err != nil || len(zone.NSEC3Salt) > 255 {
+				errStr := fmt.Sprintf("%v Expected an NSEC3 salt in hex or -, got: [%v]", p.Pos(), tok)
+				return errors.New(errStr)
+			}
+		}
+	default:
+		errStr := fmt.Sprintf("%v Expected nsec, nsec3 or compact after denial keyword, got: [%v]", p.Pos(), tok)
+		return errors.New(errStr)
+	}
+	return p.expectEOL("denial")
+}
+
+// handleKWPrimary handles the primary keyword, which makes the zone a secondary zone transferred from the given
+// server: primary <address>[:port]
+// It will modify zone as required, unless an error occurs, in which case an error will be returned.
+func (p *Parser) handleKWPrimary(zone *Zone) error {
+	tok, err := p.Lexer.Next()
+	if err != nil {
+		return err
+	}
+	if zone.Secondary() {
+		errStr := fmt.Sprintf("%v Multiple primary keywords in zone file", p.Pos())
+		return errors.New(errStr)
+	}
+	if tok.Type != TokenIP && tok.Type != TokenIdent {
+		errStr := fmt.Sprintf("%v Expected an address after primary keyword, got: [%v]", p.Pos(), tok)
+		return errors.New(errStr)
+	}
+	zone.Primary, err = parseAddrPort(tok.Value)
+	if err != nil {
+		errStr := fmt.Sprintf("%v %v", p.Pos(), err)
+		return errors.New(errStr)
+	}
+	return p.expectEOL("primary")
+}
+
+// handleKWNotify handles the notify keyword, which is followed by the addresses of secondaries to send NOTIFY
+// to when the zone changes: notify <address>[:port] ...
+// It will modify zone as required, unless an error occurs, in which case an error will be returned.
+func (p *Parser) handleKWNotify(zone *Zone) error {
+	for {
+		tok, err := p.Lexer.Next()
+		if err != nil {
+			return err
+		}
+		if tok.Type == TokenNewline || tok.Type == TokenEOF {
+			break
+		}
+		if tok.Type != TokenIP && tok.Type != TokenIdent {
+			errStr := fmt.Sprintf("%v Expected an address after notify keyword, got: [%v]", p.Pos(), tok)
+			return errors.New(errStr)
+		}
+		target, err := parseAddrPort(tok.Value)
+		if err != nil {
+			errStr := fmt.Sprintf("%v %v", p.Pos(), err)
+			return errors.New(errStr)
+		}
+		zone.Notify = append(zone.Notify, target)
+	}
+	if len(zone.Notify) == 0 {
+		errStr := fmt.Sprintf("%v Expected an address after notify keyword", p.Pos())
+		return errors.New(errStr)
+	}
 	return nil
 }
 
+// handleKWPTRFrom handles the ptr-from keyword, which gives the forward zones whose A and AAAA records a reverse
+// zone is given PTR records for: ptr-from <zone> ...
+// It will modify zone as required, unless an error occurs, in which case an error will be returned.
+func (p *Parser) handleKWPTRFrom(zone *Zone) error {
+	for {
+		tok, err := p.Lexer.Next()
+		if err != nil {
+			return err
+		}
+		if tok.Type == TokenNewline || tok.Type == TokenEOF {
+			break
+		}
+		domain := Domain(tok.Value)
+		if tok.Type != TokenIdent || !domain.Valid() {
+			errStr := fmt.Sprintf("%v Expected a zone after ptr-from keyword, got: [%v]", p.Pos(), tok)
+			return errors.New(errStr)
+		}
+		if !domain.FQDN() {
+			log.Warningf("%v ptr-from zone %v is not an FQDN. Will assume it is.", p.Pos(), domain)
+			domain = domain.AsFQDN()
+		}
+		zone.PTRFrom = append(zone.PTRFrom, domain)
+	}
+	if len(zone.PTRFrom) == 0 {
+		errStr := fmt.Sprintf("%v Expected a zone after ptr-from keyword", p.Pos())
+		return errors.New(errStr)
+	}
+	return nil
+}
+
+// parseAddrPort parses a server address, with an optional port which defaults to 53.
+// IPv6 addresses with a port must be in brackets, e.g. [2001:db8::1]:5353.
+func parseAddrPort(s string) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.AddrPortFrom(addr, 53), nil
+	}
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		errStr := fmt.Sprintf("Invalid server address %q", s)
+		return addrPort, errors.New(errStr)
+	}
+	return addrPort, nil
+}
+
 // Pos returns a short string displaying the current parser name & line number
 func (p *Parser) Pos() string {
 	return fmt.Sprintf("%v:%v", p.Name, p.Lexer.Line)
@@ -0,0 +1,154 @@
+package dns
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+// testParse parses a zone file for example.com with the given records.
+func testParse(records string) (Zone, error) {
+	contents := "zone example.com.\nttl 300\nsoa ns.example.com. hostmaster.example.com. 1 3600 600 604800 60\n" + records + "\n"
+	lexer := NewLexer(bufio.NewReader(strings.NewReader(contents)))
+	parser := NewParser(&lexer, "test.zone")
+	return parser.Parse()
+}
+
+// TestParseSOA ensures the soa keyword gives the zone's SOA record, and that SOA records can't be given any other
+// way.
+func TestParseSOA(t *testing.T) {
+	zone, err := testParse("")
+	if err != nil {
+		t.Fatalf("Could not parse zone: %v", err)
+	}
+	soa, ok := zone.SOA()
+	if !ok {
+		t.Fatalf("Expected the zone to have an SOA record")
+	}
+	if want := "ns.example.com. hostmaster.example.com. 1 3600 600 604800 60"; soa.DataString() != want {
+		t.Errorf("Expected SOA data %q, got %q", want, soa.DataString())
+	}
+
+	lexer := NewLexer(bufio.NewReader(strings.NewReader("zone example.com.\nsoa ns1 hostmaster 1 2 3 4 5\n")))
+	parser := NewParser(&lexer, "test.zone")
+	zone, err = parser.Parse()
+	if err != nil {
+		t.Fatalf("Could not parse zone: %v", err)
+	}
+	if soa, _ := zone.SOA(); soa.MName != "ns1.example.com." || soa.RName != "hostmaster.example.com." {
+		t.Errorf("Expected relative SOA names to be made absolute, got %v and %v", soa.MName, soa.RName)
+	}
+
+	bad := map[string]string{
+		"record":   "@ SOA ns.example.com. hostmaster.example.com. 1 3600 600 604800 60",
+		"multiple": "soa ns.example.com. hostmaster.example.com. 2 3600 600 604800 60",
+	}
+	for desc, records := range bad {
+		if _, err := testParse(records); err == nil {
+			t.Errorf("%v: expected %q to be rejected", desc, records)
+		}
+	}
+	for desc, line := range map[string]string{
+		"missing field": "soa ns.example.com. hostmaster.example.com. 1 3600 600 604800",
+		"bad serial":    "soa ns.example.com. hostmaster.example.com. one 3600 600 604800 60",
+		"big serial":    "soa ns.example.com. hostmaster.example.com. 4294967296 3600 600 604800 60",
+		"trailing":      "soa ns.example.com. hostmaster.example.com. 1 3600 600 604800 60 300",
+	} {
+		lexer := NewLexer(bufio.NewReader(strings.NewReader("zone example.com.\n" + line + "\n")))
+		parser := NewParser(&lexer, "test.zone")
+		if _, err := parser.Parse(); err == nil {
+			t.Errorf("%v: expected %q to be rejected", desc, line)
+		}
+	}
+}
+
+// TestKeywordNames ensures keywords are only taken as directives at the start of a line, so they can be used as
+// names of records and in their data.
+func TestKeywordNames(t *testing.T) {
+	tests := []struct {
+		records string
+		name    string
+		rtype   RecType
+		data    string
+	}{
+		{"soa A 192.0.2.1", "soa", TypeA, "192.0.2.1"},
+		{"www CNAME soa", "www", TypeCNAME, "soa.example.com."},
+		{"@ MX 10 denial", "", TypeMX, "10 denial.example.com."},
+		{"ttl AAAA 2001:db8::1", "ttl", TypeAAAA, "2001:db8::1"},
+		{"ptr-from TXT \"zone\"", "ptr-from", TypeTXT, `"zone"`},
+		{"dnssec-key CNAME tsig-key", "dnssec-key", TypeCNAME, "tsig-key.example.com."},
+		{"@ NS primary", "", TypeNS, "primary.example.com."},
+		{"primary A 192.0.2.1", "primary", TypeA, "192.0.2.1"},
+		{"www CNAME primary", "www", TypeCNAME, "primary.example.com."},
+		{"notify A 192.0.2.1", "notify", TypeA, "192.0.2.1"},
+		{"@ MX 10 notify", "", TypeMX, "10 notify.example.com."},
+		{"allow-notify CNAME allow-notify.example.net.", "allow-notify", TypeCNAME, "allow-notify.example.net."},
+		{"MX.example.com. A 192.0.2.1", "mx", TypeA, "192.0.2.1"},
+		{"example.com. TXT \"apex\"", "", TypeTXT, `"apex"`},
+	}
+	for _, test := range tests {
+		zone, err := testParse(test.records)
+		if err != nil {
+			t.Errorf("Could not parse %q: %v", test.records, err)
+			continue
+		}
+		rrset := zone.Records[test.name]
+		if got := rrset.RRSet[test.rtype]; len(got) != 1 || got[0].DataString() != test.data {
+			t.Errorf("Expected %q to give %v %v %v, got %v", test.records, test.name, test.rtype, test.data, got)
+		}
+	}
+	if _, err := testParse("www.example.net. A 192.0.2.1"); err == nil {
+		t.Errorf("Expected a fully qualified name outside the zone not to parse")
+	}
+}
+
+// TestGenericKnownTypes ensures records of types we know may be given in the generic form of RFC 3597
+// section 5, and are decoded from it.
+func TestGenericKnownTypes(t *testing.T) {
+	tests := []struct {
+		records string
+		name    string
+		rtype   RecType
+		data    string
+	}{
+		{`host TYPE1 \# 4 C0000201`, "host", TypeA, "192.0.2.1"},
+		{`host A \# 4 C000 0201`, "host", TypeA, "192.0.2.1"},
+		{`@ MX \# 20 000A 046D61696C 076578616D706C65 03636F6D 00 600`, "", TypeMX, "10 mail.example.com."},
+		{`txt TXT \# 6 0568656C6C6F`, "txt", TypeTXT, `"hello"`},
+	}
+	for _, test := range tests {
+		zone, err := testParse(test.records)
+		if err != nil {
+			t.Errorf("Could not parse %q: %v", test.records, err)
+			continue
+		}
+		rrset := zone.Records[test.name]
+		if got := rrset.RRSet[test.rtype]; len(got) != 1 || got[0].DataString() != test.data || len(got[0].Data) != 0 {
+			t.Errorf("Expected %q to give %v %v %v, got %v", test.records, test.name, test.rtype, test.data, got)
+		}
+	}
+	for _, records := range []string{`host A \# 3 C00002`, `host A \# 4 C00002`, `@ MX \# 2 000A`} {
+		if _, err := testParse(records); err == nil {
+			t.Errorf("Expected %q not to parse", records)
+		}
+	}
+}
+
+// TestMetaTypes ensures records can't be given meta-types or query types, by name or in the generic form.
+func TestMetaTypes(t *testing.T) {
+	for _, records := range []string{
+		`x OPT \# 0`,
+		`x TYPE41 \# 0`,
+		`x TYPE128 \# 0`,
+		`x TYPE250 \# 0`,
+		`x TYPE252 \# 0`,
+		`x TYPE255 \# 0`,
+	} {
+		if _, err := testParse(records); err == nil {
+			t.Errorf("Expected %q to be rejected", records)
+		}
+	}
+	if _, err := testParse(`x TYPE127 \# 0`); err != nil {
+		t.Errorf("Expected TYPE127, a data type, to be parsed: %v", err)
+	}
+}
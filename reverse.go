@@ -0,0 +1,164 @@
+package dns
+
+import (
+	"maps"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReverseName returns the name the PTR record of addr lives at: under in-addr.arpa for IPv4 addresses
+// (RFC 1035 section 3.5), and under ip6.arpa for IPv6 addresses (RFC 3596 section 2.5).
+func ReverseName(addr netip.Addr) Domain {
+	addr = addr.Unmap()
+	b := addr.AsSlice()
+	labels := make([]string, 0, 2*len(b)+2)
+	for i := len(b) - 1; i >= 0; i-- {
+		if addr.Is4() {
+			labels = append(labels, strconv.Itoa(int(b[i])))
+		} else {
+			labels = append(labels, strconv.FormatUint(uint64(b[i]&0xf), 16), strconv.FormatUint(uint64(b[i]>>4), 16))
+		}
+	}
+	if addr.Is4() {
+		labels = append(labels, "in-addr", "arpa")
+	} else {
+		labels = append(labels, "ip6", "arpa")
+	}
+	return Domain(strings.Join(labels, ".") + ".")
+}
+
+// generatePTRs will replace the zones given with ptr-from in zones by copies with PTR records for the A and
+// AAAA records of their forward zones in zones, so reverse DNS follows forward DNS as it changes.
+// The serials of the copies follow those of the zones in served, the zones served until now, see followSerial.
+// The names of the zones whose serial was increased past the one served are returned.
+func generatePTRs(zones map[Domain]Zone, served *Trie[Zone]) (increased []Domain) {
+	reverse := make(map[Domain]Zone)
+	for name, zone := range zones {
+		if len(zone.PTRFrom) == 0 {
+			continue
+		}
+		var forward []*Zone
+		for _, from := range zone.PTRFrom {
+			if z, ok := lookupZone(zones, from); ok {
+				forward = append(forward, &z)
+			} else {
+				log.Warnf("Zone %v has PTR records made from zone %v, which isn't loaded", zone.Name, from)
+			}
+		}
+		withPTRs, err := zone.withPTRs(forward)
+		if err != nil {
+			log.Errorf("Could not make PTR records for zone %v: %v", zone.Name, err)
+			continue
+		}
+		ok, err := withPTRs.followSerial(served)
+		if err != nil {
+			log.Errorf("Could not compare zone %v with the version served: %v", zone.Name, err)
+			continue
+		}
+		if ok {
+			increased = append(increased, name)
+		}
+		reverse[name] = withPTRs
+	}
+	maps.Copy(zones, reverse)
+	return increased
+}
+
+// followSerial will set the serial of the reverse zone z, a copy made by withPTRs, so that it's increased when
+// its records differ from those of the version in served. Otherwise its PTR records could change without the
+// serial changing, and secondaries wouldn't see it. A serial from the zone file later than the one served is kept.
+// Without a version served, e.g. after a restart, the serial is increased past the end of the zone's journal
+// instead, as the serial served before may have been increased this way.
+// It reports whether the serial was increased past the one served.
+func (z *Zone) followSerial(served *Trie[Zone]) (bool, error) {
+	soa, ok := z.SOA()
+	if !ok {
+		return false, nil
+	}
+	serial := soa.Serial
+	prev, isServed := findZone(served, z.Name)
+	isServed = isServed && strings.EqualFold(prev.Name.String(), z.Name.String())
+	if isServed {
+		prevSOA, ok := prev.SOA()
+		if !ok || serialLess(prevSOA.Serial, soa.Serial) {
+			return false, nil
+		}
+		diff, err := DiffZones(prev, z)
+		if err != nil {
+			return false, err
+		}
+		serial = prevSOA.Serial
+		if len(diff.Deleted) > 0 || len(diff.Added) > 0 {
+			serial++
+		}
+	} else if last, ok := z.Journal.Serial(); ok && serialLess(soa.Serial, last) {
+		serial = last + 1
+	}
+	if serial == soa.Serial {
+		return false, nil
+	}
+	// withPTRs made the zone's records afresh, so no other version of the zone shares its SOA record.
+	z.Records[""].RRSet[TypeSOA][0].Serial = serial
+	log.Infof("Increased serial of zone %v, which has PTR records made from other zones, to %v", z.Name, serial)
+	return isServed, nil
+}
+
+// lookupZone returns the zone of zones named name, in any case.
+func lookupZone(zones map[Domain]Zone, name Domain) (Zone, bool) {
+	for zoneName, zone := range zones {
+		if strings.EqualFold(zoneName.AsFQDN().String(), name.AsFQDN().String()) {
+			return zone, true
+		}
+	}
+	return Zone{}, false
+}
+
+// withPTRs returns a copy of the zone with its generated PTR records replaced by ones for the addresses of
+// forward. A PTR record is made for each address in the zone that's owned by a name of forward outside
+// wildcards and delegations. Names given PTR records in the zone file keep only those.
+func (z *Zone) withPTRs(forward []*Zone) (Zone, error) {
+	var rrs []RR
+	for rr := range z.All() {
+		if !rr.RData.generated {
+			rrs = append(rrs, rr)
+		}
+	}
+	zone, err := z.WithRecords(rrs)
+	if err != nil {
+		return zone, err
+	}
+	// explicit reports whether the (zone relative) name has PTR records from the zone file.
+	explicit := func(name string) bool {
+		rrset := zone.Records[name]
+		return slices.ContainsFunc(rrset.RRSet[TypePTR], func(ptr RData) bool { return !ptr.generated })
+	}
+	for _, from := range forward {
+		for _, name := range slices.Sorted(maps.Keys(from.Records)) {
+			if _, isCut := from.ZoneCut(name); isCut || strings.HasPrefix(name, "*") {
+				continue // Glue isn't authoritative, and wildcards don't have addresses of their own.
+			}
+			rrset := from.Records[name]
+			for _, t := range []RecType{TypeA, TypeAAAA} {
+				for addr := range rrset.Get(t) {
+					owner := ReverseName(addr.Addr)
+					if !zone.Contains(owner) {
+						continue
+					}
+					key := queryStr(&zone, owner).String()
+					if _, isCut := zone.ZoneCut(key); isCut || explicit(key) {
+						continue
+					}
+					ptr := RData{Type: TypePTR, Target: from.AbsoluteName(name).AsFQDN(), TTL: addr.TTLOrDefault(*from), generated: true}
+					if err := zone.InsertRR(ptr.RR(owner)); err != nil {
+						log.Warnf("Could not add PTR record for %v to zone %v: %v", addr.Addr, zone.Name, err)
+					}
+				}
+			}
+		}
+	}
+	return zone, nil
+}
@@ -0,0 +1,173 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestReverseName ensures addresses are mapped to their names under in-addr.arpa and ip6.arpa as in
+// RFC 1035 section 3.5 and RFC 3596 section 2.5.
+func TestReverseName(t *testing.T) {
+	tests := map[string]Domain{
+		"192.0.2.1":               "1.2.0.192.in-addr.arpa.",
+		"::ffff:192.0.2.1":        "1.2.0.192.in-addr.arpa.",
+		"4321:0:1:2:3:4:567:89ab": "b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa.",
+	}
+	for addr, want := range tests {
+		if name := ReverseName(netip.MustParseAddr(addr)); name != want {
+			t.Errorf("Expected the reverse name of %v to be %v, got %v", addr, want, name)
+		}
+	}
+}
+
+// TestPTRFrom ensures reverse zones are given PTR records for the addresses of their ptr-from zones, which
+// follow the forward zone when it changes, and that PTR records in the zone file take precedence.
+func TestPTRFrom(t *testing.T) {
+	dir := t.TempDir()
+	forward := "www A 192.0.2.1\nmail A 192.0.2.10\nmail AAAA 2001:db8::1\n*.w A 192.0.2.3\n" +
+		"sub NS ns.sub.example.com.\nns.sub A 192.0.2.9"
+	testZoneFile(t, dir, 1, forward)
+	reverse := map[string]string{
+		"2.0.192.in-addr.arpa":     "1 PTR web.example.com.\n20 PTR other.example.net.",
+		"8.b.d.0.1.0.0.2.ip6.arpa": "",
+	}
+	for name, records := range reverse {
+		contents := "zone " + name + ".\nttl 600\nsoa ns.example.com. hostmaster.example.com. 1 3600 600 604800 60\n" +
+			"ptr-from example.com.\n@ NS ns.example.com.\n" + records + "\n"
+		if err := os.WriteFile(filepath.Join(dir, name+".zone"), []byte(contents), 0o644); err != nil {
+			t.Fatalf("Could not write zone file: %v", err)
+		}
+	}
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+
+	tests := []struct {
+		addr    string
+		targets []string
+	}{
+		{"192.0.2.1", []string{"web.example.com."}},
+		{"192.0.2.10", []string{"mail.example.com."}},
+		{"2001:db8::1", []string{"mail.example.com."}},
+		{"192.0.2.3", nil},
+		{"192.0.2.9", nil},
+		{"192.0.2.20", []string{"other.example.net."}},
+	}
+	for _, test := range tests {
+		name := ReverseName(netip.MustParseAddr(test.addr))
+		reply := testRespond(t, server, testQuery(name, TypePTR))
+		var targets []string
+		for _, rr := range reply.Answer {
+			targets = append(targets, rr.RData.DataString())
+		}
+		if strings.Join(targets, " ") != strings.Join(test.targets, " ") {
+			t.Errorf("Expected %v PTR %v, got %v", name, test.targets, targets)
+		}
+	}
+
+	zone, _ := findZone(server.Zones(), "2.0.192.in-addr.arpa")
+	if file := string(zone.ZoneFile()); strings.Contains(file, "mail.example.com") || !strings.Contains(file, "ptr-from example.com.\n") {
+		t.Errorf("Expected the zone file to have ptr-from and no PTR records made from it, got:\n%s", file)
+	}
+
+	testZoneFile(t, dir, 2, "ftp A 192.0.2.30")
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not reload zones: %v", err)
+	}
+	for addr, want := range map[string]int{"192.0.2.30": 1, "192.0.2.10": 0} {
+		reply := testRespond(t, server, testQuery(ReverseName(netip.MustParseAddr(addr)), TypePTR))
+		if len(reply.Answer) != want {
+			t.Errorf("Expected %v PTR records for %v once the forward zone changed, got %v", want, addr, reply.Answer)
+		}
+	}
+}
+
+// TestPTRFromSerial ensures the serial of a reverse zone is increased when its PTR records made from a forward
+// zone change, by a reload or an UPDATE, that the change is journaled and the secondaries are notified, and that
+// the serial doesn't go back when the zones are reloaded or the server restarted.
+func TestPTRFromSerial(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer conn.Close()
+	dir := t.TempDir()
+	testZoneFile(t, dir, 1, "allow-update 127.0.0.1\nwww A 192.0.2.1")
+	contents := "zone 2.0.192.in-addr.arpa.\nttl 600\nsoa ns.example.com. hostmaster.example.com. 1 3600 600 604800 60\n" +
+		"ptr-from example.com.\nnotify " + conn.LocalAddr().String() + "\n@ NS ns.example.com.\n"
+	if err := os.WriteFile(filepath.Join(dir, "reverse.zone"), []byte(contents), 0o644); err != nil {
+		t.Fatalf("Could not write zone file: %v", err)
+	}
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+
+	// reverseSerial returns the serial of the reverse zone on server, and the serial its journal ends at.
+	reverseSerial := func(server *Server) (uint32, uint32) {
+		zone, _ := findZone(server.Zones(), "2.0.192.in-addr.arpa")
+		soa, _ := zone.SOA()
+		journaled, _ := zone.Journal.Serial()
+		return soa.Serial, journaled
+	}
+	// expectNotify waits for a NOTIFY for the reverse zone.
+	expectNotify := func() {
+		buf := make([]byte, ednsUDPSize)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("Expected a NOTIFY for the reverse zone: %v", err)
+		}
+		msg, err := ParseDNSMsg(buf[:n])
+		if err != nil || msg.Header.Opcode != opcodeNotify || msg.Question[0].Name.AsFQDN() != "2.0.192.in-addr.arpa." {
+			t.Fatalf("Expected a NOTIFY for the reverse zone, got %+v (%v)", msg, err)
+		}
+	}
+
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not reload zones: %v", err)
+	}
+	if serial, _ := reverseSerial(server); serial != 1 {
+		t.Errorf("Expected the serial to be kept while the PTR records are unchanged, got %v", serial)
+	}
+
+	addMail := RR{Name: "mail.example.com", Type: TypeA, Class: QClassIN, TTL: 60,
+		RData: RData{Type: TypeA, Addr: netip.MustParseAddr("192.0.2.10")}}
+	if rcode := testUpdate(t, server, "127.0.0.1", nil, []RR{addMail}); rcode != rcodeNoError {
+		t.Fatalf("UPDATE failed with rcode %v", rcode)
+	}
+	if serial, journaled := reverseSerial(server); serial != 2 || journaled != 2 {
+		t.Errorf("Expected serial 2 journaled after an UPDATE of the forward zone, got %v and %v", serial, journaled)
+	}
+	expectNotify()
+
+	// The reverse zone file still has serial 1, but the serial served mustn't go back.
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not reload zones: %v", err)
+	}
+	if serial, _ := reverseSerial(server); serial != 2 {
+		t.Errorf("Expected serial 2 to be kept on reload, got %v", serial)
+	}
+	testZoneFile(t, dir, 5, "www A 192.0.2.1\nftp A 192.0.2.30")
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not reload zones: %v", err)
+	}
+	if serial, journaled := reverseSerial(server); serial != 3 || journaled != 3 {
+		t.Errorf("Expected serial 3 journaled after a reload of the forward zone, got %v and %v", serial, journaled)
+	}
+	expectNotify()
+
+	restarted := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := restarted.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+	if serial, _ := reverseSerial(restarted); serial != 4 {
+		t.Errorf("Expected the serial to be increased past the journal after a restart, got %v", serial)
+	}
+}
@@ -0,0 +1,414 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// secondaryTick is how often secondary zones are checked for being due a refresh.
+	secondaryTick = time.Second
+	// secondaryRetry is how long to wait before retrying to transfer a secondary zone we have no SOA record for.
+	secondaryRetry = time.Minute
+	// transferTimeout limits how long transferring a zone from its primary may take.
+	transferTimeout = time.Minute
+)
+
+// secondary is the refresh state of a secondary zone (RFC 1034 section 4.3.5).
+type secondary struct {
+	refreshAt  time.Time // When to next check the primary for a new version of the zone.
+	expireAt   time.Time // When to stop serving the zone if it can't be refreshed. Zero if it isn't loaded.
+	refreshing bool      // Whether a refresh is in progress.
+	notified   bool      // Whether a NOTIFY arrived during the refresh in progress, so another is needed.
+}
+
+// inboundTransfer is the result of requesting a zone transfer from a primary.
+type inboundTransfer struct {
+	upToDate bool       // The primary has no newer version of the zone.
+	full     []RR       // The whole zone, if it was sent like AXFR.
+	diffs    []ZoneDiff // The changes to the zone, if it was sent incrementally.
+}
+
+// copyPath returns the path of the local copy of the secondary zone, kept next to its zone file.
+// The modification time of the copy is when the zone was last refreshed.
+func copyPath(zone *Zone) string {
+	return zone.File + ".copy"
+}
+
+// loadSecondary fills in the records of the secondary zone, just loaded from its zone file, with those of prev,
+// the version served until now, or else the local copy of the zone if it hasn't expired.
+// New secondary zones are refreshed straight away. s.zonesMu must be held.
+func (s *Server) loadSecondary(prev, zone *Zone) {
+	key := strings.ToLower(zone.Name.String())
+	if prev != nil && prev.Secondary() {
+		zone.Records, zone.names = prev.Records, prev.names
+		if _, ok := s.secondaries[key]; ok {
+			return
+		}
+	}
+	state := &secondary{refreshAt: time.Now()}
+	s.secondaries[key] = state
+
+	rrs, err := readRRFile(copyPath(zone))
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	info, statErr := os.Stat(copyPath(zone))
+	if err != nil || statErr != nil {
+		log.Errorf("Could not read local copy of secondary zone %v: %v", zone.Name, errors.Join(err, statErr))
+		return
+	}
+	loaded, err := zone.WithRecords(rrs)
+	if err != nil {
+		log.Errorf("Could not load local copy of secondary zone %v: %v", zone.Name, err)
+		return
+	}
+	soa, ok := loaded.SOA()
+	if !ok {
+		log.Errorf("Local copy of secondary zone %v has no SOA record", zone.Name)
+		return
+	}
+	expireAt := info.ModTime().Add(time.Duration(soa.Expire) * time.Second)
+	if !time.Now().Before(expireAt) {
+		log.Warnf("Local copy of secondary zone %v has expired", zone.Name)
+		return
+	}
+	*zone = loaded
+	state.expireAt = expireAt
+	log.Infof("Loaded secondary zone %v at serial %v from its local copy", zone.Name, soa.Serial)
+}
+
+// RunSecondaries will refresh secondary zones from their primaries whenever they are due, or have been notified of
+// a change, until ctx is cancelled.
+func (s *Server) RunSecondaries(ctx context.Context) error {
+	ticker := time.NewTicker(secondaryTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-s.refreshNow:
+		}
+		for _, name := range s.dueSecondaries() {
+			go func() {
+				if err := s.RefreshZone(name); err != nil {
+					log.Errorf("[%v secondary] %v", name, err)
+				}
+			}()
+		}
+	}
+}
+
+// dueSecondaries returns the names of the secondary zones due a refresh, and marks them as being refreshed.
+// Zones which have expired stop being served, unless they're being refreshed, in which case RefreshZone
+// expires them if the refresh fails.
+func (s *Server) dueSecondaries() (names []string) {
+	s.zonesMu.Lock()
+	defer s.zonesMu.Unlock()
+	now := time.Now()
+	for name, state := range s.secondaries {
+		if !state.refreshing && !state.expireAt.IsZero() && !now.Before(state.expireAt) {
+			s.expireSecondary(name, state)
+		}
+		if !state.refreshing && !now.Before(state.refreshAt) {
+			state.refreshing = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// RefreshZone will check the primary of the secondary zone with the (lowercase) name for a newer version, and
+// transfer it if there is one. Failed refreshes are retried after the SOA retry interval, and the zone stops being
+// served once it expires.
+func (s *Server) RefreshZone(name string) error {
+	zone, ok := findZone(s.Zones(), Domain(name))
+	if !ok || !strings.EqualFold(zone.Name.String(), name) || !zone.Secondary() {
+		return nil // The zone was removed, or isn't a secondary any more.
+	}
+	soa, loaded := zone.SOA()
+	transfer, transferErr := s.transferIn(zone, soa, loaded)
+
+	s.zonesMu.Lock()
+	defer s.zonesMu.Unlock()
+	state, ok := s.secondaries[name]
+	if !ok {
+		return nil
+	}
+	state.refreshing = false
+	now := time.Now()
+	defer func() {
+		if state.notified {
+			state.notified = false
+			state.refreshAt = now
+			select {
+			case s.refreshNow <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	err := transferErr
+	if err == nil {
+		err = s.applyTransfer(zone, transfer)
+	}
+	if err != nil {
+		retry := secondaryRetry
+		if loaded {
+			retry = time.Duration(soa.Retry) * time.Second
+		}
+		state.refreshAt = now.Add(retry)
+		if loaded && !now.Before(state.expireAt) {
+			s.expireSecondary(name, state)
+		}
+		errStr := fmt.Sprintf("Could not refresh zone from %v: %v", zone.Primary, err)
+		return errors.New(errStr)
+	}
+
+	refreshed, _ := findZone(s.Zones(), Domain(name))
+	soa, _ = refreshed.SOA()
+	state.refreshAt = now.Add(time.Duration(soa.Refresh) * time.Second)
+	state.expireAt = now.Add(time.Duration(soa.Expire) * time.Second)
+	if err := os.Chtimes(copyPath(refreshed), now, now); err != nil {
+		log.Errorf("[%v secondary] Could not update the time of the local copy: %v", name, err)
+	}
+	return nil
+}
+
+// expireSecondary stops serving the records of the secondary zone with the (lowercase) name, which has expired.
+// s.zonesMu must be held.
+func (s *Server) expireSecondary(name string, state *secondary) {
+	log.Errorf("[%v secondary] Zone has expired, it won't be served until it can be transferred again", name)
+	current, _ := findZone(s.Zones(), Domain(name))
+	expired, _ := current.WithRecords(nil)
+	s.setZone(expired)
+	state.expireAt = time.Time{}
+}
+
+// applyTransfer will start serving the new version of the secondary zone from transfer, saving it to the
+// local copy of the zone. s.zonesMu must be held.
+func (s *Server) applyTransfer(zone *Zone, transfer inboundTransfer) error {
+	if transfer.upToDate {
+		log.Debugf("[%v secondary] Zone is up to date", zone.Name)
+		return nil
+	}
+	current, ok := findZone(s.Zones(), zone.Name)
+	if !ok || !equalSOA(zone, current) {
+		return errors.New("Zone changed during the transfer")
+	}
+	zone = current // Its settings may have been reloaded.
+
+	rrs := transfer.full
+	if transfer.diffs != nil {
+		var err error
+		rrs, err = applyDiffs(zone, transfer.diffs)
+		if err != nil {
+			return err
+		}
+	}
+	updated, err := zone.WithRecords(rrs)
+	if err != nil {
+		return err
+	}
+	soa, ok := updated.SOA()
+	if !ok {
+		return errors.New("Transferred zone has no SOA record")
+	}
+
+	if err := writeRRFile(copyPath(&updated), axfrRRs(&updated, soa)); err != nil {
+		return err
+	}
+	prev := zone
+	if _, ok := zone.SOA(); !ok {
+		prev = nil
+	}
+	if err := updateJournal(prev, &updated); err != nil {
+		log.Errorf("[%v secondary] Could not update journal: %v", zone.Name, err)
+	}
+	s.setZone(updated)
+	log.Infof("[%v secondary] Transferred zone at serial %v", zone.Name, soa.Serial)
+	s.notifySecondaries(&updated)
+	return nil
+}
+
+// equalSOA reports whether zones a and b have the same SOA record serial, or both have no SOA record.
+func equalSOA(a, b *Zone) bool {
+	soaA, okA := a.SOA()
+	soaB, okB := b.SOA()
+	return okA == okB && soaA.Serial == soaB.Serial
+}
+
+// applyDiffs returns the records of zone with diffs, from an incremental transfer, applied.
+func applyDiffs(zone *Zone, diffs []ZoneDiff) ([]RR, error) {
+	records := make(map[string]RR)
+	for rr := range zone.All() {
+		if rr.Type == TypeSOA {
+			continue
+		}
+		key, err := rrKey(rr)
+		if err != nil {
+			return nil, err
+		}
+		records[key] = rr
+	}
+	for _, diff := range diffs {
+		for _, rr := range diff.Deleted {
+			key, err := rrKey(rr)
+			if err != nil {
+				return nil, err
+			}
+			delete(records, key)
+		}
+		for _, rr := range diff.Added {
+			key, err := rrKey(rr)
+			if err != nil {
+				return nil, err
+			}
+			records[key] = rr
+		}
+	}
+
+	rrs := []RR{diffs[len(diffs)-1].NewSOA}
+	for _, rr := range records {
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// setZone will start serving zone in place of the zone with the same name. s.zonesMu must be held.
+// Reverse zones with PTR records made from zone are given the changes, and their journals and secondaries too.
+func (s *Server) setZone(zone Zone) {
+	current := s.Zones()
+	zones := make(map[Domain]Zone)
+	for _, z := range current.All() {
+		zones[z.Name] = *z
+	}
+	zones[zone.Name] = zone
+	var changed []Zone
+	for _, name := range generatePTRs(zones, current) {
+		if name == zone.Name {
+			continue // The caller records the changes to zone.
+		}
+		reverse := zones[name]
+		prev, _ := findZone(current, name)
+		if err := updateJournal(prev, &reverse); err != nil {
+			log.Errorf("Could not update journal of zone %v: %v", name, err)
+		}
+		changed = append(changed, reverse)
+	}
+	trie := NewZoneTrie(zones)
+	s.zones.Store(&trie)
+	for _, reverse := range changed {
+		s.notifySecondaries(&reverse)
+	}
+}
+
+// transferIn requests the secondary zone from its primary. If the zone is loaded, with the SOA record soa, an
+// incremental transfer is requested (RFC 1995), otherwise the whole zone is (RFC 5936).
+// If the zone has a TSIG key, the request is signed with it, and so must the transfer be.
+func (s *Server) transferIn(zone *Zone, soa RData, loaded bool) (transfer inboundTransfer, err error) {
+	query := DNSMsg{
+		Header:   Header{ID: uint16(rand.Uint32()), QR: qrQuery, Opcode: opcodeQuery},
+		Question: []Question{{Name: zone.Name, Type: TypeAXFR, Class: QClassIN}},
+	}
+	if loaded {
+		query.Question[0].Type = TypeIXFR
+		query.Authority = []RR{zone.RR(soa, zone.Name)}
+	}
+	payload, err := query.Serialise()
+	if err != nil {
+		return transfer, err
+	}
+	var verifier *tsigVerifier
+	if zone.TSIGKey != "" {
+		key, err := s.key(zone.TSIGKey)
+		if err != nil {
+			return transfer, err
+		}
+		payload, verifier = signRequest(payload, key)
+	}
+
+	conn, err := net.DialTimeout("tcp", zone.Primary.String(), transferTimeout)
+	if err != nil {
+		return transfer, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(transferTimeout))
+	if err := writeTCPMsg(conn, payload); err != nil {
+		return transfer, err
+	}
+
+	// The transfer is over once the primary's SOA record has been repeated at the end: twice in all for AXFR,
+	// or three times for IXFR, as the new SOA of the last diff is sent before the final one.
+	reader := bufio.NewReader(conn)
+	var rrs []RR
+	var serial uint32
+	soaCount := 0
+	incremental := false
+	for {
+		buf, err := readTCPMsg(reader)
+		if err != nil {
+			return transfer, err
+		}
+		reply, err := ParseDNSMsg(buf)
+		if err != nil {
+			return transfer, err
+		}
+		if reply.Header.ID != query.Header.ID || reply.Header.QR != qrReply {
+			return transfer, errors.New("Primary sent a message which isn't a reply to the transfer query")
+		}
+		if verifier != nil {
+			if err := verifier.verify(buf, reply); err != nil {
+				return transfer, err
+			}
+		}
+		if reply.Header.Rcode != rcodeNoError {
+			errStr := fmt.Sprintf("Primary refused the transfer with rcode %v", reply.Header.Rcode)
+			return transfer, errors.New(errStr)
+		}
+
+		for _, rr := range reply.Answer {
+			switch len(rrs) {
+			case 0:
+				if rr.Type != TypeSOA {
+					return transfer, errors.New("Zone transfer doesn't start with an SOA record")
+				}
+				serial = rr.RData.Serial
+			case 1:
+				incremental = loaded && rr.Type == TypeSOA && rr.RData.Serial == soa.Serial && serial != soa.Serial
+			}
+			rrs = append(rrs, rr)
+			if rr.Type == TypeSOA && rr.RData.Serial == serial {
+				soaCount++
+			}
+		}
+
+		done := true
+		switch {
+		case len(rrs) == 1 && loaded && !serialLess(soa.Serial, serial):
+			transfer.upToDate = true
+		case incremental && soaCount == 3:
+			transfer.diffs, err = parseDiffs(rrs[1 : len(rrs)-1])
+		case !incremental && soaCount == 2:
+			transfer.full = rrs[:len(rrs)-1]
+		default:
+			done = false
+		}
+		if done {
+			if err == nil && verifier != nil {
+				err = verifier.complete()
+			}
+			return transfer, err
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPrimary serves the zones in dir over TCP on a local port until the test ends, returning the server and
+// its address.
+func testPrimary(t *testing.T, dir string) (*Server, string) {
+	primary := NewServer(testZoneTrie(t), Config{ZonePath: dir, TCPIdleTimeout: time.Second, TCPMaxConns: 4})
+	if err := primary.LoadZones(); err != nil {
+		t.Fatalf("Could not load primary zones: %v", err)
+	}
+	return primary, testServeTCP(t, primary)
+}
+
+// testSecondary loads the secondary zone example.com, transferred from primary, with its files in dir.
+func testSecondary(t *testing.T, dir, primary string) *Server {
+	contents := fmt.Sprintf("zone example.com.\nprimary %v\n", primary)
+	if err := os.WriteFile(filepath.Join(dir, "example.zone"), []byte(contents), 0o644); err != nil {
+		t.Fatalf("Could not write zone file: %v", err)
+	}
+	secondary := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := secondary.LoadZones(); err != nil {
+		t.Fatalf("Could not load secondary zones: %v", err)
+	}
+	return secondary
+}
+
+// testLookup returns the rcode and first address of the answer to an A query for name.
+func testLookup(t *testing.T, server *Server, name Domain) (byte, string) {
+	reply := testRespond(t, server, testQuery(name, TypeA))
+	if len(reply.Answer) == 0 {
+		return reply.Header.Rcode, ""
+	}
+	return reply.Header.Rcode, reply.Answer[0].RData.Addr.String()
+}
+
+// TestSecondary ensures secondary zones are transferred from their primary, kept up to date, restored from their
+// local copy, and stop being served when they expire.
+func TestSecondary(t *testing.T) {
+	primaryDir, secondaryDir := t.TempDir(), t.TempDir()
+	testZoneFile(t, primaryDir, 1, "a A 192.0.2.1\nb A 192.0.2.2")
+	primary, addr := testPrimary(t, primaryDir)
+	secondary := testSecondary(t, secondaryDir, addr)
+
+	if rcode, _ := testLookup(t, secondary, "a.example.com"); rcode != rcodeServFail {
+		t.Errorf("Expected SERVFAIL before the zone is transferred, got %v", rcode)
+	}
+	if err := secondary.RefreshZone("example.com."); err != nil {
+		t.Fatalf("Could not transfer zone: %v", err)
+	}
+	if rcode, addr := testLookup(t, secondary, "b.example.com"); rcode != rcodeNoError || addr != "192.0.2.2" {
+		t.Errorf("Wrong answer after the zone was transferred: %v %v", rcode, addr)
+	}
+
+	// The next refresh is incremental.
+	testZoneFile(t, primaryDir, 2, "a A 192.0.2.1\nb A 192.0.2.3")
+	if err := primary.LoadZones(); err != nil {
+		t.Fatalf("Could not reload primary zones: %v", err)
+	}
+	if err := secondary.RefreshZone("example.com."); err != nil {
+		t.Fatalf("Could not refresh zone: %v", err)
+	}
+	if rcode, addr := testLookup(t, secondary, "b.example.com"); rcode != rcodeNoError || addr != "192.0.2.3" {
+		t.Errorf("Wrong answer after the zone was refreshed: %v %v", rcode, addr)
+	}
+	zone, _ := findZone(secondary.Zones(), "example.com.")
+	if serial, _ := zone.Journal.Serial(); serial != 2 {
+		t.Errorf("Expected the secondary's journal to be at serial 2, got %v", serial)
+	}
+	if rcode, addr := testLookup(t, secondary, "a.example.com"); rcode != rcodeNoError || addr != "192.0.2.1" {
+		t.Errorf("Unchanged record was lost in the refresh: %v %v", rcode, addr)
+	}
+
+	// A restarted secondary serves its local copy straight away.
+	restarted := testSecondary(t, secondaryDir, addr)
+	if rcode, addr := testLookup(t, restarted, "b.example.com"); rcode != rcodeNoError || addr != "192.0.2.3" {
+		t.Errorf("Wrong answer from the local copy: %v %v", rcode, addr)
+	}
+
+	// Once the primary is unreachable for longer than the SOA expire interval, the zone expires.
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	ln.Close()
+	restarted = testSecondary(t, secondaryDir, ln.Addr().String())
+	restarted.secondaries["example.com."].expireAt = time.Now()
+	if err := restarted.RefreshZone("example.com."); err == nil {
+		t.Fatalf("Expected the refresh to fail")
+	}
+	if rcode, _ := testLookup(t, restarted, "b.example.com"); rcode != rcodeServFail {
+		t.Errorf("Expected SERVFAIL once the zone expired, got %v", rcode)
+	}
+}
+
+// TestSecondaryExpiry ensures a secondary zone loaded from its local copy expires the SOA expire interval after
+// the copy was last refreshed, even while it's waiting to retry a failed refresh.
+func TestSecondaryExpiry(t *testing.T) {
+	primaryDir, secondaryDir := t.TempDir(), t.TempDir()
+	testZoneFile(t, primaryDir, 1, "a A 192.0.2.1")
+	_, addr := testPrimary(t, primaryDir)
+	if err := testSecondary(t, secondaryDir, addr).RefreshZone("example.com."); err != nil {
+		t.Fatalf("Could not transfer zone: %v", err)
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	ln.Close()
+	copyFile := filepath.Join(secondaryDir, "example.zone.copy")
+	const expire = 604800 * time.Second // The SOA expire interval of testZoneFile.
+
+	// The copy was refreshed just over the expire interval ago, so it isn't loaded.
+	refreshed := time.Now().Add(-expire - time.Second)
+	if err := os.Chtimes(copyFile, refreshed, refreshed); err != nil {
+		t.Fatalf("Could not set the time of the local copy: %v", err)
+	}
+	secondary := testSecondary(t, secondaryDir, ln.Addr().String())
+	if rcode, _ := testLookup(t, secondary, "a.example.com"); rcode != rcodeServFail {
+		t.Errorf("Expected SERVFAIL for an expired local copy, got %v", rcode)
+	}
+
+	// The copy expires in two seconds. The refresh fails, and isn't retried for the SOA retry interval.
+	refreshed = time.Now().Add(-expire + 2*time.Second)
+	if err := os.Chtimes(copyFile, refreshed, refreshed); err != nil {
+		t.Fatalf("Could not set the time of the local copy: %v", err)
+	}
+	secondary = testSecondary(t, secondaryDir, ln.Addr().String())
+	if expireAt := secondary.secondaries["example.com."].expireAt; !expireAt.Equal(refreshed.Add(expire)) {
+		t.Errorf("Expected the zone to expire at %v, got %v", refreshed.Add(expire), expireAt)
+	}
+	if rcode, addr := testLookup(t, secondary, "a.example.com"); rcode != rcodeNoError || addr != "192.0.2.1" {
+		t.Errorf("Wrong answer from the local copy: %v %v", rcode, addr)
+	}
+	if err := secondary.RefreshZone("example.com."); err == nil {
+		t.Fatalf("Expected the refresh to fail")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go secondary.RunSecondaries(ctx)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if rcode, _ := testLookup(t, secondary, "a.example.com"); rcode == rcodeServFail {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Secondary didn't stop serving the zone once it expired")
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Sign returns a copy of the zone signed offline, to be served as it is without its private keys: its DNSSEC
+// records are replaced by DNSKEY records for ksks and zsks, NSEC or NSEC3 records as set by the zone's denial,
+// and RRSIG records valid from inception to expiration. The DNSKEY RRset is signed with the key signing keys,
+// and everything else with the zone signing keys, or the key signing keys if there are none (RFC 6781 section 3.1).
+func (z *Zone) Sign(ksks, zsks []*DNSSECKey, inception, expiration time.Time) (Zone, error) {
+	if len(ksks) == 0 {
+		return Zone{}, errors.New("At least one key signing key is needed to sign a zone")
+	}
+	if z.Denial == DenialCompact {
+		errStr := fmt.Sprintf("Zone %v uses compact denial, which needs the zone to be signed online", z.Name)
+		return Zone{}, errors.New(errStr)
+	}
+	if len(z.PTRFrom) > 0 {
+		errStr := fmt.Sprintf("Zone %v has PTR records made with ptr-from, which needs the zone to be signed online", z.Name)
+		return Zone{}, errors.New(errStr)
+	}
+	if z.hasALIAS() {
+		errStr := fmt.Sprintf("Zone %v has ALIAS records, which need the zone to be signed online", z.Name)
+		return Zone{}, errors.New(errStr)
+	}
+	soa, ok := z.NegativeSOA()
+	if !ok {
+		errStr := fmt.Sprintf("Zone %v has no SOA record to sign", z.Name)
+		return Zone{}, errors.New(errStr)
+	}
+	if len(zsks) == 0 {
+		zsks = ksks
+	}
+
+	// Insert the DNSKEY records, and NSEC3PARAM record if needed, by signing a copy online.
+	var rrs []RR
+	for rr := range z.All() {
+		if !slices.Contains(dnssecTypes, rr.Type) {
+			rrs = append(rrs, rr)
+		}
+	}
+	online := *z
+	online.DNSSECKeys = slices.Concat(ksks, zsks)
+	online.DNSSECKeyFiles = nil
+	signed, err := online.WithRecords(rrs)
+	if err != nil {
+		return Zone{}, err
+	}
+	signed.chain = newDenialChain(&signed)
+	var denial []RR
+	if signed.chain.nsec3 {
+		for i := range signed.chain.hashes {
+			denial = append(denial, signed.nsec3Record(i, soa.TTL))
+		}
+	} else {
+		for i := range signed.chain.names {
+			denial = append(denial, signed.nsecRecord(i, soa.TTL))
+		}
+	}
+	for _, rr := range denial {
+		if err := signed.InsertRR(rr); err != nil {
+			return Zone{}, err
+		}
+	}
+
+	var sigs []RR
+	for _, name := range slices.Sorted(maps.Keys(signed.Records)) {
+		rrset := signed.Records[name]
+		cut, isCut := signed.ZoneCut(name)
+		if isCut && cut != name {
+			continue // Glue isn't authoritative.
+		}
+		for _, t := range slices.Sorted(maps.Keys(rrset.RRSet)) {
+			if t == TypeRRSIG || isCut && t != TypeDS && t != TypeNSEC {
+				continue // Only the DS and NSEC records at a zone cut are authoritative.
+			}
+			keys := zsks
+			if t == TypeDNSKEY {
+				keys = ksks
+			}
+			for _, key := range keys {
+				owner := signed.AbsoluteName(name)
+				sig, data, err := rrsigFor(&signed, key, owner, rrset.RRSet[t])
+				if err != nil {
+					return Zone{}, err
+				}
+				if sig, err = key.signRRSIG(sig, data, inception, expiration); err != nil {
+					errStr := fmt.Sprintf("Could not sign %v %v with key %v: %v", owner, t, key.Tag, err)
+					return Zone{}, errors.New(errStr)
+				}
+				sig.TTL = rrset.RRSet[t][0].TTLOrDefault(signed)
+				sigs = append(sigs, sig.RR(owner))
+			}
+		}
+	}
+	for _, rr := range sigs {
+		if err := signed.InsertRR(rr); err != nil {
+			return Zone{}, err
+		}
+	}
+
+	// The signed zone has no keys, so it's served as it is.
+	signed.DNSSECKeys = nil
+	signed.Denial = DenialNSEC
+	signed.NSEC3Iterations = 0
+	signed.NSEC3Salt = nil
+	signed.chain = nil
+	return signed, nil
+}
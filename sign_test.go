@@ -0,0 +1,180 @@
+package dns
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPresignedServer signs example.com offline, with the given denial keyword line, and serves the signed zone
+// file. The zone signing key is returned with the server.
+func testPresignedServer(t *testing.T, denial string) (*Server, *DNSSECKey) {
+	dir := t.TempDir()
+	testZoneFile(t, dir, 1, denial+"\na A 192.0.2.1\nc A 192.0.2.3\n*.w A 192.0.2.2\n"+
+		"sub NS ns.sub.example.com.\nns.sub A 192.0.2.9\nsub DS 12345 15 2 ABCDEF")
+	zones, err := LoadZoneFiles(dir)
+	if err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+	zone := zones["example.com."]
+	ksk, err := GenerateDNSSECKey("ED25519")
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	key, err := GenerateDNSSECKey("ECDSAP256SHA256")
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	zsk, err := key.ZSK()
+	if err != nil {
+		t.Fatalf("Could not make a zone signing key: %v", err)
+	}
+	now := time.Now()
+	signed, err := zone.Sign([]*DNSSECKey{ksk}, []*DNSSECKey{zsk}, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Could not sign zone: %v", err)
+	}
+	if err := signed.WriteFile(); err != nil {
+		t.Fatalf("Could not write signed zone: %v", err)
+	}
+
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load signed zone: %v", err)
+	}
+	loaded, _ := findZone(server.Zones(), "example.com")
+	if !bytes.Equal(loaded.ZoneFile(), signed.ZoneFile()) {
+		t.Errorf("Signed zone changed when written and loaded again:\n%s\n%s", signed.ZoneFile(), loaded.ZoneFile())
+	}
+	return server, zsk
+}
+
+// TestSign ensures zones signed offline are served with their stored signatures and denial records, and that
+// DS records are served at zone cuts.
+func TestSign(t *testing.T) {
+	for _, test := range []struct {
+		denial string
+		rtype  RecType
+	}{
+		{"denial nsec", TypeNSEC},
+		{"denial nsec3 1 aabbccdd", TypeNSEC3},
+	} {
+		server, zsk := testPresignedServer(t, test.denial)
+
+		reply := testDNSSECQuery(t, server, "example.com", TypeDNSKEY)
+		dnskeys, sigs := testSplitRRSIGs(reply.Answer, TypeDNSKEY)
+		if len(dnskeys) != 2 || len(sigs) != 1 {
+			t.Fatalf("%v: expected 2 DNSKEY records signed by the key signing key, got %v", test.denial, reply.Answer)
+		}
+		testVerifyRRSIG(t, "example.com.", dnskeys, sigs[0], dnskeys)
+
+		tests := []struct {
+			name, owner Domain
+			labels      byte
+		}{
+			{"a.example.com", "a.example.com.", 3},
+			{"x.w.example.com", "*.w.example.com.", 3},
+		}
+		for _, name := range tests {
+			reply := testDNSSECQuery(t, server, name.name, TypeA)
+			rrset, sigs := testSplitRRSIGs(reply.Answer, TypeA)
+			if len(rrset) != 1 || len(sigs) != 1 || sigs[0].RData.KeyTag != zsk.Tag || sigs[0].RData.Labels != name.labels {
+				t.Errorf("%v: expected an A record signed by the zone signing key, got %v", name.name, reply.Answer)
+				continue
+			}
+			testVerifyRRSIG(t, name.owner, rrset, sigs[0], dnskeys)
+		}
+
+		reply = testDNSSECQuery(t, server, "b.example.com", TypeA)
+		if reply.Header.Rcode != rcodeNxdomain || len(testVerifyDenial(t, server, reply, test.rtype)) == 0 {
+			t.Errorf("%v: expected NXDOMAIN with signed %v records, got %+v", test.denial, test.rtype, reply)
+		}
+
+		reply = testDNSSECQuery(t, server, "sub.example.com", TypeDS)
+		ds, sigs := testSplitRRSIGs(reply.Answer, TypeDS)
+		if !reply.Header.AA || len(ds) != 1 || len(sigs) != 1 {
+			t.Fatalf("%v: expected an authoritative, signed DS answer, got %+v", test.denial, reply)
+		}
+		testVerifyRRSIG(t, "sub.example.com.", ds, sigs[0], dnskeys)
+
+		reply = testDNSSECQuery(t, server, "www.sub.example.com", TypeA)
+		ds, sigs = testSplitRRSIGs(reply.Authority, TypeDS)
+		if reply.Header.AA || len(ds) != 1 || len(sigs) != 1 {
+			t.Errorf("%v: expected a referral with a signed DS record, got %+v", test.denial, reply)
+		}
+	}
+}
+
+// TestDS ensures DS records are made as in the example of RFC 4509 section 2.3.
+func TestDS(t *testing.T) {
+	publicKey, _ := base64.StdEncoding.DecodeString("AQOeiiR0GOMYkDshWoSKz9XzfwJr1AYtsmx3TGkJaNXVbfi/2pHm822aJ5iI9BMz" +
+		"NXxeYCmZDRD99WYwYqUSdjMmmAphXdvxegXd/M5+X7OrzKBaMbCVdFLUUh6DhweJBjEVv5f2wwjM9XzcnOf+EPbtG9DMBmADjFDc2w/rljwvFw==")
+	key := &DNSSECKey{DNSKEY: RData{Type: TypeDNSKEY, Flags: 256, Protocol: 3, Algorithm: 5, PublicKey: publicKey}}
+	rdata, err := key.DNSKEY.appendTo(nil, nil)
+	if err != nil {
+		t.Fatalf("Could not serialise DNSKEY: %v", err)
+	}
+	key.Tag = keyTag(rdata)
+	ds, err := key.DS("dskey.example.com")
+	if err != nil {
+		t.Fatalf("Could not make DS record: %v", err)
+	}
+	if want := "60485 5 2 D4B7D520E7BB5F0F67674A0CCEB1E3E0614B93C4F9E99B8383F6A1E4469DA50A"; ds.DataString() != want {
+		t.Errorf("Expected DS record %v, got %v", want, ds.DataString())
+	}
+}
+
+// TestSignPTRFrom ensures zones with ptr-from aren't signed offline, as the PTR records it makes change without
+// being signed again, and that zone files signed offline can't have ptr-from.
+func TestSignPTRFrom(t *testing.T) {
+	zone, err := testParse("ptr-from example.net.\n@ NS ns.example.com.")
+	if err != nil {
+		t.Fatalf("Could not parse zone: %v", err)
+	}
+	ksk, err := GenerateDNSSECKey("ED25519")
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	now := time.Now()
+	if _, err := zone.Sign([]*DNSSECKey{ksk}, nil, now.Add(-time.Hour), now.Add(time.Hour)); err == nil {
+		t.Errorf("Expected a zone with ptr-from not to be signed offline")
+	}
+
+	server, _ := testPresignedServer(t, "denial nsec")
+	signed, _ := findZone(server.Zones(), "example.com")
+	contents := strings.Replace(string(signed.ZoneFile()), "\n", "\nptr-from example.net.\n", 1)
+	lexer := NewLexer(bufio.NewReader(strings.NewReader(contents)))
+	parser := NewParser(&lexer, "test.zone")
+	if _, err := parser.Parse(); err == nil {
+		t.Errorf("Expected a zone signed offline with ptr-from not to parse")
+	}
+}
+
+// TestSignALIAS ensures zones with ALIAS records aren't signed offline, as the addresses they give are looked up
+// when queried and so can't be signed ahead of time, and that zone files signed offline can't have ALIAS records.
+func TestSignALIAS(t *testing.T) {
+	zone, err := testParse("www ALIAS target.example.net.")
+	if err != nil {
+		t.Fatalf("Could not parse zone: %v", err)
+	}
+	ksk, err := GenerateDNSSECKey("ED25519")
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+	now := time.Now()
+	if _, err := zone.Sign([]*DNSSECKey{ksk}, nil, now.Add(-time.Hour), now.Add(time.Hour)); err == nil {
+		t.Errorf("Expected a zone with ALIAS records not to be signed offline")
+	}
+
+	server, _ := testPresignedServer(t, "denial nsec")
+	signed, _ := findZone(server.Zones(), "example.com")
+	contents := string(signed.ZoneFile()) + "www ALIAS target.example.net.\n"
+	lexer := NewLexer(bufio.NewReader(strings.NewReader(contents)))
+	parser := NewParser(&lexer, "test.zone")
+	if _, err := parser.Parse(); err == nil {
+		t.Errorf("Expected a zone signed offline with ALIAS records not to parse")
+	}
+}
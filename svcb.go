@@ -0,0 +1,267 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SvcParam is a service parameter of an SVCB or HTTPS record (RFC 9460 section 2.1), with its value in wire form.
+type SvcParam struct {
+	Key   uint16
+	Value []byte
+}
+
+// Keys of the service parameters we know the presentation format of (RFC 9460 section 14.3.2).
+const (
+	svcKeyMandatory     uint16 = 0
+	svcKeyALPN          uint16 = 1
+	svcKeyNoDefaultALPN uint16 = 2
+	svcKeyPort          uint16 = 3
+	svcKeyIPv4Hint      uint16 = 4
+	svcKeyECH           uint16 = 5
+	svcKeyIPv6Hint      uint16 = 6
+)
+
+var svcKeyNames = map[uint16]string{
+	svcKeyMandatory:     "mandatory",
+	svcKeyALPN:          "alpn",
+	svcKeyNoDefaultALPN: "no-default-alpn",
+	svcKeyPort:          "port",
+	svcKeyIPv4Hint:      "ipv4hint",
+	svcKeyECH:           "ech",
+	svcKeyIPv6Hint:      "ipv6hint",
+}
+
+// svcKeyString returns the name of key, or its generic keyNNNNN form if it has none.
+func svcKeyString(key uint16) string {
+	if name, ok := svcKeyNames[key]; ok {
+		return name
+	}
+	return fmt.Sprintf("key%v", key)
+}
+
+// parseSvcKey converts the name of a service parameter key, or its generic keyNNNNN form, to the key.
+func parseSvcKey(s string) (uint16, error) {
+	for key, name := range svcKeyNames {
+		if s == name {
+			return key, nil
+		}
+	}
+	if n, ok := strings.CutPrefix(s, "key"); ok {
+		if key, err := strconv.ParseUint(n, 10, 16); err == nil && key != 65535 {
+			return uint16(key), nil
+		}
+	}
+	errStr := fmt.Sprintf("Unknown SvcParam key %q", s)
+	return 0, errors.New(errStr)
+}
+
+// ParseSvcParam parses a service parameter in zone file form, e.g. alpn=h2,h3 or port=8443.
+// The values of generic keyNNNNN keys are taken as they are.
+func ParseSvcParam(s string) (SvcParam, error) {
+	name, value, hasValue := strings.Cut(s, "=")
+	key, err := parseSvcKey(name)
+	if err != nil {
+		return SvcParam{}, err
+	}
+	param := SvcParam{Key: key}
+	if key == svcKeyNoDefaultALPN {
+		if hasValue {
+			return param, errors.New("no-default-alpn doesn't take a value")
+		}
+		return param, nil
+	}
+	if !hasValue || (value == "" && key <= svcKeyIPv6Hint) {
+		errStr := fmt.Sprintf("SvcParam %v needs a value", name)
+		return param, errors.New(errStr)
+	}
+
+	list := strings.Split(value, ",")
+	switch key {
+	case svcKeyMandatory:
+		var keys []uint16
+		for _, name := range list {
+			key, err := parseSvcKey(name)
+			if err != nil {
+				return param, err
+			}
+			keys = append(keys, key)
+		}
+		slices.Sort(keys) // They're listed in increasing order on the wire.
+		for _, key := range keys {
+			param.Value = binary.BigEndian.AppendUint16(param.Value, key)
+		}
+	case svcKeyALPN:
+		for _, id := range list {
+			if len(id) == 0 || len(id) > 255 {
+				errStr := fmt.Sprintf("Invalid ALPN ID %q", id)
+				return param, errors.New(errStr)
+			}
+			param.Value = append(append(param.Value, byte(len(id))), id...)
+		}
+	case svcKeyPort:
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			errStr := fmt.Sprintf("Invalid port %q", value)
+			return param, errors.New(errStr)
+		}
+		param.Value = binary.BigEndian.AppendUint16(nil, uint16(port))
+	case svcKeyIPv4Hint, svcKeyIPv6Hint:
+		for _, s := range list {
+			addr, err := netip.ParseAddr(s)
+			if err != nil || addr.Is4() != (key == svcKeyIPv4Hint) || addr.Zone() != "" {
+				errStr := fmt.Sprintf("Invalid %v address %q", name, s)
+				return param, errors.New(errStr)
+			}
+			param.Value = append(param.Value, addr.AsSlice()...)
+		}
+	case svcKeyECH:
+		if param.Value, err = base64.StdEncoding.DecodeString(value); err != nil {
+			errStr := fmt.Sprintf("Invalid ech value: %v", err)
+			return param, errors.New(errStr)
+		}
+	default:
+		param.Value = []byte(value)
+	}
+	return param, nil
+}
+
+// String returns the parameter in zone file form, as read by ParseSvcParam.
+func (p SvcParam) String() string {
+	name := svcKeyString(p.Key)
+	var values []string
+	switch p.Key {
+	case svcKeyMandatory:
+		for i := 0; i+1 < len(p.Value); i += 2 {
+			values = append(values, svcKeyString(binary.BigEndian.Uint16(p.Value[i:])))
+		}
+	case svcKeyALPN:
+		for value := p.Value; len(value) > 0 && len(value) > int(value[0]); value = value[1+value[0]:] {
+			values = append(values, string(value[1:1+value[0]]))
+		}
+	case svcKeyNoDefaultALPN:
+		return name
+	case svcKeyPort:
+		if len(p.Value) == 2 {
+			values = append(values, strconv.Itoa(int(binary.BigEndian.Uint16(p.Value))))
+		}
+	case svcKeyIPv4Hint, svcKeyIPv6Hint:
+		size := 4
+		if p.Key == svcKeyIPv6Hint {
+			size = 16
+		}
+		for i := 0; i+size <= len(p.Value); i += size {
+			addr, _ := netip.AddrFromSlice(p.Value[i : i+size])
+			values = append(values, addr.String())
+		}
+	case svcKeyECH:
+		values = append(values, base64.StdEncoding.EncodeToString(p.Value))
+	default:
+		return name + "=" + quoteString(string(p.Value))
+	}
+	return name + "=" + strings.Join(values, ",")
+}
+
+// validateSvcParams checks params, the parameters of a record with the given priority, are in increasing key order
+// without duplicates, have valid values, and include every key listed as mandatory (RFC 9460 sections 2.2, 7, 8).
+func validateSvcParams(priority uint16, params []SvcParam) error {
+	if priority == 0 && len(params) > 0 {
+		return errors.New("AliasMode SVCB records (priority 0) can't have SvcParams")
+	}
+	keys := make([]uint16, len(params))
+	for i, param := range params {
+		if i > 0 && param.Key <= keys[i-1] {
+			return errors.New("SvcParams must be in increasing key order, without duplicates")
+		}
+		keys[i] = param.Key
+		if err := param.validate(); err != nil {
+			return err
+		}
+	}
+
+	if slices.Contains(keys, svcKeyNoDefaultALPN) && !slices.Contains(keys, svcKeyALPN) {
+		return errors.New("no-default-alpn needs an alpn SvcParam")
+	}
+
+	i, ok := slices.BinarySearch(keys, svcKeyMandatory)
+	if !ok {
+		return nil
+	}
+	mandatory := params[i].Value
+	for j := 0; j+1 < len(mandatory); j += 2 {
+		key := binary.BigEndian.Uint16(mandatory[j:])
+		switch {
+		case key == svcKeyMandatory:
+			return errors.New("mandatory can't list itself")
+		case j > 0 && key <= binary.BigEndian.Uint16(mandatory[j-2:]):
+			return errors.New("mandatory keys must be in increasing order, without duplicates")
+		case !slices.Contains(keys, key):
+			errStr := fmt.Sprintf("Mandatory SvcParam %v is missing", svcKeyString(key))
+			return errors.New(errStr)
+		}
+	}
+	return nil
+}
+
+// validate checks the wire form of the parameter's value is valid for its key.
+func (p SvcParam) validate() error {
+	var valid bool
+	switch p.Key {
+	case svcKeyMandatory:
+		valid = len(p.Value) > 0 && len(p.Value)%2 == 0
+	case svcKeyALPN:
+		value := p.Value
+		for len(value) > 0 && value[0] > 0 && len(value) > int(value[0]) {
+			value = value[1+value[0]:]
+		}
+		valid = len(p.Value) > 0 && len(value) == 0
+	case svcKeyNoDefaultALPN:
+		valid = len(p.Value) == 0
+	case svcKeyPort:
+		valid = len(p.Value) == 2
+	case svcKeyIPv4Hint:
+		valid = len(p.Value) > 0 && len(p.Value)%4 == 0
+	case svcKeyIPv6Hint:
+		valid = len(p.Value) > 0 && len(p.Value)%16 == 0
+	default:
+		valid = p.Key != 65535 // The invalid key (RFC 9460 section 14.3.1).
+	}
+	if !valid {
+		errStr := fmt.Sprintf("Invalid value for SvcParam %v", svcKeyString(p.Key))
+		return errors.New(errStr)
+	}
+	return nil
+}
+
+// appendSvcParams appends the wire form of params to payload.
+func appendSvcParams(payload []byte, params []SvcParam) []byte {
+	for _, param := range params {
+		payload = binary.BigEndian.AppendUint16(payload, param.Key)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(param.Value)))
+		payload = append(payload, param.Value...)
+	}
+	return payload
+}
+
+// parseSvcParams parses the SvcParams at the end of the RDATA of an SVCB or HTTPS record.
+func parseSvcParams(buf []byte) ([]SvcParam, error) {
+	var params []SvcParam
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, errors.New("SvcParam is too short")
+		}
+		key, length := binary.BigEndian.Uint16(buf), int(binary.BigEndian.Uint16(buf[2:]))
+		if len(buf) < 4+length {
+			return nil, errors.New("SvcParam value is too long for the RDATA")
+		}
+		params = append(params, SvcParam{Key: key, Value: slices.Clone(buf[4 : 4+length])})
+		buf = buf[4+length:]
+	}
+	return params, nil
+}
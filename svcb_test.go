@@ -0,0 +1,61 @@
+package dns
+
+import (
+	"testing"
+)
+
+// TestSVCB ensures SVCB and HTTPS records are read from zone files with their parameters in key order, are
+// served with the addresses of their targets, and that AliasMode records can be at the apex.
+func TestSVCB(t *testing.T) {
+	dir := t.TempDir()
+	testZoneFile(t, dir, 1, "@ HTTPS 0 lb.example.net.\n"+
+		"www HTTPS 1 . port=8443 alpn=h2,h3 ech=AEX+DQ== ipv6hint=2001:db8::1 ipv4hint=192.0.2.1,192.0.2.2 mandatory=port,alpn\n"+
+		"www A 192.0.2.1\n"+
+		"_8443._api SVCB 2 api key667=\"hello world\" no-default-alpn alpn=h3\napi AAAA 2001:db8::2")
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+
+	tests := []struct {
+		name       Domain
+		rtype      RecType
+		data       string
+		additional string
+	}{
+		{"example.com", TypeHTTPS, "0 lb.example.net.", ""},
+		{"www.example.com", TypeHTTPS, "1 . mandatory=alpn,port alpn=h2,h3 port=8443 ipv4hint=192.0.2.1,192.0.2.2 " +
+			"ech=AEX+DQ== ipv6hint=2001:db8::1", "www.example.com"},
+		{"_8443._api.example.com", TypeSVCB, `2 api.example.com. alpn=h3 no-default-alpn key667="hello world"`, "api.example.com"},
+	}
+	for _, test := range tests {
+		reply := testRespond(t, server, testQuery(test.name, test.rtype))
+		if len(reply.Answer) != 1 || reply.Answer[0].RData.DataString() != test.data {
+			t.Errorf("Expected %v %v record %q, got %v", test.name, test.rtype, test.data, reply.Answer)
+			continue
+		}
+		if test.additional == "" && len(reply.Additional) > 0 ||
+			test.additional != "" && (len(reply.Additional) != 1 || reply.Additional[0].Name.String() != test.additional) {
+			t.Errorf("%v: expected the addresses of %q in the additional section, got %v", test.name, test.additional, reply.Additional)
+		}
+	}
+
+	for desc, line := range map[string]string{
+		"missing mandatory key":  "www HTTPS 1 . mandatory=alpn port=443",
+		"mandatory lists itself": "www HTTPS 1 . mandatory=mandatory",
+		"duplicate key":          "www HTTPS 1 . port=443 port=8443",
+		"AliasMode params":       "www HTTPS 0 lb.example.net. alpn=h2",
+		"no-default-alpn alone":  "www HTTPS 1 . no-default-alpn",
+		"bad ipv4hint":           "www HTTPS 1 . ipv4hint=2001:db8::1",
+	} {
+		testZoneFile(t, dir, 1, line)
+		if _, err := LoadZoneFiles(dir); err == nil {
+			t.Errorf("%v: expected %q not to load", desc, line)
+		}
+	}
+
+	params := []SvcParam{{Key: svcKeyPort, Value: []byte{0, 80}}, {Key: svcKeyALPN, Value: []byte{2, 'h', '2'}}}
+	if err := validateSvcParams(1, params); err == nil {
+		t.Errorf("Expected SvcParams out of key order to be invalid")
+	}
+}
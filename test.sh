@@ -2,4 +2,4 @@
 
 go fmt
 go test -v
-go run . -zones zones -logLevel debug -listen '[::]:1053'
+go run ./cmd/dns -zones zones -logLevel debug -listen '[::]:1053'
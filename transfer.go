@@ -0,0 +1,152 @@
+package dns
+
+import (
+	"iter"
+	"math"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// transferMsgSize is the size, before compression, that zone transfer messages are filled up to.
+// An RR which would take a message over it goes in the next one, so only a message of a single large RR is bigger.
+const transferMsgSize = 16384
+
+// TransferZone answers an AXFR query (RFC 5936), streaming the whole zone to the client with send.
+// Only clients in the zone's allow-transfer ACL may transfer it, everyone else is REFUSED.
+func (s *Server) TransferZone(query DNSMsg, client Client, logHead string, send func([]byte) error) error {
+	zone, soa, rcode := s.transferSource(query, client, logHead)
+	if rcode != rcodeNoError {
+		return send(errReply(query, rcode, logHead))
+	}
+	log.Infof("%v Transferring zone %v", logHead, zone.Name)
+	return streamRRs(query, axfrRRs(zone, soa), logHead, send)
+}
+
+// IncrementalTransfer answers an IXFR query (RFC 1995) with the changes to the zone since the version the client
+// has, from the zone's journal. If the journal doesn't go back that far, the whole zone is sent like AXFR.
+// Over UDP, clients which aren't up to date are only sent our SOA record, so they retry over TCP.
+func (s *Server) IncrementalTransfer(query DNSMsg, client Client, logHead string, send func([]byte) error) error {
+	zone, soa, rcode := s.transferSource(query, client, logHead)
+	if rcode != rcodeNoError {
+		return send(errReply(query, rcode, logHead))
+	}
+	if len(query.Authority) != 1 || query.Authority[0].Type != TypeSOA {
+		log.Infof("%v [FORMERR] IXFR query without the client's SOA record", logHead)
+		return send(errReply(query, rcodeFormErr, logHead))
+	}
+	serial := query.Authority[0].RData.Serial
+	soaRR := zone.RR(soa, zone.Name)
+	only := func(yield func(RR) bool) { yield(soaRR) }
+
+	if !serialLess(serial, soa.Serial) {
+		log.Infof("%v Client is up to date with zone %v at serial %v", logHead, zone.Name, soa.Serial)
+		return streamRRs(query, only, logHead, send)
+	}
+	if !client.TCP {
+		log.Infof("%v Client at serial %v of zone %v should retry over TCP", logHead, serial, zone.Name)
+		return streamRRs(query, only, logHead, send)
+	}
+	diffs, ok := zone.Journal.Since(serial)
+	if !ok {
+		log.Infof("%v No journal for zone %v from serial %v, transferring the whole zone", logHead, zone.Name, serial)
+		return streamRRs(query, axfrRRs(zone, soa), logHead, send)
+	}
+
+	log.Infof("%v Transferring changes to zone %v from serial %v to %v", logHead, zone.Name, serial, soa.Serial)
+	diff := CondenseDiffs(diffs)
+	records := func(yield func(RR) bool) {
+		for _, rrs := range [][]RR{{soaRR, diff.OldSOA}, diff.Deleted, {diff.NewSOA}, diff.Added, {soaRR}} {
+			for _, rr := range rrs {
+				if !yield(rr) {
+					return
+				}
+			}
+		}
+	}
+	return streamRRs(query, records, logHead, send)
+}
+
+// transferSource finds the zone and SOA record for a zone transfer query. If the zone can't be transferred to
+// client, the returned rcode is that of the error reply.
+func (s *Server) transferSource(query DNSMsg, client Client, logHead string) (zone *Zone, soa RData, rcode byte) {
+	q := query.Question[0]
+	zone, ok := findZone(s.Zones(), q.Name)
+	if !ok || queryStr(zone, q.Name) != "" {
+		log.Infof("%v [REFUSED] Not authoritative for a zone with this name", logHead)
+		return nil, soa, rcodeRefused
+	}
+	if !zone.AllowTransfer.Allows(client) {
+		log.Warnf("%v [REFUSED] Client may not transfer zone %v", logHead, zone.Name)
+		return nil, soa, rcodeRefused
+	}
+	soa, ok = zone.SOA()
+	if !ok {
+		log.Errorf("%v [SERVFAIL] Zone %v has no SOA record, so can't be transferred", logHead, zone.Name)
+		return nil, soa, rcodeServFail
+	}
+	return zone, soa, rcodeNoError
+}
+
+// axfrRRs yields every record of zone in AXFR order: the SOA record soa, all the other records, then soa again.
+func axfrRRs(zone *Zone, soa RData) iter.Seq[RR] {
+	soaRR := zone.RR(soa, zone.Name)
+	return func(yield func(RR) bool) {
+		if !yield(soaRR) {
+			return
+		}
+		for rr := range zone.All() {
+			if rr.Type == TypeSOA {
+				continue
+			}
+			if !yield(rr) {
+				return
+			}
+		}
+		yield(soaRR)
+	}
+}
+
+// streamRRs sends a reply to query with the records rrs in the answer section, split over as many
+// messages as are needed. Only the first message repeats the question.
+func streamRRs(query DNSMsg, rrs iter.Seq[RR], logHead string, send func([]byte) error) error {
+	msg := NewDNSMsg(query)
+	size := 12 // The header
+	for _, q := range msg.Question {
+		size += len(q.Serialise())
+	}
+	flush := func() error {
+		payload, err := msg.Serialise()
+		if err != nil {
+			log.Errorf("%v Could not serialise zone transfer message: %v", logHead, err)
+			return send(errReply(query, rcodeServFail, logHead))
+		}
+		msg = NewDNSMsg(query)
+		msg.Question = nil
+		size = 12
+		return send(payload)
+	}
+
+	for rr := range rrs {
+		bin, err := rr.Serialise()
+		if err != nil {
+			log.Errorf("%v Could not serialise zone transfer record: %v", logHead, err)
+			return send(errReply(query, rcodeServFail, logHead))
+		}
+		if len(msg.Answer) > 0 && size+len(bin) > transferMsgSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		// Compression only makes the message smaller, so if it fits now, it fits once serialised.
+		if size+len(bin) > math.MaxUint16 {
+			log.Errorf("%v Zone transfer record %v %v is too large for a message", logHead, rr.Name, rr.Type)
+			return send(errReply(query, rcodeServFail, logHead))
+		}
+		msg.Answer = append(msg.Answer, rr)
+		size += len(bin)
+	}
+	if len(msg.Answer) > 0 {
+		return flush()
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// testTransfer sends query to server over TCP from addr, and returns the parsed replies.
+func testTransfer(t *testing.T, server *Server, query DNSMsg, addr string) []DNSMsg {
+	payload, err := query.Serialise()
+	if err != nil {
+		t.Fatalf("Could not serialise query: %v", err)
+	}
+	client := Client{Addr: netip.AddrPortFrom(netip.MustParseAddr(addr), 5353), TCP: true}
+	var replies []DNSMsg
+	err = server.RespondStream(payload, client, "[test]", func(response []byte) error {
+		reply, err := ParseDNSMsg(response)
+		if err != nil {
+			t.Fatalf("Could not parse reply: %v", err)
+		}
+		replies = append(replies, reply)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not send reply: %v", err)
+	}
+	return replies
+}
+
+func testTransferZone(t *testing.T) Zone {
+	zone := testZone(t, "example.com.",
+		RData{Name: "@", Type: TypeSOA, MName: "ns.example.com.", RName: "hostmaster.example.com.", Serial: 1, Minimum: 60},
+		RData{Name: "@", Type: TypeNS, Target: "ns.example.com."},
+		RData{Name: "ns", Type: TypeA, Addr: netip.MustParseAddr("192.0.2.1")},
+	)
+	// Enough TXT records to need more than one message.
+	for i := range 200 {
+		txt := RData{Name: RecordName(fmt.Sprintf("txt%v", i)), Type: TypeTXT, TXT: NewTXTData(string(make([]byte, 200)))}
+		if err := zone.Insert(txt); err != nil {
+			t.Fatalf("Could not insert %+v into zone: %v", txt, err)
+		}
+	}
+	zone.AllowTransfer = ACL{{Prefix: netip.MustParsePrefix("192.0.2.0/24")}}
+	return zone
+}
+
+// TestAXFR ensures a zone is transferred whole, starting and ending with its SOA, to allowed clients only.
+func TestAXFR(t *testing.T) {
+	server := NewServer(testZoneTrie(t, testTransferZone(t)), Config{})
+	query := testQuery("example.com", TypeAXFR)
+
+	replies := testTransfer(t, server, query, "192.0.2.10")
+	if len(replies) < 2 {
+		t.Fatalf("Expected the transfer to span several messages, got %v", len(replies))
+	}
+	var answers []RR
+	for i, reply := range replies {
+		if reply.Header.Rcode != rcodeNoError || reply.Header.ID != query.Header.ID {
+			t.Errorf("Bad reply header in message %v: %+v", i, reply.Header)
+		}
+		if (i == 0) != (len(reply.Question) == 1) {
+			t.Errorf("Only the first message should have the question, message %v has %v", i, reply.Question)
+		}
+		answers = append(answers, reply.Answer...)
+	}
+	if first, last := answers[0], answers[len(answers)-1]; first.Type != TypeSOA || last.Type != TypeSOA {
+		t.Errorf("Transfer should start and end with the SOA, got %v and %v", first.Type, last.Type)
+	}
+	if len(answers) != 204 {
+		t.Errorf("Expected 204 records (all 203, with the SOA twice), got %v", len(answers))
+	}
+
+	replies = testTransfer(t, server, query, "198.51.100.1")
+	if len(replies) != 1 || replies[0].Header.Rcode != rcodeRefused {
+		t.Errorf("Expected a single REFUSED reply for a client outside the ACL, got %+v", replies)
+	}
+
+	replies = testTransfer(t, server, testQuery("ns.example.com", TypeAXFR), "192.0.2.10")
+	if len(replies) != 1 || replies[0].Header.Rcode != rcodeRefused {
+		t.Errorf("Expected a single REFUSED reply for a name below the apex, got %+v", replies)
+	}
+
+	reply := testRespond(t, server, query)
+	if reply.Header.Rcode != rcodeNotImplemented {
+		t.Errorf("Expected NOTIMP for AXFR over UDP, got %v", reply.Header.Rcode)
+	}
+}
+
+// TestAXFRMessageSize ensures an RR which would take a transfer message over transferMsgSize starts the next
+// message, so no message is too large to send, and that an RR too large for any message gives SERVFAIL.
+func TestAXFRMessageSize(t *testing.T) {
+	zone := testTransferZone(t)
+	// Just under transferMsgSize of TXT records, and then one which nearly fills a message by itself.
+	for i := range 15 {
+		txt := RData{Name: "big", Type: TypeTXT, TXT: NewTXTData(fmt.Sprintf("%v%v", i, strings.Repeat("x", 1000)))}
+		if err := zone.Insert(txt); err != nil {
+			t.Fatalf("Could not insert %+v into zone: %v", txt, err)
+		}
+	}
+	huge := RData{Name: "huge", Type: TypeTXT, TXT: NewTXTData(strings.Repeat("x", 60000))}
+	if err := zone.Insert(huge); err != nil {
+		t.Fatalf("Could not insert %+v into zone: %v", huge, err)
+	}
+	server := NewServer(testZoneTrie(t, zone), Config{})
+	query := testQuery("example.com", TypeAXFR)
+	payload, err := query.Serialise()
+	if err != nil {
+		t.Fatalf("Could not serialise query: %v", err)
+	}
+	client := Client{Addr: netip.MustParseAddrPort("192.0.2.10:5353"), TCP: true}
+
+	answers := 0
+	err = server.RespondStream(payload, client, "[test]", func(response []byte) error {
+		reply, err := ParseDNSMsg(response)
+		if err != nil {
+			t.Fatalf("Could not parse reply: %v", err)
+		}
+		if len(response) > math.MaxUint16 || len(reply.Answer) > 1 && len(response) > transferMsgSize {
+			t.Errorf("Message of %v RRs is too large: %v bytes", len(reply.Answer), len(response))
+		}
+		answers += len(reply.Answer)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Could not send reply: %v", err)
+	}
+	if answers != 204+16 {
+		t.Errorf("Expected %v records, got %v", 204+16, answers)
+	}
+
+	opaque := RData{Name: "opaque", Type: RecType(65280), Data: make([]byte, math.MaxUint16)}
+	if err := zone.Insert(opaque); err != nil {
+		t.Fatalf("Could not insert %+v into zone: %v", opaque, err)
+	}
+	server = NewServer(testZoneTrie(t, zone), Config{})
+	replies := testTransfer(t, server, query, "192.0.2.10")
+	if last := replies[len(replies)-1]; last.Header.Rcode != rcodeServFail {
+		t.Errorf("Expected SERVFAIL for an RR too large for a message, got %+v", last.Header)
+	}
+}
@@ -1,6 +1,9 @@
-package main
+package dns
 
-import "strings"
+import (
+	"iter"
+	"strings"
+)
 
 // Trie is a trie data structure for domain names, to retrieve a zone or DNS records from a domain name.
 // Children of the tree root will be the domain TLDs, com, biz, etc...
@@ -27,24 +30,29 @@ func newTrieNode[T any]() trieNode[T] {
 }
 
 // labelsFor will split a domain into it constituent labels. E.g. ["example", "com"]
+// The empty key has no labels, and refers to the root of the trie.
 func labelsFor(domain string) []string {
+	if domain == "" {
+		return nil
+	}
 	return strings.Split(string(domain), ".")
 }
 
 // findNode will return a pointer to the trieNode for the given key.
-// If it does not exist, the deepest match will be retuned, and the returned bool will be false.
-// If an exact match is returned, the bool will be true.
-func (t *Trie[T]) findNode(key string) (*trieNode[T], bool) {
+// If it does not exist, the deepest match will be retuned.
+// matched is the number of labels of key, counted from the right, which the returned node matches.
+func (t *Trie[T]) findNode(key string) (node *trieNode[T], matched int) {
 	labels := labelsFor(key)
-	node := &t.root
+	node = &t.root
 	for i := len(labels) - 1; i >= 0; i-- {
 		child := node.children[labels[i]]
 		if child == nil {
-			return node, false
+			return node, matched
 		}
 		node = child
+		matched++
 	}
-	return node, true
+	return node, matched
 }
 
 // findCreateNode will return a pointer for the node keyed by key.
@@ -72,10 +80,31 @@ func (t *Trie[T]) Insert(key string, value T) {
 }
 
 // Search will return a pointer to the value for the given key, and a boolean indicating whether the node exists.
-// If the node does not exist, the bool will be false and the deepest match will be returned, starting from the root.
+// If the node does not exist or has no value, the bool will be false and the value of its deepest ancestor with a
+// value will be returned, falling back to the root.
 func (t *Trie[T]) Search(key string) (*T, bool) {
-	node, exists := t.findNode(key)
-	return &node.value, exists
+	labels := labelsFor(key)
+	node := &t.root
+	match := node
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = node.children[labels[i]]
+		if node == nil {
+			return &match.value, false
+		}
+		if node.hasValue {
+			match = node
+		}
+	}
+	return &match.value, match == node
+}
+
+// Closest will return the key of the deepest node which exists on the path to the given key, whether it has a
+// value or not. The returned bool will be true if that is the node for key itself.
+// For example, if only a.b.c has been inserted, Closest("x.b.c") returns "b.c".
+func (t *Trie[T]) Closest(key string) (string, bool) {
+	labels := labelsFor(key)
+	_, matched := t.findNode(key)
+	return strings.Join(labels[len(labels)-matched:], "."), matched == len(labels)
 }
 
 // Upsert will find or create the exact node for the given key,
@@ -91,3 +120,30 @@ func (t *Trie[T]) Upsert(key string, fn func(val *T, hasValue bool) error) error
 	}
 	return err
 }
+
+// All is an iterator over the key and a pointer to the value of every node with a value, in no particular order.
+func (t *Trie[T]) All() iter.Seq2[string, *T] {
+	return func(yield func(string, *T) bool) {
+		t.root.walk(nil, yield)
+	}
+}
+
+// walk calls yield for n and every node below it with a value, until yield returns false.
+// labels are the labels of n, from the root down. The return value is false if iteration was stopped.
+func (n *trieNode[T]) walk(labels []string, yield func(string, *T) bool) bool {
+	if n.hasValue {
+		key := make([]string, len(labels))
+		for i, label := range labels {
+			key[len(labels)-1-i] = label
+		}
+		if !yield(strings.Join(key, "."), &n.value) {
+			return false
+		}
+	}
+	for label, child := range n.children {
+		if !child.walk(append(labels, label), yield) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,4 +1,4 @@
-package main
+package dns
 
 import "testing"
 
@@ -79,3 +79,46 @@ func TestZoneTrieEmptyKey(t *testing.T) {
 		t.Errorf("Root node exists but it did not contain the inserted zone")
 	}
 }
+
+// TestTrieClosest ensures we find the deepest existing node on the path to a key, including nodes without values.
+func TestTrieClosest(t *testing.T) {
+	trie := NewTrie[string]()
+	trie.Insert("a.b.c", "abc")
+
+	tests := []struct {
+		key     string
+		closest string
+		exact   bool
+	}{
+		{"a.b.c", "a.b.c", true},
+		{"b.c", "b.c", true}, // No value, but it exists as a parent of a.b.c
+		{"x.b.c", "b.c", false},
+		{"y.x.a.b.c", "a.b.c", false},
+		{"x.y", "", false},
+		{"", "", true},
+	}
+	for _, test := range tests {
+		closest, exact := trie.Closest(test.key)
+		if closest != test.closest || exact != test.exact {
+			t.Errorf("Closest(%q): expected (%q, %v), got (%q, %v)", test.key, test.closest, test.exact, closest, exact)
+		}
+	}
+}
+
+func TestTrieAll(t *testing.T) {
+	trie := NewTrie[string]()
+	keys := []string{"a.b.c", "x.b.c", "c", "d"}
+	for _, key := range keys {
+		trie.Insert(key, key)
+	}
+	found := make(map[string]bool)
+	for key, val := range trie.All() {
+		if key != *val {
+			t.Errorf("Key %q has value %q", key, *val)
+		}
+		found[key] = true
+	}
+	if len(found) != len(keys) {
+		t.Errorf("Expected keys %v, got %v", keys, found)
+	}
+}
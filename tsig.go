@@ -0,0 +1,405 @@
+package dns
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// tsigFudge is the clock skew, in seconds, we allow for in the messages we sign.
+	tsigFudge = 300
+	// tsigMaxUnsigned is how many replies in a row may be unsigned in a signed stream such as a zone transfer.
+	tsigMaxUnsigned = 99
+	// TSIG errors (RFC 8945 section 3), given in the TSIG record of a NOTAUTH reply.
+	tsigBadSig  uint16 = 16 // The MAC doesn't match.
+	tsigBadKey  uint16 = 17 // The key is unknown, or uses another algorithm.
+	tsigBadTime uint16 = 18 // The message was signed too long ago, or in the future.
+)
+
+// tsigAlgorithms are the hash functions of the HMAC algorithms we support, by algorithm name.
+var tsigAlgorithms = map[Domain]func() hash.Hash{
+	"hmac-sha256.": sha256.New,
+	"hmac-sha512.": sha512.New,
+}
+
+var tsigErrorNames = map[uint16]string{
+	tsigBadSig:  "BADSIG",
+	tsigBadKey:  "BADKEY",
+	tsigBadTime: "BADTIME",
+}
+
+// TSIGKey is a secret shared with another server or client to sign messages with (RFC 8945).
+type TSIGKey struct {
+	Name      Domain // Lowercase FQDN.
+	Algorithm Domain // Lowercase FQDN, e.g. "hmac-sha256.".
+	Secret    []byte
+}
+
+// TSIG holds the contents of a TSIG record, which signs the message it's the last record of.
+type TSIG struct {
+	KeyName    Domain
+	Algorithm  Domain
+	TimeSigned uint64 // Seconds since the epoch, 48 bits.
+	Fudge      uint16 // Seconds of clock skew allowed for.
+	MAC        []byte
+	OrigID     uint16 // Message ID the message was signed with.
+	Error      uint16
+	OtherData  []byte
+	offset     uint // Where the TSIG record starts in the message it was parsed from.
+}
+
+// LoadKeys will read TSIG keys from the key file at path. Each line of the file is a key:
+// <name> <algorithm> <base64 secret>
+// The algorithm is hmac-sha256 or hmac-sha512. Comments start with ";".
+// Secrets can be generated with e.g. "openssl rand -base64 32".
+func LoadKeys(path string) (map[Domain]*TSIGKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keys := make(map[Domain]*TSIGKey)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			errStr := fmt.Sprintf("%v:%v Expected a key name, algorithm and secret", path, line)
+			return nil, errors.New(errStr)
+		}
+		name := Domain(strings.ToLower(fields[0]))
+		if !name.Valid() {
+			errStr := fmt.Sprintf("%v:%v Invalid key name: %v", path, line, fields[0])
+			return nil, errors.New(errStr)
+		}
+		key := &TSIGKey{Name: name.AsFQDN(), Algorithm: Domain(strings.ToLower(fields[1])).AsFQDN()}
+		if _, ok := tsigAlgorithms[key.Algorithm]; !ok {
+			errStr := fmt.Sprintf("%v:%v Unsupported algorithm: %v", path, line, fields[1])
+			return nil, errors.New(errStr)
+		}
+		if key.Secret, err = base64.StdEncoding.DecodeString(fields[2]); err != nil || len(key.Secret) == 0 {
+			errStr := fmt.Sprintf("%v:%v Invalid base64 secret for key %v", path, line, key.Name)
+			return nil, errors.New(errStr)
+		}
+		if _, ok := keys[key.Name]; ok {
+			errStr := fmt.Sprintf("%v:%v Key %v is defined more than once", path, line, key.Name)
+			return nil, errors.New(errStr)
+		}
+		keys[key.Name] = key
+	}
+	return keys, scanner.Err()
+}
+
+// parseTSIG parses the RR at msg[offset] if it's a TSIG record. tsig is nil if the RR is of any other type, in
+// which case it's left for parseRR.
+func parseTSIG(msg []byte, offset uint) (tsig *TSIG, next uint, err error) {
+	name, next, err := parseName(msg, offset)
+	if err != nil || uint(len(msg)) < next+10 || RecType(binary.BigEndian.Uint16(msg[next:])) != TypeTSIG {
+		return nil, offset, nil
+	}
+	if QClass(binary.BigEndian.Uint16(msg[next+2:])) != QClassANY {
+		return nil, offset, errors.New("TSIG record doesn't have class ANY")
+	}
+	rdLen := uint(binary.BigEndian.Uint16(msg[next+8:]))
+	start, end := next+10, next+10+rdLen
+	if uint(len(msg)) < end {
+		return nil, offset, errors.New("TSIG record is too small")
+	}
+
+	tsig = &TSIG{KeyName: Domain(strings.ToLower(name.AsFQDN().String())), offset: offset}
+	algorithm, pos, err := parseName(msg[:end], start)
+	if err != nil {
+		return nil, offset, err
+	}
+	tsig.Algorithm = Domain(strings.ToLower(algorithm.AsFQDN().String()))
+	fixed := msg[pos:end]
+	if len(fixed) < 10 {
+		return nil, offset, errors.New("TSIG record is too small")
+	}
+	tsig.TimeSigned = uint64(binary.BigEndian.Uint16(fixed))<<32 | uint64(binary.BigEndian.Uint32(fixed[2:]))
+	tsig.Fudge = binary.BigEndian.Uint16(fixed[6:])
+	macSize := int(binary.BigEndian.Uint16(fixed[8:]))
+	fixed = fixed[10:]
+	if len(fixed) < macSize+6 {
+		return nil, offset, errors.New("TSIG record is too small for its MAC")
+	}
+	tsig.MAC = slices.Clone(fixed[:macSize])
+	fixed = fixed[macSize:]
+	tsig.OrigID = binary.BigEndian.Uint16(fixed)
+	tsig.Error = binary.BigEndian.Uint16(fixed[2:])
+	otherLen := int(binary.BigEndian.Uint16(fixed[4:]))
+	if len(fixed) != otherLen+6 {
+		return nil, offset, errors.New("TSIG record has the wrong length for its other data")
+	}
+	tsig.OtherData = slices.Clone(fixed[6:])
+	return tsig, end, nil
+}
+
+// appendTSIG will append the TSIG record t to the serialised message msg, counting it in the header.
+func appendTSIG(msg []byte, t *TSIG) []byte {
+	msg = append(msg, serialiseName(t.KeyName)...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(TypeTSIG))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(QClassANY))
+	msg = binary.BigEndian.AppendUint32(msg, 0)
+	lenOffset := len(msg)
+	msg = append(msg, 0, 0) // RDLENGTH, filled in once the RDATA has been written.
+	msg = append(msg, serialiseName(t.Algorithm)...)
+	msg = appendTSIGTime(msg, t)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(t.MAC)))
+	msg = append(msg, t.MAC...)
+	msg = binary.BigEndian.AppendUint16(msg, t.OrigID)
+	msg = binary.BigEndian.AppendUint16(msg, t.Error)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(t.OtherData)))
+	msg = append(msg, t.OtherData...)
+	binary.BigEndian.PutUint16(msg[lenOffset:], uint16(len(msg)-lenOffset-2))
+	binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:])+1) // ARCOUNT
+	return msg
+}
+
+// appendTSIGTime appends the timers of t, the time signed and fudge, to buf.
+func appendTSIGTime(buf []byte, t *TSIG) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(t.TimeSigned>>32))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(t.TimeSigned))
+	return binary.BigEndian.AppendUint16(buf, t.Fudge)
+}
+
+// stripTSIG returns the message msg, which has the TSIG record t, as it was before it was signed: without the
+// TSIG record, and with its original ID.
+func stripTSIG(msg []byte, t *TSIG) []byte {
+	stripped := slices.Clone(msg[:t.offset])
+	binary.BigEndian.PutUint16(stripped, t.OrigID)
+	binary.BigEndian.PutUint16(stripped[10:], binary.BigEndian.Uint16(stripped[10:])-1) // ARCOUNT
+	return stripped
+}
+
+// mac returns the MAC of data, one or more messages without their TSIG records, signed by the TSIG record t.
+// prior is the MAC of the request or previous reply the messages follow, or nil for a request. If timersOnly,
+// only the timers of t are signed rather than all of its variables, as in the later replies of a stream.
+func (k *TSIGKey) mac(prior, data []byte, t *TSIG, timersOnly bool) []byte {
+	h := hmac.New(tsigAlgorithms[k.Algorithm], k.Secret)
+	if prior != nil {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(prior))))
+		h.Write(prior)
+	}
+	h.Write(data)
+	var vars []byte
+	if !timersOnly {
+		vars = append(vars, serialiseName(k.Name)...)
+		vars = binary.BigEndian.AppendUint16(vars, uint16(QClassANY))
+		vars = binary.BigEndian.AppendUint32(vars, 0) // TTL
+		vars = append(vars, serialiseName(k.Algorithm)...)
+	}
+	vars = appendTSIGTime(vars, t)
+	if !timersOnly {
+		vars = binary.BigEndian.AppendUint16(vars, t.Error)
+		vars = binary.BigEndian.AppendUint16(vars, uint16(len(t.OtherData)))
+		vars = append(vars, t.OtherData...)
+	}
+	h.Write(vars)
+	return h.Sum(nil)
+}
+
+// sign will sign the serialised message msg with the key, returning the message with the TSIG record t appended,
+// and the MAC. t only needs its time signed, error and other data set. prior and timersOnly are as for mac.
+func (k *TSIGKey) sign(msg, prior []byte, timersOnly bool, t TSIG) (signed, mac []byte) {
+	t.KeyName, t.Algorithm = k.Name, k.Algorithm
+	t.Fudge = tsigFudge
+	t.OrigID = binary.BigEndian.Uint16(msg)
+	t.MAC = k.mac(prior, msg, &t, timersOnly)
+	return appendTSIG(slices.Clone(msg), &t), t.MAC
+}
+
+// verify checks the TSIG record t was made with the key, for data signed as for mac, at a time within its fudge
+// of now. The returned TSIG error is 0 if the signature is good. An error is returned if the MAC has an invalid
+// length, which is a format error.
+func (k *TSIGKey) verify(prior, data []byte, t *TSIG, timersOnly bool, now time.Time) (tsigErr uint16, err error) {
+	size := tsigAlgorithms[k.Algorithm]().Size()
+	if len(t.MAC) > size || len(t.MAC) < max(10, size/2) {
+		errStr := fmt.Sprintf("TSIG MAC has invalid length %v", len(t.MAC))
+		return 0, errors.New(errStr)
+	}
+	if !hmac.Equal(k.mac(prior, data, t, timersOnly)[:len(t.MAC)], t.MAC) {
+		return tsigBadSig, nil
+	}
+	skew := now.Unix() - int64(t.TimeSigned)
+	if skew > int64(t.Fudge) || -skew > int64(t.Fudge) {
+		return tsigBadTime, nil
+	}
+	return 0, nil
+}
+
+// recordLen returns the length of the TSIG records the key signs messages with.
+func (k *TSIGKey) recordLen() int {
+	rdLen := len(serialiseName(k.Algorithm)) + 16 + tsigAlgorithms[k.Algorithm]().Size()
+	return len(serialiseName(k.Name)) + 10 + rdLen
+}
+
+// tsigNow returns the current time as a TSIG time signed.
+func tsigNow() uint64 {
+	return uint64(time.Now().Unix())
+}
+
+// verifyRequest checks the TSIG record of the signed request query, with the wire format queryBuf (RFC 8945
+// section 5.2). The key the request was signed with is returned if the signature is good, otherwise the error
+// reply to send, which isn't signed unless the key is known.
+func (s *Server) verifyRequest(queryBuf []byte, query DNSMsg, logHead string) (*TSIGKey, []byte) {
+	t := query.TSIG
+	key, ok := s.Keys[t.KeyName]
+	if !ok || key.Algorithm != t.Algorithm {
+		log.Warnf("%v [NOTAUTH] Request is signed with unknown TSIG key %v (%v)", logHead, t.KeyName, t.Algorithm)
+		return nil, tsigErrReply(query, nil, tsigBadKey, logHead)
+	}
+	tsigErr, err := key.verify(nil, stripTSIG(queryBuf, t), t, false, time.Now())
+	if err != nil {
+		log.Infof("%v [FORMERR] %v", logHead, err)
+		return nil, errReply(query, rcodeFormErr, logHead)
+	}
+	switch tsigErr {
+	case tsigBadSig:
+		log.Warnf("%v [NOTAUTH] Bad TSIG signature for key %v", logHead, key.Name)
+		return nil, tsigErrReply(query, nil, tsigErr, logHead)
+	case tsigBadTime:
+		log.Warnf("%v [NOTAUTH] TSIG signature with key %v is too old or new, check the clocks", logHead, key.Name)
+		return nil, tsigErrReply(query, key, tsigErr, logHead)
+	}
+	log.Debugf("%v Request is signed with TSIG key %v", logHead, key.Name)
+	return key, nil
+}
+
+// tsigErrReply constructs a serialised NOTAUTH reply to the signed request query, with the TSIG error tsigErr.
+// The reply is signed with key, unless it's nil (RFC 8945 section 5.3.2).
+func tsigErrReply(query DNSMsg, key *TSIGKey, tsigErr uint16, logHead string) []byte {
+	reply := NewDNSMsgErr(query, rcodeNotAuth)
+	reply.Question = query.Question
+	payload, err := reply.Serialise()
+	if err != nil {
+		log.Errorf("%v BUG? Error when serialising TSIG error reply: %v. Replying with NULL", logHead, err)
+		return []byte("")
+	}
+	t := TSIG{
+		KeyName:    query.TSIG.KeyName,
+		Algorithm:  query.TSIG.Algorithm,
+		TimeSigned: tsigNow(),
+		Fudge:      tsigFudge,
+		OrigID:     query.Header.ID,
+		Error:      tsigErr,
+	}
+	if key == nil {
+		return appendTSIG(payload, &t)
+	}
+	// A BADTIME reply gives the time the request was signed, and our own time in the other data.
+	t.OtherData = binary.BigEndian.AppendUint16(nil, uint16(t.TimeSigned>>32))
+	t.OtherData = binary.BigEndian.AppendUint32(t.OtherData, uint32(t.TimeSigned))
+	t.TimeSigned = query.TSIG.TimeSigned
+	signed, _ := key.sign(payload, query.TSIG.MAC, false, t)
+	return signed
+}
+
+// tsigSigner returns send wrapped to sign each message it's passed with key, as the replies to a request with
+// the MAC requestMAC (RFC 8945 section 5.3). The first reply is signed with all the TSIG variables, and each
+// later one with only the timers, continuing from the MAC of the reply before.
+func tsigSigner(key *TSIGKey, requestMAC []byte, send func([]byte) error) func([]byte) error {
+	prior := requestMAC
+	timersOnly := false
+	return func(msg []byte) error {
+		if len(msg) < 12 {
+			return send(msg) // Not a message, so there's nothing to sign.
+		}
+		signed, mac := key.sign(msg, prior, timersOnly, TSIG{TimeSigned: tsigNow()})
+		prior, timersOnly = mac, true
+		return send(signed)
+	}
+}
+
+// tsigVerifier checks the TSIG records of the replies to a request we signed (RFC 8945 section 5.3.1).
+// In a stream of replies, such as a zone transfer, up to tsigMaxUnsigned replies in a row may be unsigned. They
+// are covered by the next signed reply.
+type tsigVerifier struct {
+	key      *TSIGKey
+	prior    []byte // The MAC of the request, then of the last signed reply.
+	unsigned []byte // The unsigned replies since the last signed one.
+	count    int    // How many unsigned replies there have been in a row.
+	signed   bool   // Whether a signed reply has been verified.
+}
+
+// signRequest will sign the serialised request msg with key, returning the signed request and a verifier for
+// its replies.
+func signRequest(msg []byte, key *TSIGKey) ([]byte, *tsigVerifier) {
+	signed, mac := key.sign(msg, nil, false, TSIG{TimeSigned: tsigNow()})
+	return signed, &tsigVerifier{key: key, prior: mac}
+}
+
+// verify will check the reply, with the wire format buf, is signed, or may be left unsigned.
+func (v *tsigVerifier) verify(buf []byte, reply DNSMsg) error {
+	t := reply.TSIG
+	if t == nil {
+		if !v.signed || v.count >= tsigMaxUnsigned {
+			return errors.New("Reply isn't signed")
+		}
+		v.unsigned = append(v.unsigned, buf...)
+		v.count++
+		return nil
+	}
+	if t.Error != 0 {
+		errStr := fmt.Sprintf("Server rejected our TSIG signature with error %v", tsigErrorName(t.Error))
+		return errors.New(errStr)
+	}
+	if t.KeyName != v.key.Name || t.Algorithm != v.key.Algorithm {
+		errStr := fmt.Sprintf("Reply is signed with key %v rather than %v", t.KeyName, v.key.Name)
+		return errors.New(errStr)
+	}
+	data := append(v.unsigned, stripTSIG(buf, t)...)
+	tsigErr, err := v.key.verify(v.prior, data, t, v.signed, time.Now())
+	if err != nil {
+		return err
+	}
+	if tsigErr != 0 {
+		errStr := fmt.Sprintf("Reply has a bad TSIG signature: %v", tsigErrorName(tsigErr))
+		return errors.New(errStr)
+	}
+	v.prior, v.unsigned, v.count, v.signed = t.MAC, nil, 0, true
+	return nil
+}
+
+// complete returns an error if the last reply verified wasn't signed, as the end of a stream must be.
+func (v *tsigVerifier) complete() error {
+	if v.count > 0 {
+		return errors.New("Last reply isn't signed")
+	}
+	return nil
+}
+
+// tsigErrorName returns the name of the TSIG error tsigErr, for logging.
+func tsigErrorName(tsigErr uint16) string {
+	if name, ok := tsigErrorNames[tsigErr]; ok {
+		return name
+	}
+	return fmt.Sprint(tsigErr)
+}
+
+// key returns the TSIG key with the given name.
+func (s *Server) key(name Domain) (*TSIGKey, error) {
+	key, ok := s.Keys[name]
+	if !ok {
+		errStr := fmt.Sprintf("Unknown TSIG key %v", name)
+		return nil, errors.New(errStr)
+	}
+	return key, nil
+}
@@ -0,0 +1,151 @@
+package dns
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testKey returns the TSIG key xfr. with the given secret.
+func testKey(secret string) *TSIGKey {
+	return &TSIGKey{Name: "xfr.", Algorithm: "hmac-sha256.", Secret: []byte(secret)}
+}
+
+// testSignedTransfer sends an AXFR query for example.com, signed with key at the time signed, to server from a
+// client outside its networks. The raw replies are returned, with a verifier for them.
+func testSignedTransfer(t *testing.T, server *Server, key *TSIGKey, signed time.Time) ([][]byte, *tsigVerifier) {
+	payload, err := testQuery("example.com", TypeAXFR).Serialise()
+	if err != nil {
+		t.Fatalf("Could not serialise query: %v", err)
+	}
+	payload, mac := key.sign(payload, nil, false, TSIG{TimeSigned: uint64(signed.Unix())})
+	client := Client{Addr: netip.MustParseAddrPort("198.51.100.1:5353"), TCP: true}
+	var replies [][]byte
+	server.RespondStream(payload, client, "[test]", func(reply []byte) error {
+		replies = append(replies, reply)
+		return nil
+	})
+	return replies, &tsigVerifier{key: key, prior: mac}
+}
+
+// TestTSIG ensures signed requests are verified, allowed by the keys in ACLs, and that every message of the
+// reply is signed.
+func TestTSIG(t *testing.T) {
+	zone := testTransferZone(t)
+	zone.AllowTransfer = ACL{{Key: "xfr."}}
+	server := NewServer(testZoneTrie(t, zone), Config{})
+	server.Keys = map[Domain]*TSIGKey{"xfr.": testKey("secret")}
+
+	query := testQuery("example.com", TypeAXFR)
+	if replies := testTransfer(t, server, query, "198.51.100.1"); replies[0].Header.Rcode != rcodeRefused {
+		t.Errorf("Expected an unsigned AXFR to be REFUSED, got %v", replies[0].Header.Rcode)
+	}
+
+	replies, verifier := testSignedTransfer(t, server, testKey("secret"), time.Now())
+	if len(replies) < 2 {
+		t.Fatalf("Expected the transfer to need more than one message, got %v", len(replies))
+	}
+	for i, buf := range replies {
+		reply, err := ParseDNSMsg(buf)
+		if err != nil {
+			t.Fatalf("Could not parse reply: %v", err)
+		}
+		if reply.Header.Rcode != rcodeNoError {
+			t.Fatalf("Signed AXFR failed with rcode %v", reply.Header.Rcode)
+		}
+		if reply.TSIG == nil {
+			t.Fatalf("Reply %v isn't signed", i)
+		}
+		if err := verifier.verify(buf, reply); err != nil {
+			t.Fatalf("Reply %v doesn't verify: %v", i, err)
+		}
+	}
+
+	tests := []struct {
+		desc    string
+		key     *TSIGKey
+		signed  time.Time
+		tsigErr uint16
+	}{
+		{"wrong secret", testKey("wrong"), time.Now(), tsigBadSig},
+		{"unknown key", &TSIGKey{Name: "other.", Algorithm: "hmac-sha256.", Secret: []byte("secret")}, time.Now(), tsigBadKey},
+		{"old signature", testKey("secret"), time.Now().Add(-time.Hour), tsigBadTime},
+	}
+	for _, test := range tests {
+		replies, _ := testSignedTransfer(t, server, test.key, test.signed)
+		reply, err := ParseDNSMsg(replies[0])
+		if err != nil {
+			t.Fatalf("%v: Could not parse reply: %v", test.desc, err)
+		}
+		if len(replies) != 1 || reply.Header.Rcode != rcodeNotAuth || reply.TSIG == nil ||
+			reply.TSIG.Error != test.tsigErr {
+			t.Errorf("%v: expected a NOTAUTH reply with TSIG error %v, got %+v", test.desc, test.tsigErr, reply)
+			continue
+		}
+		// Only BADTIME replies are signed, as only then do we know the client has the key.
+		if signed := len(reply.TSIG.MAC) > 0; signed != (test.tsigErr == tsigBadTime) {
+			t.Errorf("%v: reply should be signed only for BADTIME, got MAC %x", test.desc, reply.TSIG.MAC)
+		}
+	}
+}
+
+// TestTSIGTransferIn ensures a secondary signs its transfer requests with the zone's key, and verifies the
+// signed transfer.
+func TestTSIGTransferIn(t *testing.T) {
+	keys := map[Domain]*TSIGKey{"xfr.": testKey("secret")}
+	primaryDir, secondaryDir := t.TempDir(), t.TempDir()
+	testZoneFile(t, primaryDir, 1, "allow-transfer key:xfr.\na A 192.0.2.1")
+	primary := NewServer(testZoneTrie(t), Config{ZonePath: primaryDir, TCPIdleTimeout: time.Second, TCPMaxConns: 4})
+	primary.Keys = keys
+	if err := primary.LoadZones(); err != nil {
+		t.Fatalf("Could not load primary zones: %v", err)
+	}
+	addr := testServeTCP(t, primary)
+
+	contents := fmt.Sprintf("zone example.com.\nprimary %v\ntsig-key xfr.\n", addr)
+	if err := os.WriteFile(filepath.Join(secondaryDir, "example.zone"), []byte(contents), 0o644); err != nil {
+		t.Fatalf("Could not write zone file: %v", err)
+	}
+	secondary := NewServer(testZoneTrie(t), Config{ZonePath: secondaryDir})
+	if err := secondary.LoadZones(); err == nil {
+		t.Errorf("Expected a zone using an unknown TSIG key not to load")
+	}
+	secondary.Keys = map[Domain]*TSIGKey{"xfr.": testKey("wrong")}
+	if err := secondary.LoadZones(); err != nil {
+		t.Fatalf("Could not load secondary zones: %v", err)
+	}
+	if err := secondary.RefreshZone("example.com."); err == nil {
+		t.Errorf("Expected the transfer to fail with the wrong secret")
+	}
+
+	secondary = NewServer(testZoneTrie(t), Config{ZonePath: secondaryDir})
+	secondary.Keys = keys
+	if err := secondary.LoadZones(); err != nil {
+		t.Fatalf("Could not load secondary zones: %v", err)
+	}
+	if err := secondary.RefreshZone("example.com."); err != nil {
+		t.Fatalf("Could not transfer zone: %v", err)
+	}
+	if _, addr := testLookup(t, secondary, "a.example.com"); addr != "192.0.2.1" {
+		t.Errorf("Expected the transferred zone to be served, got %q", addr)
+	}
+
+	// NOTIFYs have to be signed with the zone's key, even from the primary.
+	query := testQuery("example.com", TypeSOA)
+	query.Header.Opcode = opcodeNotify
+	payload, err := query.Serialise()
+	if err != nil {
+		t.Fatalf("Could not serialise query: %v", err)
+	}
+	client := Client{Addr: netip.MustParseAddrPort(addr)}
+	if reply, _ := ParseDNSMsg(secondary.Respond(payload, client, "[test]")); reply.Header.Rcode != rcodeRefused {
+		t.Errorf("Expected an unsigned NOTIFY from the primary to be REFUSED, got %v", reply.Header.Rcode)
+	}
+	signed, _ := keys["xfr."].sign(payload, nil, false, TSIG{TimeSigned: uint64(time.Now().Unix())})
+	if reply, _ := ParseDNSMsg(secondary.Respond(signed, client, "[test]")); reply.Header.Rcode != rcodeNoError {
+		t.Errorf("Expected a signed NOTIFY to be accepted, got %v", reply.Header.Rcode)
+	}
+}
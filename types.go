@@ -1,27 +1,67 @@
-package main
+package dns
 
 import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"net/netip"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // These RecType values correspond to the DNS message values for the given type.
-// To add another type, just add one of these const values and an entry to recTypeToName.
+// To add another type, just add one of these const values and an entry to recTypeToName. Types without one are
+// still stored and served, with their RDATA kept opaque in RData.Data (RFC 3597).
 const (
-	TypeA     RecType = 1
-	TypeNS    RecType = 2
-	TypeCNAME RecType = 5
-	TypePTR   RecType = 12
-	TypeMX    RecType = 15
-	TypeTXT   RecType = 16
-	TypeAAAA  RecType = 28
-	TypeOPT   RecType = 41
+	TypeA          RecType = 1
+	TypeNS         RecType = 2
+	TypeCNAME      RecType = 5
+	TypeSOA        RecType = 6
+	TypePTR        RecType = 12
+	TypeMX         RecType = 15
+	TypeTXT        RecType = 16
+	TypeAAAA       RecType = 28
+	TypeSRV        RecType = 33
+	TypeDNAME      RecType = 39
+	TypeOPT        RecType = 41
+	TypeDS         RecType = 43
+	TypeSSHFP      RecType = 44
+	TypeRRSIG      RecType = 46
+	TypeNSEC       RecType = 47
+	TypeDNSKEY     RecType = 48
+	TypeNSEC3      RecType = 50
+	TypeNSEC3PARAM RecType = 51
+	TypeTLSA       RecType = 52
+	TypeSVCB       RecType = 64
+	TypeHTTPS      RecType = 65
+	TypeCAA        RecType = 257
 )
 
+// TypeALIAS is the type of ALIAS records, which give the A and AAAA records of their owner as those of their
+// target, looked up when they're queried. It's the type PowerDNS uses, in the private use range (RFC 6895).
+// ALIAS records are only sent in zone transfers.
+const TypeALIAS RecType = 65401
+
+// These RecType values can only be used in the question section of a query, they aren't types of record.
 const (
-	QClassIN QClass = 1
+	TypeIXFR RecType = 251
+	TypeAXFR RecType = 252
+)
+
+// TypeTSIG is the type of the TSIG meta-record (RFC 8945), which signs a message. It's kept in DNSMsg.TSIG.
+const TypeTSIG RecType = 250
+
+// TypeANY matches records of any type. It's only used in the prerequisite and update sections of UPDATE
+// messages (RFC 2136), ANY queries aren't supported.
+const TypeANY RecType = 255
+
+const (
+	QClassIN   QClass = 1
+	QClassNONE QClass = 254 // Only used in UPDATE messages (RFC 2136).
+	QClassANY  QClass = 255 // Only used in UPDATE messages (RFC 2136).
 )
 
 type Domain string
@@ -30,27 +70,92 @@ type QClass uint16
 type TXTData [][]byte
 
 type RData struct {
-	Name   RecordName
-	Type   RecType
-	Addr   netip.Addr // A, AAAA
-	Target Domain     // For CNAMEs, MX etc. The zonefile parser always makes the target an FQDN.
-	TXT    TXTData    // TXT, split into 255-byte strings
-	TTL    uint       // Seconds
-	Pref   uint16     // For MX
+	Name    RecordName
+	Type    RecType
+	Addr    netip.Addr   // A, AAAA
+	Target  Domain       // For CNAMEs, DNAMEs, MX etc. The zonefile parser always makes the target an FQDN.
+	TXT     TXTData      // TXT, split into 255-byte strings
+	TTL     uint         // Seconds
+	Pref    uint16       // For MX, and the priority of SRV, SVCB and HTTPS
+	Weight  uint16       // SRV
+	Port    uint16       // SRV
+	Options []EDNSOption // For OPT
+	// SOA fields. The zonefile parser always makes MName and RName FQDNs.
+	MName   Domain // Primary name server
+	RName   Domain // Mailbox of the person responsible for the zone
+	Serial  uint32
+	Refresh uint32 // Seconds
+	Retry   uint32 // Seconds
+	Expire  uint32 // Seconds
+	Minimum uint32 // Negative caching TTL in seconds
+	// DNSSEC fields (RFC 4034)
+	Flags       uint16    // DNSKEY, NSEC3, NSEC3PARAM and CAA (8 bits)
+	Protocol    byte      // DNSKEY, always 3
+	Algorithm   byte      // DNSKEY, RRSIG, DS, SSHFP, and the hash algorithm of NSEC3 and NSEC3PARAM
+	PublicKey   []byte    // DNSKEY
+	TypeCovered RecType   // RRSIG
+	Labels      byte      // RRSIG: labels in the owner name, not counting a wildcard label.
+	OrigTTL     uint32    // RRSIG
+	Expiration  uint32    // RRSIG, seconds since the epoch
+	Inception   uint32    // RRSIG, seconds since the epoch
+	KeyTag      uint16    // RRSIG, DS
+	SignerName  Domain    // RRSIG: the zone apex.
+	Signature   []byte    // RRSIG
+	NextName    Domain    // NSEC: the next name in the zone.
+	Iterations  uint16    // NSEC3, NSEC3PARAM
+	Salt        []byte    // NSEC3, NSEC3PARAM
+	NextHashed  []byte    // NSEC3: the next hashed owner name in the zone.
+	Types       []RecType // NSEC, NSEC3: the types at the owner name, in order.
+	DigestType  byte      // DS, the matching type of TLSA and the fingerprint type of SSHFP
+	Digest      []byte    // DS: digest of the child zone's DNSKEY record. TLSA: certificate data. SSHFP: fingerprint.
+	// Security record fields (RFC 8659, RFC 6698, RFC 4255)
+	Tag      string // CAA property tag, e.g. issue
+	Value    string // CAA property value
+	Usage    byte   // TLSA certificate usage
+	Selector byte   // TLSA
+	// SVCB and HTTPS service parameters (RFC 9460), in increasing key order. Pref is the SvcPriority, 0 for
+	// AliasMode, and Target the TargetName, "." meaning the owner name in ServiceMode.
+	Params []SvcParam
+	// Data is the opaque RDATA of a record of a type we don't know (RFC 3597).
+	Data []byte
+	// generated is set on PTR records made from the address records of a zone given with ptr-from. They're
+	// made again whenever the zones change, and aren't written to the zone file.
+	generated bool
 }
 
-// domainRegex defines a regex for a valid domain name. This does NOT include @ and wildcard domains.
-var domainRegex *regexp.Regexp = regexp.MustCompile(`^(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.?)+[a-z0-9][a-z0-9-]{0,61}[a-z0-9]\.?$`)
+// domainRegex defines a regex for a valid domain name, in any case. This does NOT include @ and wildcard domains.
+// Underscores are allowed, for names like _sip._tcp.example.com (RFC 2782).
+var domainRegex *regexp.Regexp = regexp.MustCompile(`(?i)^(?:[a-z0-9_](?:[a-z0-9_-]{0,61}[a-z0-9_])?\.?)+[a-z0-9_][a-z0-9_-]{0,61}[a-z0-9_]\.?$`)
 
 var recTypeToName = map[RecType]string{
-	TypeA:     "A",
-	TypeNS:    "NS",
-	TypeCNAME: "CNAME",
-	TypePTR:   "PTR",
-	TypeMX:    "MX",
-	TypeTXT:   "TXT",
-	TypeAAAA:  "AAAA",
-	TypeOPT:   "OPT",
+	TypeA:          "A",
+	TypeNS:         "NS",
+	TypeCNAME:      "CNAME",
+	TypeSOA:        "SOA",
+	TypePTR:        "PTR",
+	TypeMX:         "MX",
+	TypeTXT:        "TXT",
+	TypeAAAA:       "AAAA",
+	TypeSRV:        "SRV",
+	TypeDNAME:      "DNAME",
+	TypeOPT:        "OPT",
+	TypeDS:         "DS",
+	TypeRRSIG:      "RRSIG",
+	TypeNSEC:       "NSEC",
+	TypeDNSKEY:     "DNSKEY",
+	TypeNSEC3:      "NSEC3",
+	TypeNSEC3PARAM: "NSEC3PARAM",
+	TypeTLSA:       "TLSA",
+	TypeSSHFP:      "SSHFP",
+	TypeCAA:        "CAA",
+	TypeALIAS:      "ALIAS",
+	TypeSVCB:       "SVCB",
+	TypeHTTPS:      "HTTPS",
+}
+
+var qTypeToName = map[RecType]string{
+	TypeIXFR: "IXFR",
+	TypeAXFR: "AXFR",
 }
 
 var qClassByName = map[string]QClass{
@@ -124,12 +229,23 @@ func (q QClass) Valid() bool {
 }
 
 func (q QClass) String() string {
-	if q == QClassIN {
+	switch q {
+	case QClassIN:
 		return "IN"
+	case QClassNONE:
+		return "NONE"
+	case QClassANY:
+		return "ANY"
 	}
 	return ""
 }
 
+// quoteString quotes s for a zone file, escaping quotes and backslashes.
+func quoteString(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
 func (t TXTData) String() string {
 	var builder strings.Builder
 	for _, s := range t {
@@ -146,19 +262,86 @@ func (r RData) TTLOrDefault(zone Zone) uint {
 	return r.TTL
 }
 
-// dataString returns a string representation of the data/target/txt depending on the record type.
+// DataString returns the data/target/txt of the record as it's written in zone files, depending on the record type.
 func (r RData) DataString() string {
 	switch r.Type {
 	case TypeA, TypeAAAA:
 		return r.Addr.String()
-	case TypeCNAME, TypeMX, TypeNS:
-		return r.Target.String()
+	case TypeCNAME, TypeNS, TypePTR, TypeDNAME, TypeALIAS:
+		return r.Target.AsFQDN().String()
+	case TypeMX:
+		return fmt.Sprintf("%v %v", r.Pref, r.Target.AsFQDN())
+	case TypeSRV:
+		return fmt.Sprintf("%v %v %v %v", r.Pref, r.Weight, r.Port, r.Target.AsFQDN())
 	case TypeTXT:
-		return r.TXT.String()
+		return quoteString(r.TXT.String())
+	case TypeSOA:
+		return fmt.Sprintf("%v %v %v %v %v %v %v", r.MName.AsFQDN(), r.RName.AsFQDN(), r.Serial, r.Refresh, r.Retry, r.Expire, r.Minimum)
+	case TypeDNSKEY:
+		return fmt.Sprintf("%v %v %v %v", r.Flags, r.Protocol, r.Algorithm, base64.StdEncoding.EncodeToString(r.PublicKey))
+	case TypeRRSIG:
+		return fmt.Sprintf("%v %v %v %v %v %v %v %v %v", r.TypeCovered, r.Algorithm, r.Labels, r.OrigTTL,
+			sigTime(r.Expiration), sigTime(r.Inception), r.KeyTag, r.SignerName.AsFQDN(),
+			base64.StdEncoding.EncodeToString(r.Signature))
+	case TypeNSEC:
+		return strings.Join(append([]string{r.NextName.AsFQDN().String()}, typeStrings(r.Types)...), " ")
+	case TypeNSEC3:
+		next := strings.ToLower(base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(r.NextHashed))
+		fields := []string{fmt.Sprintf("%v %v %v %v %v", r.Algorithm, r.Flags, r.Iterations, saltString(r.Salt), next)}
+		return strings.Join(append(fields, typeStrings(r.Types)...), " ")
+	case TypeNSEC3PARAM:
+		return fmt.Sprintf("%v %v %v %v", r.Algorithm, r.Flags, r.Iterations, saltString(r.Salt))
+	case TypeDS:
+		return fmt.Sprintf("%v %v %v %v", r.KeyTag, r.Algorithm, r.DigestType, strings.ToUpper(hex.EncodeToString(r.Digest)))
+	case TypeCAA:
+		return fmt.Sprintf("%v %v %v", r.Flags, r.Tag, quoteString(r.Value))
+	case TypeTLSA:
+		return fmt.Sprintf("%v %v %v %v", r.Usage, r.Selector, r.DigestType, strings.ToUpper(hex.EncodeToString(r.Digest)))
+	case TypeSSHFP:
+		return fmt.Sprintf("%v %v %v", r.Algorithm, r.DigestType, strings.ToUpper(hex.EncodeToString(r.Digest)))
+	case TypeSVCB, TypeHTTPS:
+		fields := []string{strconv.Itoa(int(r.Pref)), r.Target.AsFQDN().String()}
+		for _, param := range r.Params {
+			fields = append(fields, param.String())
+		}
+		return strings.Join(fields, " ")
+	}
+	if !r.Type.Valid() {
+		return genericDataString(r.Data)
 	}
 	return ""
 }
 
+// genericDataString returns RDATA in the generic form of RFC 3597 section 5, e.g. \# 4 0A000001.
+func genericDataString(data []byte) string {
+	if len(data) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %v %v`, len(data), strings.ToUpper(hex.EncodeToString(data)))
+}
+
+// typeStrings returns the names of types.
+func typeStrings(types []RecType) []string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.String()
+	}
+	return names
+}
+
+// saltString returns an NSEC3 salt in hex, or "-" for no salt (RFC 5155 section 3.3).
+func saltString(salt []byte) string {
+	if len(salt) == 0 {
+		return "-"
+	}
+	return hex.EncodeToString(salt)
+}
+
+// sigTime formats t, seconds since the epoch, as an RRSIG expiration or inception time: YYYYMMDDHHmmSS in UTC.
+func sigTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format("20060102150405")
+}
+
 func (r RecType) Valid() bool {
 	for k, _ := range recTypeToName {
 		if k == r {
@@ -168,11 +351,27 @@ func (r RecType) Valid() bool {
 	return false
 }
 
+// ValidQType reports whether r may be used in a question, either as a record type, known or not, or a query-only
+// type we support.
+func (r RecType) ValidQType() bool {
+	_, ok := qTypeToName[r]
+	return ok || (r != 0 && !r.Meta())
+}
+
+// Meta reports whether r is a meta-type or query-only type (RFC 6895 section 3.1), which records are never
+// stored as.
+func (r RecType) Meta() bool {
+	return r == TypeOPT || (r >= 128 && r <= 255)
+}
+
 func (r RecType) String() string {
 	if s, ok := recTypeToName[r]; ok {
 		return s
 	}
-	return ""
+	if s, ok := qTypeToName[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("TYPE%v", uint16(r))
 }
 
 // ParseQClass converts a string to a QClass.
@@ -183,12 +382,19 @@ func ParseQClass(s string) (QClass, error) {
 	return 0, fmt.Errorf("Unknown QCLASS: %q", s)
 }
 
-// ParseRecType converts a string to a RecType.
+// ParseRecType converts a string to a RecType. Meta-types, such as OPT, are refused as records are never stored
+// as them.
 func ParseRecType(s string) (RecType, error) {
 	for k, v := range recTypeToName {
-		if s == v {
+		if s == v && !k.Meta() {
 			return k, nil
 		}
 	}
+	// The generic form of RFC 3597 section 5, for types we don't know.
+	if n, ok := strings.CutPrefix(s, "TYPE"); ok {
+		if t, err := strconv.ParseUint(n, 10, 16); err == nil && t != 0 && !RecType(t).Meta() {
+			return RecType(t), nil
+		}
+	}
 	return 0, fmt.Errorf("Unknown record type: %q", s)
 }
@@ -0,0 +1,329 @@
+package dns
+
+import (
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// updateRR is a record of a zone being updated, with its updateKey.
+type updateRR struct {
+	key string
+	rr  RR
+}
+
+// HandleUpdate answers an UPDATE message (RFC 2136), applying the updates in it to one of our zones if its
+// prerequisites are met. Only clients in the zone's allow-update ACL may update it.
+// The update is applied atomically: either all of it is, or none of it. The zone's serial is increased, and
+// the zone is written back to its zone file.
+func (s *Server) HandleUpdate(query DNSMsg, client Client, logHead string) []byte {
+	if rcode := s.update(query, client, logHead); rcode != rcodeNoError {
+		return errReply(query, rcode, logHead)
+	}
+	reply := NewDNSMsg(query)
+	payload, err := reply.Serialise()
+	if err != nil {
+		log.Errorf("%v Could not serialise UPDATE reply: %v", logHead, err)
+		return errReply(query, rcodeServFail, logHead)
+	}
+	return payload
+}
+
+// update applies the UPDATE message query, returning the rcode for the reply.
+// The zone section of the message is in its question section, the prerequisites in its answer section and the
+// updates in its authority section.
+func (s *Server) update(query DNSMsg, client Client, logHead string) (rcode byte) {
+	if len(query.Question) != 1 || query.Question[0].Type != TypeSOA {
+		log.Infof("%v [FORMERR] UPDATE without a single SOA zone", logHead)
+		return rcodeFormErr
+	}
+	name := query.Question[0].Name
+
+	// Held until the update is applied, so other updates and reloads can't change the zone in the meantime.
+	s.zonesMu.Lock()
+	defer s.zonesMu.Unlock()
+	zone, ok := findZone(s.Zones(), name)
+	if !ok || queryStr(zone, name) != "" {
+		log.Infof("%v [NOTAUTH] UPDATE for a name which isn't one of our zones", logHead)
+		return rcodeNotAuth
+	}
+	if zone.Secondary() {
+		log.Infof("%v [REFUSED] UPDATE for secondary zone %v, it must be sent to the primary", logHead, zone.Name)
+		return rcodeRefused
+	}
+	if zone.presigned() {
+		log.Infof("%v [REFUSED] UPDATE for zone %v, which is signed offline", logHead, zone.Name)
+		return rcodeRefused
+	}
+	if !zone.AllowUpdate.Allows(client) {
+		log.Warnf("%v [REFUSED] Client may not update zone %v", logHead, zone.Name)
+		return rcodeRefused
+	}
+	soa, ok := zone.SOA()
+	if !ok {
+		log.Errorf("%v [SERVFAIL] Zone %v has no SOA record to update", logHead, zone.Name)
+		return rcodeServFail
+	}
+
+	if rcode := checkPrerequisites(zone, query.Answer, logHead); rcode != rcodeNoError {
+		return rcode
+	}
+	if rcode := prescanUpdates(zone, query.Authority, logHead); rcode != rcodeNoError {
+		return rcode
+	}
+
+	rrs, changed := applyUpdates(zone, query.Authority)
+	if !changed {
+		log.Infof("%v [NoError] Zone %v is unchanged", logHead, zone.Name)
+		return rcodeNoError
+	}
+	// The serial is increased, unless the update already did so by replacing the SOA record.
+	i := slices.IndexFunc(rrs, func(r updateRR) bool { return r.rr.Type == TypeSOA })
+	if rrs[i].rr.RData.Serial == soa.Serial {
+		rrs[i].rr.RData.Serial++
+	}
+
+	records := make([]RR, len(rrs))
+	for i, r := range rrs {
+		records[i] = r.rr
+	}
+	updated, err := zone.WithRecords(records)
+	if err != nil {
+		log.Warnf("%v [REFUSED] Could not update zone %v: %v", logHead, zone.Name, err)
+		return rcodeRefused
+	}
+	if updated.File != "" {
+		if err := updated.WriteFile(); err != nil {
+			log.Errorf("%v [SERVFAIL] Could not write zone file for zone %v: %v", logHead, zone.Name, err)
+			return rcodeServFail
+		}
+	}
+	if err := updateJournal(zone, &updated); err != nil {
+		log.Errorf("%v Could not update journal: %v", logHead, err)
+	}
+	s.setZone(updated)
+	soa, _ = updated.SOA()
+	log.Infof("%v [NoError] Updated zone %v to serial %v", logHead, zone.Name, soa.Serial)
+	s.notifySecondaries(&updated)
+	return rcodeNoError
+}
+
+// checkPrerequisites checks the prerequisites of an UPDATE message against zone (RFC 2136 section 3.2),
+// returning the rcode of the first that isn't met.
+func checkPrerequisites(zone *Zone, prereqs []RR, logHead string) (rcode byte) {
+	// Records which must make up their RRsets exactly, keyed by the lowercase owner and type.
+	type rrsetKey struct {
+		name Domain
+		t    RecType
+	}
+	values := make(map[rrsetKey]map[string]bool)
+
+	for _, rr := range prereqs {
+		if rr.TTL != 0 {
+			log.Infof("%v [FORMERR] Prerequisite for %v has a TTL", logHead, rr.Name)
+			return rcodeFormErr
+		}
+		if !zone.Contains(rr.Name) {
+			log.Infof("%v [NOTZONE] Prerequisite for %v is outside zone %v", logHead, rr.Name, zone.Name)
+			return rcodeNotZone
+		}
+		name := queryStr(zone, rr.Name)
+		rrset, inUse := zone.Records[name.String()]
+		inUse = inUse && !rrset.Empty
+		exists := len(rrset.RRSet[rr.Type]) > 0
+		if rr.Class != QClassIN && rr.RData.Type != 0 {
+			log.Infof("%v [FORMERR] Prerequisite for %v has data", logHead, rr.Name)
+			return rcodeFormErr
+		}
+
+		switch {
+		case rr.Class == QClassANY && rr.Type == TypeANY && !inUse:
+			log.Infof("%v [NXDOMAIN] Prerequisite failed, %v isn't in use", logHead, rr.Name)
+			return rcodeNxdomain
+		case rr.Class == QClassANY && rr.Type != TypeANY && !exists:
+			log.Infof("%v [NXRRSET] Prerequisite failed, %v has no %v RRset", logHead, rr.Name, rr.Type)
+			return rcodeNXRRSet
+		case rr.Class == QClassNONE && rr.Type == TypeANY && inUse:
+			log.Infof("%v [YXDOMAIN] Prerequisite failed, %v is in use", logHead, rr.Name)
+			return rcodeYXDomain
+		case rr.Class == QClassNONE && rr.Type != TypeANY && exists:
+			log.Infof("%v [YXRRSET] Prerequisite failed, %v has a %v RRset", logHead, rr.Name, rr.Type)
+			return rcodeYXRRSet
+		case rr.Class == QClassIN:
+			key := rrsetKey{name, rr.Type}
+			if values[key] == nil {
+				values[key] = make(map[string]bool)
+			}
+			values[key][updateKey(rr)] = true
+		case rr.Class != QClassANY && rr.Class != QClassNONE:
+			log.Infof("%v [FORMERR] Prerequisite for %v has class %v", logHead, rr.Name, rr.Class)
+			return rcodeFormErr
+		}
+	}
+
+	// Value dependent prerequisites: the RRsets must be exactly as given.
+	for key, want := range values {
+		rrset := zone.Records[key.name.String()]
+		have := make(map[string]bool)
+		for rdata := range rrset.Get(key.t) {
+			have[updateKey(zone.RR(rdata, zone.AbsoluteName(key.name.String())))] = true
+		}
+		if len(have) != len(want) {
+			log.Infof("%v [NXRRSET] Prerequisite failed, %v RRset of %v differs", logHead, key.t, key.name)
+			return rcodeNXRRSet
+		}
+		for k := range want {
+			if !have[k] {
+				log.Infof("%v [NXRRSET] Prerequisite failed, %v RRset of %v differs", logHead, key.t, key.name)
+				return rcodeNXRRSet
+			}
+		}
+	}
+	return rcodeNoError
+}
+
+// prescanUpdates checks the updates of an UPDATE message are well formed and can be applied to zone
+// (RFC 2136 section 3.4.1), before any of them are.
+func prescanUpdates(zone *Zone, updates []RR, logHead string) (rcode byte) {
+	for _, rr := range updates {
+		if !zone.Contains(rr.Name) {
+			log.Infof("%v [NOTZONE] Update for %v is outside zone %v", logHead, rr.Name, zone.Name)
+			return rcodeNotZone
+		}
+		switch rr.Class {
+		case QClassIN:
+			if rr.Type == 0 || rr.Type.Meta() {
+				log.Infof("%v [FORMERR] Can't add record of type %v", logHead, rr.Type)
+				return rcodeFormErr
+			}
+			if !representable(zone, rr) {
+				log.Infof("%v [REFUSED] Record for %v can't be written to the zone file", logHead, rr.Name)
+				return rcodeRefused
+			}
+		case QClassANY:
+			if rr.TTL != 0 || rr.RData.Type != 0 || (rr.Type != TypeANY && (rr.Type == 0 || rr.Type.Meta())) {
+				log.Infof("%v [FORMERR] Malformed deletion of RRsets of %v", logHead, rr.Name)
+				return rcodeFormErr
+			}
+		case QClassNONE:
+			if rr.TTL != 0 || rr.RData.Type == 0 || rr.Type == TypeOPT {
+				log.Infof("%v [FORMERR] Malformed deletion of record of %v", logHead, rr.Name)
+				return rcodeFormErr
+			}
+		default:
+			log.Infof("%v [FORMERR] Update for %v has class %v", logHead, rr.Name, rr.Class)
+			return rcodeFormErr
+		}
+	}
+	return rcodeNoError
+}
+
+// representable reports whether rr, a record to be added to zone, can be written to a zone file and read back.
+func representable(zone *Zone, rr RR) bool {
+	if name := queryStr(zone, rr.Name); name != "" && !RecordName(name).Valid() {
+		return false
+	}
+	switch rr.Type {
+	case TypeCNAME, TypeNS, TypePTR, TypeMX, TypeDNAME, TypeALIAS:
+		return rr.RData.Target.Valid()
+	case TypeSRV:
+		return rr.RData.Target.Valid() || rr.RData.Target.AsFQDN() == "."
+	case TypeSVCB, TypeHTTPS:
+		for _, param := range rr.RData.Params {
+			// The values of generic keys are written as they are.
+			value := string(param.Value)
+			if _, known := svcKeyNames[param.Key]; !known && (!utf8.ValidString(value) || strings.ContainsAny(value, "\r\n")) {
+				return false
+			}
+		}
+		return rr.RData.Target.Valid() || rr.RData.Target.AsFQDN() == "."
+	case TypeSOA:
+		return rr.RData.MName.Valid() && rr.RData.RName.Valid()
+	case TypeTXT:
+		txt := rr.RData.TXT.String()
+		return txt != "" && utf8.ValidString(txt) && !strings.ContainsAny(txt, "\r\n")
+	case TypeCAA:
+		value := rr.RData.Value
+		return caaTagRegex.MatchString(rr.RData.Tag) && value != "" && utf8.ValidString(value) && !strings.ContainsAny(value, "\r\n")
+	case TypeDNSKEY, TypeRRSIG, TypeNSEC, TypeNSEC3, TypeNSEC3PARAM:
+		return false // DNSSEC records are made from the zone's keys.
+	}
+	return true
+}
+
+// applyUpdates returns the records of zone with updates, which have passed prescanUpdates, applied in order
+// (RFC 2136 section 3.4.2). changed is false if the updates made no difference.
+func applyUpdates(zone *Zone, updates []RR) (rrs []updateRR, changed bool) {
+	for rr := range zone.All() {
+		rrs = append(rrs, updateRR{key: updateKey(rr), rr: rr})
+	}
+	sameName := func(a, b Domain) bool {
+		return strings.EqualFold(a.AsFQDN().String(), b.AsFQDN().String())
+	}
+
+	for _, rr := range updates {
+		apex := queryStr(zone, rr.Name) == ""
+		switch rr.Class {
+		case QClassIN:
+			if rr.Type == TypeSOA {
+				// The SOA record is only replaced by one with a later serial.
+				i := slices.IndexFunc(rrs, func(r updateRR) bool { return r.rr.Type == TypeSOA })
+				if apex && serialLess(rrs[i].rr.RData.Serial, rr.RData.Serial) {
+					rrs[i] = updateRR{key: updateKey(rr), rr: rr}
+					changed = true
+				}
+				continue
+			}
+			key := updateKey(rr)
+			i := slices.IndexFunc(rrs, func(r updateRR) bool { return r.key == key })
+			if i < 0 {
+				rrs = append(rrs, updateRR{key: key, rr: rr})
+				changed = true
+			} else if rrs[i].rr.TTL != rr.TTL {
+				rrs[i].rr.TTL = rr.TTL
+				changed = true
+			}
+		case QClassANY:
+			// Delete the RRset of the type, or every RRset of the name. The SOA and apex NS records stay.
+			n := len(rrs)
+			rrs = slices.DeleteFunc(rrs, func(r updateRR) bool {
+				if !sameName(r.rr.Name, rr.Name) || r.rr.Type == TypeSOA || (apex && r.rr.Type == TypeNS) {
+					return false
+				}
+				return rr.Type == TypeANY || r.rr.Type == rr.Type
+			})
+			changed = changed || len(rrs) != n
+		case QClassNONE:
+			// Delete the record, unless it's the SOA record or the last apex NS record.
+			if rr.Type == TypeSOA {
+				continue
+			}
+			if apex && rr.Type == TypeNS {
+				nameservers := 0
+				for _, r := range rrs {
+					if r.rr.Type == TypeNS && sameName(r.rr.Name, zone.Name) {
+						nameservers++
+					}
+				}
+				if nameservers <= 1 {
+					continue
+				}
+			}
+			key := updateKey(rr)
+			n := len(rrs)
+			rrs = slices.DeleteFunc(rrs, func(r updateRR) bool { return r.key == key })
+			changed = changed || len(rrs) != n
+		}
+	}
+	return rrs, changed
+}
+
+// updateKey returns a key identifying the record rr in an UPDATE message, whatever its class and TTL, like rrKey.
+func updateKey(rr RR) string {
+	rr.Class = QClassIN
+	rr.TTL = 0
+	key, _ := rrKey(rr)
+	return key
+}
@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testUpdate sends an UPDATE message for example.com from the client address addr, and returns the reply's rcode.
+func testUpdate(t *testing.T, server *Server, addr string, prereqs, updates []RR) byte {
+	query := testQuery("example.com", TypeSOA)
+	query.Header.Opcode = opcodeUpdate
+	query.Answer, query.Authority = prereqs, updates
+	payload, err := query.Serialise()
+	if err != nil {
+		t.Fatalf("Could not serialise UPDATE: %v", err)
+	}
+	client := Client{Addr: netip.AddrPortFrom(netip.MustParseAddr(addr), 53)}
+	reply, err := ParseDNSMsg(server.Respond(payload, client, "[test]"))
+	if err != nil {
+		t.Fatalf("Could not parse reply: %v", err)
+	}
+	return reply.Header.Rcode
+}
+
+// testSerial returns the serial of example.com on server.
+func testSerial(t *testing.T, server *Server) uint32 {
+	zone, _ := findZone(server.Zones(), "example.com")
+	soa, ok := zone.SOA()
+	if !ok {
+		t.Fatalf("Zone has no SOA record")
+	}
+	return soa.Serial
+}
+
+// TestUpdate ensures dynamic updates are applied atomically when their prerequisites are met, increase the
+// serial, and are written back to the zone file.
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+	testZoneFile(t, dir, 1, "allow-update 127.0.0.1\na A 192.0.2.1\nc CNAME a.example.com.")
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+
+	addB := RR{Name: "b.example.com", Type: TypeA, Class: QClassIN, TTL: 60,
+		RData: RData{Type: TypeA, Addr: netip.MustParseAddr("192.0.2.2")}}
+	bAbsent := RR{Name: "b.example.com", Type: TypeANY, Class: QClassNONE}
+	if rcode := testUpdate(t, server, "192.0.2.10", nil, []RR{addB}); rcode != rcodeRefused {
+		t.Errorf("Expected UPDATE from a client not in allow-update to be REFUSED, got %v", rcode)
+	}
+	if rcode := testUpdate(t, server, "127.0.0.1", []RR{bAbsent}, []RR{addB}); rcode != rcodeNoError {
+		t.Fatalf("UPDATE failed with rcode %v", rcode)
+	}
+	if _, addr := testLookup(t, server, "b.example.com"); addr != "192.0.2.2" {
+		t.Errorf("Expected the added record to be served, got %q", addr)
+	}
+	if serial := testSerial(t, server); serial != 2 {
+		t.Errorf("Expected the serial to be increased to 2, got %v", serial)
+	}
+
+	tests := []struct {
+		desc             string
+		prereqs, updates []RR
+		rcode            byte
+	}{
+		{"name not in use", []RR{bAbsent}, nil, rcodeYXDomain},
+		{"RRset exists", []RR{{Name: "d.example.com", Type: TypeA, Class: QClassANY}}, nil, rcodeNXRRSet},
+		{"value dependent", []RR{{Name: "a.example.com", Type: TypeA, Class: QClassIN,
+			RData: RData{Type: TypeA, Addr: netip.MustParseAddr("192.0.2.9")}}}, nil, rcodeNXRRSet},
+		{"name outside the zone", nil, []RR{{Name: "example.net", Type: TypeANY, Class: QClassANY}}, rcodeNotZone},
+		// The first update is fine, but the second would give the CNAME c another record, so neither is applied.
+		{"CNAME exclusivity", nil, []RR{
+			{Name: "e.example.com", Type: TypeA, Class: QClassIN, TTL: 60,
+				RData: RData{Type: TypeA, Addr: netip.MustParseAddr("192.0.2.5")}},
+			{Name: "c.example.com", Type: TypeA, Class: QClassIN, TTL: 60,
+				RData: RData{Type: TypeA, Addr: netip.MustParseAddr("192.0.2.3")}},
+		}, rcodeRefused},
+	}
+	for _, test := range tests {
+		if rcode := testUpdate(t, server, "127.0.0.1", test.prereqs, test.updates); rcode != test.rcode {
+			t.Errorf("%v: expected rcode %v, got %v", test.desc, test.rcode, rcode)
+		}
+	}
+	if rcode, _ := testLookup(t, server, "e.example.com"); rcode != rcodeNxdomain {
+		t.Errorf("Expected a failed UPDATE not to be applied at all, got rcode %v for e.example.com", rcode)
+	}
+	if serial := testSerial(t, server); serial != 2 {
+		t.Errorf("Expected failed UPDATEs not to change the serial, got %v", serial)
+	}
+
+	// Delete a's A RRset, subject to its value.
+	aPresent := RR{Name: "a.example.com", Type: TypeA, Class: QClassIN,
+		RData: RData{Type: TypeA, Addr: netip.MustParseAddr("192.0.2.1")}}
+	deleteA := RR{Name: "a.example.com", Type: TypeA, Class: QClassANY}
+	if rcode := testUpdate(t, server, "127.0.0.1", []RR{aPresent}, []RR{deleteA}); rcode != rcodeNoError {
+		t.Fatalf("UPDATE failed with rcode %v", rcode)
+	}
+
+	// The zone file was rewritten, so the updates survive a restart.
+	restarted := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := restarted.LoadZones(); err != nil {
+		t.Fatalf("Could not load the rewritten zone file: %v", err)
+	}
+	if serial := testSerial(t, restarted); serial != 3 {
+		t.Errorf("Expected serial 3 after a restart, got %v", serial)
+	}
+	if _, addr := testLookup(t, restarted, "b.example.com"); addr != "192.0.2.2" {
+		t.Errorf("Expected the added record after a restart, got %q", addr)
+	}
+	if rcode, _ := testLookup(t, restarted, "a.example.com"); rcode != rcodeNxdomain {
+		t.Errorf("Expected the deleted record to be gone after a restart, got rcode %v", rcode)
+	}
+	// The updates were journaled, so secondaries can catch up with IXFR.
+	if answers := testIXFR(t, restarted, 1); len(answers) != 6 {
+		t.Errorf("Expected an incremental transfer of 6 records from serial 1, got %v", answers)
+	}
+}
+
+// TestUpdateKeywordNames ensures names added by UPDATE that look like keywords or record types are written to the
+// zone file so that they're read back as names.
+func TestUpdateKeywordNames(t *testing.T) {
+	dir := t.TempDir()
+	testZoneFile(t, dir, 1, "allow-update 127.0.0.1")
+	server := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := server.LoadZones(); err != nil {
+		t.Fatalf("Could not load zones: %v", err)
+	}
+
+	names := []Domain{"notify.example.com", "zone.example.com", "MX.example.com", "TYPE1.example.com"}
+	var updates []RR
+	for _, name := range names {
+		updates = append(updates, RR{Name: name, Type: TypeA, Class: QClassIN, TTL: 60,
+			RData: RData{Type: TypeA, Addr: netip.MustParseAddr("192.0.2.1")}})
+	}
+	if rcode := testUpdate(t, server, "127.0.0.1", nil, updates); rcode != rcodeNoError {
+		t.Fatalf("UPDATE failed with rcode %v", rcode)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(dir, "example.zone"))
+	if err != nil {
+		t.Fatalf("Could not read the rewritten zone file: %v", err)
+	}
+	if !strings.Contains(string(contents), "\nnotify.example.com. A 192.0.2.1") {
+		t.Errorf("Expected notify to be written fully qualified, got:\n%s", contents)
+	}
+	restarted := NewServer(testZoneTrie(t), Config{ZonePath: dir})
+	if err := restarted.LoadZones(); err != nil {
+		t.Fatalf("Could not load the rewritten zone file: %v", err)
+	}
+	for _, name := range names {
+		if _, addr := testLookup(t, restarted, name); addr != "192.0.2.1" {
+			t.Errorf("Expected the record added for %v after a restart, got %q", name, addr)
+		}
+	}
+}
@@ -1,13 +1,16 @@
-package main
+package dns
 
 import (
 	"bufio"
 	"errors"
 	"fmt"
 	"iter"
+	"maps"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -15,10 +18,39 @@ import (
 
 type RecordName string // E.g. wow.example, *.example for zone "com."
 
+// QueryResult describes what a zone knows about a queried name.
+type QueryResult int
+
+const (
+	ResultNXDomain         QueryResult = iota // The name doesn't exist.
+	ResultFound                               // The name has records.
+	ResultWildcard                            // The name doesn't exist, but records were synthesised from a wildcard.
+	ResultEmptyNonTerminal                    // The name has no records, but names below it do (RFC 8020).
+	ResultDelegation                          // The name is at or below a zone cut. The RRSet is that of the cut.
+	ResultDNAME                               // The name is below a DNAME record. The RRSet is that of its owner.
+)
+
 type Zone struct {
-	Name    Domain // Domain the zone is responsible for.
-	TTL     uint   // Default TTL in seconds
-	Records map[string]RRSet
+	Name    Domain           // Domain the zone is responsible for.
+	TTL     uint             // Default TTL in seconds
+	Records map[string]RRSet // Keyed by lowercase record name relative to the zone, "" for the apex.
+	names   Trie[struct{}]   // Name tree of Records, with the apex at the root. Nodes without a value are empty non-terminals.
+
+	File            string           // Path of the zone file the zone was loaded from, "" if it isn't from a zone file.
+	AllowTransfer   ACL              // Clients which may transfer the zone.
+	Journal         *Journal         // Changes to the zone, for IXFR. nil if the zone isn't from a zone file.
+	Primary         netip.AddrPort   // Server the zone is transferred from, if this is a secondary zone.
+	AllowNotify     ACL              // Clients other than the primary which may send NOTIFY for the zone.
+	Notify          []netip.AddrPort // Secondaries which are sent NOTIFY when the zone changes.
+	AllowUpdate     ACL              // Clients which may send dynamic updates for the zone.
+	PTRFrom         []Domain         // Forward zones whose address records the zone is given PTR records for.
+	TSIGKey         Domain           // Key to sign transfer requests to the primary and NOTIFYs with, "" for none.
+	DNSSECKeyFiles  []string         // Paths of the zone's DNSSEC keys as given in the zone file.
+	DNSSECKeys      []*DNSSECKey     // Keys the zone is signed with online. Their DNSKEY records are at the apex.
+	Denial          Denial           // How nonexistence is proven in signed replies.
+	NSEC3Iterations uint16           // Extra hash iterations for NSEC3 denial.
+	NSEC3Salt       []byte           // Salt for NSEC3 denial.
+	chain           *denialChain     // Built by NewZoneTrie for signed zones, nil whenever the records change.
 }
 
 type RRSet struct {
@@ -27,19 +59,24 @@ type RRSet struct {
 	RRSet    map[RecType][]RData
 }
 
-// Matches valid record names like "example" and "*.example", "@"
-var recordNameRegex *regexp.Regexp = regexp.MustCompile(`^(?:@|\*|(?:\*\.)?(?:[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?)(?:\.(?:[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?))*)$`)
+// Matches valid record names like "example" and "*.example", "@". Labels may have underscores, as in "_sip._tcp".
+var recordNameRegex *regexp.Regexp = regexp.MustCompile(`^(?:@|\*|(?:\*\.)?(?:[A-Za-z0-9_](?:[A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?)(?:\.(?:[A-Za-z0-9_](?:[A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?))*)$`)
 
 func NewZone() Zone {
 	return Zone{
 		Records: make(map[string]RRSet),
+		names:   NewTrie[struct{}](),
 	}
 }
 
+// NewZoneTrie builds the trie zones are served from, giving signed zones their denial chains.
 func NewZoneTrie(zones map[Domain]Zone) Trie[Zone] {
 	trie := NewTrie[Zone]()
 	for _, zone := range zones {
-		trie.Insert(string(zone.Name), zone)
+		if (len(zone.DNSSECKeys) > 0 || zone.presigned()) && zone.chain == nil {
+			zone.chain = newDenialChain(&zone)
+		}
+		trie.Insert(strings.ToLower(string(zone.Name)), zone)
 	}
 	return trie
 }
@@ -99,61 +136,324 @@ func (r *RRSet) CNAME() RData {
 }
 
 // Insert will add the given record to RRSet.
+// The RRSIG and NSEC records of a CNAME are the only records allowed beside it (RFC 4035 section 2.5).
 func (r *RRSet) Insert(record RData) error {
 	recIsCNAME := record.Type == TypeCNAME
-	if r.HasCNAME {
+	dnssec := record.Type == TypeRRSIG || record.Type == TypeNSEC
+	if r.HasCNAME && !dnssec {
 		errStr := fmt.Sprintf("%v is a CNAME and cannot have any other records", record.Name)
 		return errors.New(errStr)
 	}
-	if recIsCNAME && !r.Empty {
-		errStr := fmt.Sprintf("Cannot add CNAME %v, other records cannot exist beside a CNAME", record.Name)
+	for t := range r.RRSet {
+		if recIsCNAME && t != TypeRRSIG && t != TypeNSEC {
+			errStr := fmt.Sprintf("Cannot add CNAME %v, other records cannot exist beside a CNAME", record.Name)
+			return errors.New(errStr)
+		}
+	}
+	// An ALIAS record stands in for the A and AAAA records of its owner.
+	address := record.Type == TypeA || record.Type == TypeAAAA
+	if record.Type == TypeALIAS && len(r.RRSet[TypeALIAS])+len(r.RRSet[TypeA])+len(r.RRSet[TypeAAAA]) > 0 ||
+		address && len(r.RRSet[TypeALIAS]) > 0 {
+		errStr := fmt.Sprintf("%v can only have one ALIAS record, and no A or AAAA records beside it", record.Name)
 		return errors.New(errStr)
 	}
 	r.RRSet[record.Type] = append(r.RRSet[record.Type], record)
 	r.Empty = false
-	r.HasCNAME = recIsCNAME
+	r.HasCNAME = r.HasCNAME || recIsCNAME
 	return nil
 }
 
 // Query will return a RRSet for the given name. Name is taken to be the subdomain within the zone.
 // E.g. "x" for x.example.com in zone example.com. "" is taken to mean the zone root.
-// If an exact match isn't found, a wildcard lookup will be attempted and returned if successful.
-// If no match can be found, the returned bool will be false. If a match is returned the bool will be true.
-func (z *Zone) Query(name Domain) (RRSet, bool, error) {
+// If an exact match isn't found, the wildcard at the closest encloser of name is used if there is one (RFC 4592).
+// Wildcards therefore never match names which exist in the zone, or names below them.
+// The records of a wildcard match keep the wildcard's RecordName. It's up to the caller to use the queried name
+// as the owner. An empty non-terminal wildcard gives ResultEmptyNonTerminal, just like an exact match would.
+// Names at or below a delegation (NS records anywhere below the apex) give ResultDelegation and the RRSet of the
+// zone cut, as the data there isn't authoritative.
+// Names below a DNAME record give ResultDNAME and the RRSet of the DNAME's owner, as they're all redirected.
+// The returned RRSet is only meaningful if the result is ResultFound, ResultWildcard, ResultDelegation or
+// ResultDNAME.
+func (z *Zone) Query(name Domain) (RRSet, QueryResult, error) {
 	if name.FQDN() {
-		return RRSet{}, false, errors.New("Queried name cannot be an FQDN.")
+		return RRSet{}, ResultNXDomain, errors.New("Queried name cannot be an FQDN.")
+	}
+
+	nameStr := strings.ToLower(name.String())
+	if cut, ok := z.ZoneCut(nameStr); ok {
+		return z.Records[cut], ResultDelegation, nil
+	}
+	if owner, ok := z.DNAMEAbove(nameStr); ok {
+		return z.Records[owner], ResultDNAME, nil
 	}
 
-	nameStr := name.String()
 	RRSet, ok := z.Records[nameStr]
 	if ok {
-		return RRSet, true, nil
+		return RRSet, ResultFound, nil
+	}
+
+	encloser, exists := z.names.Closest(nameStr)
+	if exists {
+		return RRSet, ResultEmptyNonTerminal, nil
+	}
+
+	// No exact match, so the name doesn't exist. Try the source of synthesis: the wildcard at the closest encloser.
+	wildcard := WildcardAt(encloser)
+	RRSet, ok = z.Records[wildcard]
+	if ok {
+		return RRSet, ResultWildcard, nil
+	}
+	if _, exists := z.names.Closest(wildcard); exists {
+		return RRSet, ResultEmptyNonTerminal, nil
+	}
+	return RRSet, ResultNXDomain, nil
+}
+
+// ZoneCut returns the highest delegation point at or above the (zone relative, lowercase) name, if there is one.
+// A delegation point is any name below the apex with NS records.
+func (z *Zone) ZoneCut(name string) (string, bool) {
+	labels := labelsFor(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		ancestor := strings.Join(labels[i:], ".")
+		if rrset, ok := z.Records[ancestor]; ok && len(rrset.RRSet[TypeNS]) > 0 {
+			return ancestor, true
+		}
+	}
+	return "", false
+}
+
+// DNAMEAbove returns the owner of the DNAME record at an ancestor of the (zone relative, lowercase) name, if
+// there is one. A DNAME record redirects the names below its owner, but not the owner itself (RFC 6672 section 2.3).
+func (z *Zone) DNAMEAbove(name string) (string, bool) {
+	labels := labelsFor(name)
+	for i := len(labels); i > 0; i-- {
+		ancestor := strings.Join(labels[i:], ".")
+		if rrset, ok := z.Records[ancestor]; ok && len(rrset.RRSet[TypeDNAME]) > 0 {
+			return ancestor, true
+		}
+	}
+	return "", false
+}
+
+// Glue returns the address records the zone has for the target of an NS record, if the target is in the zone.
+// No wildcards are used. Addresses below zone cuts are returned, as that's where glue lives.
+func (z *Zone) Glue(target Domain) []RR {
+	if !z.Contains(target) {
+		return nil
 	}
+	rrset := z.Records[queryStr(z, target).String()]
+	var glue []RR
+	for _, t := range []RecType{TypeA, TypeAAAA} {
+		for rdata := range rrset.Get(t) {
+			glue = append(glue, z.RR(rdata, target))
+		}
+	}
+	return glue
+}
 
-	// No exact match, try a wildcard match by replacing the leftmost label with *
-	_, after, _ := strings.Cut(nameStr, ".")
-	sep := "."
-	if after == "" {
-		sep = ""
+// Contains reports whether the absolute domain name is the zone apex or below it.
+func (z *Zone) Contains(name Domain) bool {
+	nameFQDN := strings.ToLower(name.AsFQDN().String())
+	zoneName := strings.ToLower(z.Name.String())
+	return nameFQDN == zoneName || strings.HasSuffix(nameFQDN, "."+zoneName)
+}
+
+// AbsoluteName returns the absolute domain name for the (zone relative) name.
+func (z *Zone) AbsoluteName(name string) Domain {
+	if name == "" {
+		return z.Name
+	}
+	return Domain(name + "." + z.Name.String())
+}
+
+// WildcardAt returns the (zone relative) wildcard name directly below name. E.g. "*.x" for "x", "*" for the apex.
+func WildcardAt(name string) string {
+	if name == "" {
+		return "*"
 	}
-	nameStr = "*" + sep + after
+	return "*." + name
+}
 
-	RRSet, ok = z.Records[nameStr]
-	return RRSet, ok, nil
+// SOA returns the SOA record of the zone, if it has one.
+func (z *Zone) SOA() (RData, bool) {
+	apex := z.Records[""]
+	if len(apex.RRSet[TypeSOA]) == 0 {
+		return RData{}, false
+	}
+	return apex.RRSet[TypeSOA][0], true
+}
+
+// NegativeSOA returns the SOA record for the authority section of NXDOMAIN and NODATA replies (RFC 2308).
+// Its TTL is the negative caching TTL: the smaller of the SOA record's TTL and its MINIMUM field.
+// The returned bool is false if the zone has no SOA record.
+func (z *Zone) NegativeSOA() (RR, bool) {
+	soa, ok := z.SOA()
+	if !ok {
+		return RR{}, false
+	}
+	rr := z.RR(soa, z.Name)
+	rr.TTL = min(rr.TTL, soa.Minimum)
+	return rr, true
+}
+
+// RR converts r, a record of the zone, into an RR owned by name. The zone's default TTL is applied if needed.
+func (z *Zone) RR(r RData, name Domain) RR {
+	rr := r.RR(name)
+	rr.TTL = uint32(r.TTLOrDefault(*z))
+	return rr
+}
+
+// Secondary reports whether the zone is a secondary zone, transferred from a primary server.
+// A secondary zone without an SOA record hasn't been transferred yet, or has expired.
+func (z *Zone) Secondary() bool {
+	return z.Primary.IsValid()
+}
+
+// presigned reports whether the zone was signed offline, e.g. by cmd/zone-sign: it has RRSIG records at its apex,
+// and no DNSSEC keys to sign with online.
+func (z *Zone) presigned() bool {
+	return len(z.DNSSECKeys) == 0 && len(z.Records[""].RRSet[TypeRRSIG]) > 0
+}
+
+// hasALIAS reports whether the zone has any ALIAS records.
+func (z *Zone) hasALIAS() bool {
+	for _, rrset := range z.Records {
+		if len(rrset.RRSet[TypeALIAS]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// All is an iterator over every record in the zone as an RR, with its absolute owner name.
+// Names are yielded in sorted order, and the records of each RRset together.
+func (z *Zone) All() iter.Seq[RR] {
+	return func(yield func(RR) bool) {
+		for _, name := range slices.Sorted(maps.Keys(z.Records)) {
+			rrset := z.Records[name]
+			owner := z.AbsoluteName(name)
+			for _, t := range slices.Sorted(maps.Keys(rrset.RRSet)) {
+				for rdata := range rrset.Get(t) {
+					if !yield(z.RR(rdata, owner)) {
+						return
+					}
+				}
+			}
+		}
+	}
 }
 
 // Insert will insert the record into the zone.
+// There can be no names below a DNAME record, as it redirects them all (RFC 6672 section 2.4), apart from the
+// hashed names of NSEC3 records at the apex.
 func (z *Zone) Insert(record RData) error {
-	recName := record.Name.String()
+	recName := strings.ToLower(record.Name.String())
 	if record.Name.Root() {
 		recName = "" // An empty key yields the root node.
 	}
+	if owner, ok := z.DNAMEAbove(recName); ok && !nsec3Data(record) {
+		errStr := fmt.Sprintf("%v is below the DNAME record of %v, so it can't have records", record.Name, z.AbsoluteName(owner))
+		return errors.New(errStr)
+	}
 	val, ok := z.Records[recName]
 	if !ok {
 		val = NewRRSet()
 	}
-	val.Insert(record)
+	if record.Type == TypeDNAME {
+		if len(val.RRSet[TypeDNAME]) > 0 {
+			errStr := fmt.Sprintf("%v can't have more than one DNAME record", record.Name)
+			return errors.New(errStr)
+		}
+		if z.hasNamesBelow(recName) {
+			errStr := fmt.Sprintf("%v can't have a DNAME record, as there are names below it", record.Name)
+			return errors.New(errStr)
+		}
+	}
+	if err := val.Insert(record); err != nil {
+		return err
+	}
 	z.Records[recName] = val
+	z.names.Insert(recName, struct{}{})
+	z.chain = nil
+	return nil
+}
+
+// hasNamesBelow reports whether the zone has records at names below the (zone relative, lowercase) name, other
+// than NSEC3 records and their signatures.
+func (z *Zone) hasNamesBelow(name string) bool {
+	for other, rrset := range z.Records {
+		if other == name || (name != "" && !strings.HasSuffix(other, "."+name)) {
+			continue
+		}
+		for record := range rrset.GetAll() {
+			if !nsec3Data(record) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsec3Data reports whether record is an NSEC3 record or the signature of one, which live at hashed names below
+// the apex whatever the apex has.
+func nsec3Data(record RData) bool {
+	return record.Type == TypeNSEC3 || (record.Type == TypeRRSIG && record.TypeCovered == TypeNSEC3)
+}
+
+// InsertRR will insert rr, a record with an absolute owner name, into the zone.
+func (z *Zone) InsertRR(rr RR) error {
+	if !z.Contains(rr.Name) {
+		errStr := fmt.Sprintf("%v is not in zone %v", rr.Name, z.Name)
+		return errors.New(errStr)
+	}
+	record := rr.RData
+	record.Type = rr.Type
+	record.TTL = uint(rr.TTL)
+	record.Name = RecordName(queryStr(z, rr.Name))
+	if record.Name == "" {
+		record.Name = "@"
+	}
+	return z.Insert(record)
+}
+
+// WithRecords returns a copy of the zone with its records replaced by rrs, records with absolute owner names.
+// The copy has its own journal, so z isn't affected by changes to it.
+// If the zone has DNSSEC keys, the DNSKEY and NSEC3PARAM records of rrs are replaced by those of the zone.
+func (z *Zone) WithRecords(rrs []RR) (Zone, error) {
+	zone := *z
+	zone.Records = make(map[string]RRSet)
+	zone.names = NewTrie[struct{}]()
+	zone.chain = nil
+	if z.Journal != nil {
+		journal := *z.Journal
+		zone.Journal = &journal
+	}
+	for _, rr := range rrs {
+		if (rr.Type == TypeDNSKEY || rr.Type == TypeNSEC3PARAM) && len(z.DNSSECKeys) > 0 {
+			continue
+		}
+		if err := zone.InsertRR(rr); err != nil {
+			return zone, err
+		}
+	}
+	return zone, zone.insertDNSSECRecords()
+}
+
+// insertDNSSECRecords will insert the DNSKEY records of the zone's DNSSEC keys at its apex, and its NSEC3PARAM
+// record if it uses NSEC3.
+func (z *Zone) insertDNSSECRecords() error {
+	if len(z.DNSSECKeys) == 0 {
+		return nil
+	}
+	records := dnskeyRecords(z.DNSSECKeys)
+	if z.Denial == DenialNSEC3 {
+		records = append(records, z.nsec3Param())
+	}
+	for _, record := range records {
+		if err := z.Insert(record); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -215,23 +515,23 @@ func getZoneFilePaths(zoneDirPath string) ([]string, error) {
 	return files, nil
 }
 
-// parseZoneFiles takes a list of zone file paths, parses each one into a Zone object,
-// and returns a trie of Zones for fast lookup.
-// Please note the returned Trie should be searched via FQDN, as the root zone is "".
-func ParseZoneFiles(zoneDirPath string) (Trie[Zone], error) {
+// LoadZoneFiles parses every zone file under zoneDirPath, along with its journal and DNSSEC keys, into a map of
+// Zones by name. The journal of zone file x.zone is x.zone.jnl. Relative key paths are relative to the zone file.
+// Secondary zones are returned without their records.
+func LoadZoneFiles(zoneDirPath string) (map[Domain]Zone, error) {
 	log.Debugf("Parsing zone files in %s", zoneDirPath)
 	zoneFiles, err := getZoneFilePaths(zoneDirPath)
 	if err != nil {
 		s := fmt.Sprintf("Couldn't gather zone files in %v: %v", zoneDirPath, err)
 		err := errors.New(s)
-		return Trie[Zone]{}, err
+		return nil, err
 	}
 
 	var zones map[Domain]Zone = make(map[Domain]Zone)
 	for _, file := range zoneFiles {
 		zoneFile, err := os.Open(file)
 		if err != nil {
-			return NewTrie[Zone](), err
+			return nil, err
 		}
 		zoneReader := bufio.NewReader(zoneFile)
 		lexer := NewLexer(zoneReader)
@@ -239,14 +539,32 @@ func ParseZoneFiles(zoneDirPath string) (Trie[Zone], error) {
 		zone, err := parser.Parse()
 		zoneFile.Close()
 		if err != nil {
-			return NewTrie[Zone](), err
+			return nil, err
 		}
 		if _, exists := zones[zone.Name]; exists {
 			errStr := fmt.Sprintf("Duplicate zone: %v", zone.Name)
-			return NewTrie[Zone](), errors.New(errStr)
+			return nil, errors.New(errStr)
+		}
+		zone.File = file
+		zone.Journal, err = LoadJournal(file + ".jnl")
+		if err != nil {
+			return nil, err
+		}
+		for _, keyFile := range zone.DNSSECKeyFiles {
+			if !filepath.IsAbs(keyFile) {
+				keyFile = filepath.Join(filepath.Dir(file), keyFile)
+			}
+			key, err := LoadDNSSECKey(keyFile)
+			if err != nil {
+				return nil, err
+			}
+			zone.DNSSECKeys = append(zone.DNSSECKeys, key)
+		}
+		if err := zone.insertDNSSECRecords(); err != nil {
+			return nil, err
 		}
 		zones[zone.Name] = zone
 	}
 
-	return NewZoneTrie(zones), nil
+	return zones, nil
 }
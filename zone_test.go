@@ -0,0 +1,116 @@
+package dns
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// rfc4592Zone builds the example zone from RFC 4592 section 2.2.1.
+func rfc4592Zone(t *testing.T) Zone {
+	zone := NewZone()
+	zone.Name = "example."
+	zone.TTL = 3600
+	records := []RData{
+		{Name: "@", Type: TypeSOA, MName: "ns.example.com.", RName: "hostmaster.example.", Serial: 1, Minimum: 300},
+		{Name: "@", Type: TypeNS, Target: "ns.example.com."},
+		{Name: "@", Type: TypeNS, Target: "ns.example.net."},
+		{Name: "*", Type: TypeTXT, TXT: NewTXTData("this is a wildcard")},
+		{Name: "*", Type: TypeMX, Pref: 10, Target: "host1.example."},
+		{Name: "sub.*", Type: TypeTXT, TXT: NewTXTData("this is not a wildcard")},
+		{Name: "host1", Type: TypeA, Addr: netip.MustParseAddr("192.0.2.1")},
+		// These are SRV records in the RFC. Only the existence of the names matters for these tests.
+		{Name: "_ssh._tcp.host1", Type: TypeTXT, TXT: NewTXTData("srv")},
+		{Name: "_ssh._tcp.host2", Type: TypeTXT, TXT: NewTXTData("srv")},
+		{Name: "subdel", Type: TypeNS, Target: "ns.example.com."},
+		{Name: "subdel", Type: TypeNS, Target: "ns.example.net."},
+	}
+	for _, record := range records {
+		if err := zone.Insert(record); err != nil {
+			t.Fatalf("Could not insert %+v into zone: %v", record, err)
+		}
+	}
+	return zone
+}
+
+// TestWildcardRFC4592 runs the example queries of RFC 4592 section 2.2.1 against the zone model.
+func TestWildcardRFC4592(t *testing.T) {
+	zone := rfc4592Zone(t)
+	tests := []struct {
+		name    Domain
+		qtype   RecType
+		result  QueryResult
+		answers int
+	}{
+		// Synthesised from a wildcard.
+		{"host3", TypeMX, ResultWildcard, 1},
+		{"host3", TypeA, ResultWildcard, 0}, // No error, no data.
+		{"foo.bar", TypeTXT, ResultWildcard, 1},
+		// Not synthesised.
+		{"host1", TypeMX, ResultFound, 0},                  // host1.example. exists.
+		{"sub.*", TypeMX, ResultFound, 0},                  // sub.*.example. exists.
+		{"_telnet._tcp.host1", TypeTXT, ResultNXDomain, 0}, // _tcp.host1.example. is the closest encloser.
+		{"ghost.*", TypeMX, ResultNXDomain, 0},             // *.example. is the closest encloser.
+		{"host.subdel", TypeA, ResultDelegation, 0},        // Below a zone cut, so a referral.
+		// Empty non-terminals aren't matched by wildcards either.
+		{"_tcp.host1", TypeTXT, ResultEmptyNonTerminal, 0},
+	}
+
+	for _, test := range tests {
+		rrset, result, err := zone.Query(test.name)
+		if err != nil {
+			t.Errorf("%v %v: unexpected error: %v", test.name, test.qtype, err)
+			continue
+		}
+		if result != test.result {
+			t.Errorf("%v %v: expected result %v, got %v", test.name, test.qtype, test.result, result)
+		}
+		answers := 0
+		for range rrset.Get(test.qtype) {
+			answers++
+		}
+		if answers != test.answers {
+			t.Errorf("%v %v: expected %v answers, got %v", test.name, test.qtype, test.answers, answers)
+		}
+	}
+}
+
+// TestWildcardOwner ensures records synthesised from a wildcard are owned by the queried name.
+func TestWildcardOwner(t *testing.T) {
+	zones := testZoneTrie(t, rfc4592Zone(t))
+	reply := testRespond(t, NewServer(zones, Config{}), testQuery("a.b.host3.example", TypeTXT))
+	if reply.Header.Rcode != rcodeNoError || len(reply.Answer) != 1 {
+		t.Fatalf("Expected one answer, got RCODE %v and %v answers", reply.Header.Rcode, len(reply.Answer))
+	}
+	if owner := reply.Answer[0].Name; owner != "a.b.host3.example" {
+		t.Errorf("Synthesised record owned by %v, expected the query name", owner)
+	}
+}
+
+// TestDelegation ensures queries at or below a zone cut get a referral with glue.
+func TestDelegation(t *testing.T) {
+	zones := testZoneTrie(t, testZone(t, "example.com.",
+		RData{Name: "@", Type: TypeNS, Target: "ns.example.com."},
+		RData{Name: "ns", Type: TypeA, Addr: netip.MustParseAddr("192.0.2.1")},
+		RData{Name: "sub", Type: TypeNS, Target: "ns1.sub.example.com."},
+		RData{Name: "sub", Type: TypeNS, Target: "ns.example.net."},
+		RData{Name: "ns1.sub", Type: TypeA, Addr: netip.MustParseAddr("192.0.2.53")},
+		RData{Name: "ns1.sub", Type: TypeAAAA, Addr: netip.MustParseAddr("2001:db8::53")},
+	))
+	server := NewServer(zones, Config{})
+
+	for _, name := range []Domain{"host.sub.example.com", "sub.example.com", "ns1.sub.example.com"} {
+		reply := testRespond(t, server, testQuery(name, TypeA))
+		if reply.Header.AA || reply.Header.Rcode != rcodeNoError {
+			t.Errorf("%v: expected a non-authoritative NOERROR referral, got %+v", name, reply.Header)
+		}
+		if len(reply.Answer) != 0 {
+			t.Errorf("%v: expected no answers in a referral, got %v", name, reply.Answer)
+		}
+		if len(reply.Authority) != 2 || reply.Authority[0].Type != TypeNS || reply.Authority[0].Name != "sub.example.com" {
+			t.Errorf("%v: expected the delegation NS RRset in the authority section, got %v", name, reply.Authority)
+		}
+		if len(reply.Additional) != 2 {
+			t.Errorf("%v: expected A and AAAA glue for ns1.sub, got %v", name, reply.Additional)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package dns
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ZoneFile returns the zone in zone file format, as read by Parser.
+// Comments and the layout of the file the zone was loaded from aren't kept.
+func (z *Zone) ZoneFile() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "zone %v\n", z.Name)
+	if z.TTL != 0 {
+		fmt.Fprintf(&b, "ttl %v\n", z.TTL)
+	}
+	if soa, ok := z.SOA(); ok {
+		fmt.Fprintf(&b, "soa %v\n", soa.DataString())
+	}
+	if z.Secondary() {
+		fmt.Fprintf(&b, "primary %v\n", z.Primary)
+	}
+	if z.TSIGKey != "" {
+		fmt.Fprintf(&b, "tsig-key %v\n", z.TSIGKey)
+	}
+	for _, keyFile := range z.DNSSECKeyFiles {
+		fmt.Fprintf(&b, "dnssec-key %v\n", quoteString(keyFile))
+	}
+	switch z.Denial {
+	case DenialNSEC3:
+		fmt.Fprintf(&b, "denial nsec3 %v %v\n", z.NSEC3Iterations, saltString(z.NSEC3Salt))
+	case DenialCompact:
+		fmt.Fprintf(&b, "denial compact\n")
+	}
+	acls := []struct {
+		keyword string
+		acl     ACL
+	}{
+		{"allow-transfer", z.AllowTransfer},
+		{"allow-notify", z.AllowNotify},
+		{"allow-update", z.AllowUpdate},
+	}
+	for _, acl := range acls {
+		if len(acl.acl) > 0 {
+			fmt.Fprintf(&b, "%v %v\n", acl.keyword, acl.acl)
+		}
+	}
+	if len(z.Notify) > 0 {
+		targets := make([]string, len(z.Notify))
+		for i, target := range z.Notify {
+			targets[i] = target.String()
+		}
+		fmt.Fprintf(&b, "notify %v\n", strings.Join(targets, " "))
+	}
+	if len(z.PTRFrom) > 0 {
+		names := make([]string, len(z.PTRFrom))
+		for i, name := range z.PTRFrom {
+			names[i] = name.String()
+		}
+		fmt.Fprintf(&b, "ptr-from %v\n", strings.Join(names, " "))
+	}
+
+	b.WriteString("\n")
+	for _, name := range slices.Sorted(maps.Keys(z.Records)) {
+		rrset := z.Records[name]
+		owner := name
+		if owner == "" {
+			owner = "@"
+		}
+		// A name that would be read back as a keyword, e.g. notify, is written fully qualified.
+		if stringIsAny(owner, Keywords[:]) {
+			owner = z.AbsoluteName(owner).String()
+		}
+		for _, t := range slices.Sorted(maps.Keys(rrset.RRSet)) {
+			if t == TypeSOA || (slices.Contains(dnssecTypes, t) && len(z.DNSSECKeys) > 0) {
+				continue // Given by the soa, dnssec-key and denial keywords.
+			}
+			for rdata := range rrset.Get(t) {
+				if rdata.generated {
+					continue // Made from the zones given by ptr-from.
+				}
+				fmt.Fprintf(&b, "%v %v %v", owner, t, rdata.DataString())
+				if rdata.TTL != 0 && rdata.TTL != z.TTL {
+					fmt.Fprintf(&b, " %v", rdata.TTL)
+				}
+				b.WriteString("\n")
+			}
+		}
+	}
+	return []byte(b.String())
+}
+
+// WriteFile will write the zone back to the zone file it was loaded from.
+func (z *Zone) WriteFile() error {
+	return writeFileAtomic(z.File, z.ZoneFile())
+}
+
+// writeFileAtomic will replace the file at path with data. A temporary file is renamed over it, so a crash never
+// leaves a partially written file. The permissions of the file are kept.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}